@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/nictuku/Taipei-Torrent/taipei"
+)
+
+// create implements the create subcommand, which makes a .torrent file.
+func create(args []string) {
+	fs := flag.NewFlagSet("create", flag.ExitOnError)
+	var opts taipei.CreateOptions
+	output := fs.String("o", "", "Where to write the torrent. Defaults to the name of the content, plus .torrent.")
+	fs.Int64Var(&opts.PieceLength, "pieceLength", 0, "Piece length in bytes, a power of two. 0 picks one from the size.")
+	fs.StringVar(&opts.Announce, "announce", "", "Tracker announce URL.")
+	announceList := fs.String("announceList", "", "Tiers of trackers: tiers separated by ';', "+
+		"trackers of a tier by ','.")
+	fs.BoolVar(&opts.Private, "private", false, "Only get peers from the trackers.")
+	fs.StringVar(&opts.Comment, "comment", "", "Comment.")
+	fs.StringVar(&opts.CreatedBy, "createdBy", "Taipei-Torrent", "Name of the program that made the torrent.")
+	noDate := fs.Bool("noDate", false, "Leave out the creation date.")
+	webSeeds := fs.String("webSeeds", "", "Comma separated web seed URLs.")
+	fs.Usage = func() {
+		log.Printf("usage: Taipei-Torrent create [options] (file | directory)")
+		fs.PrintDefaults()
+		os.Exit(2)
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+	}
+	root := fs.Arg(0)
+
+	if *announceList != "" {
+		for _, tier := range strings.Split(*announceList, ";") {
+			opts.AnnounceList = append(opts.AnnounceList, strings.Split(tier, ","))
+		}
+	}
+	if !*noDate {
+		opts.CreationDate = time.Now()
+	}
+	if *webSeeds != "" {
+		opts.WebSeeds = strings.Split(*webSeeds, ",")
+	}
+	if *output == "" {
+		*output = filepath.Base(filepath.Clean(root)) + ".torrent"
+	}
+
+	f, err := os.Create(*output)
+	if err != nil {
+		log.Fatal(err)
+	}
+	infoHash, err := taipei.CreateTorrent(f, root, &opts)
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+		os.Remove(*output)
+	}
+	if err != nil {
+		log.Fatal("Could not create the torrent: ", err)
+	}
+	log.Printf("Wrote %v, info hash %x", *output, infoHash)
+}
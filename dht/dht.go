@@ -75,17 +75,22 @@ type DHTEngine struct {
 	nodeId string
 	port   int
 
-	routingTable *routingTable
+	routingTable  *routingTable
+	routingTable6 *routingTable // IPv6 nodes (BEP 32).
 
 	infoHashPeers    map[string]map[string]int // key1 == infoHash, key2 == address in binary form. value=ignored.
 	activeInfoHashes map[string]bool           // infoHashes for which we are peers.
 	numTargetPeers   int
 	conn             *net.UDPConn
+	conn6            *net.UDPConn // Nil if IPv6 isn't available.
+	ready            chan bool    // Closed once conn and conn6 are listening.
+	shared           *sharedConn
 	Logger           Logger
 
 	// Public channels:
 	remoteNodeAcquaintance chan string
 	peersRequest           chan peerReq
+	saveRequest            chan chan bool
 	PeersRequestResults    chan map[string][]string // key = infohash, v = slice of peers.
 	clientThrottle         *nettools.ClientThrottle
 
@@ -96,15 +101,18 @@ func NewDHTNode(port, numTargetPeers int, storeEnabled bool) (node *DHTEngine, e
 	node = &DHTEngine{
 		port:                port,
 		routingTable:        newRoutingTable(),
+		routingTable6:       newRoutingTable(),
 		PeersRequestResults: make(chan map[string][]string, 1),
 		// Buffer to avoid blocking on sends.
 		remoteNodeAcquaintance: make(chan string, 10),
 		// Buffer to avoid deadlocks and blocking on sends.
 		peersRequest:     make(chan peerReq, 10),
+		saveRequest:      make(chan chan bool),
 		infoHashPeers:    make(map[string]map[string]int),
 		activeInfoHashes: make(map[string]bool),
 		numTargetPeers:   numTargetPeers,
 		clientThrottle:   nettools.NewThrottler(),
+		ready:            make(chan bool),
 	}
 	c := openStore(port, storeEnabled)
 	node.store = c
@@ -141,6 +149,19 @@ func (d *DHTEngine) PeersRequest(ih string, announce bool) {
 	d.peersRequest <- peerReq{ih, announce}
 }
 
+// Port returns the UDP port the node was asked to listen on.
+func (d *DHTEngine) Port() int {
+	return d.port
+}
+
+// Save writes the routing table to the store now, instead of at the next
+// savePeriod tick. It must be called while DoDHT runs.
+func (d *DHTEngine) Save() {
+	done := make(chan bool)
+	d.saveRequest <- done
+	<-done
+}
+
 func (d *DHTEngine) RemoteNodeAcquaintance(addr string) {
 	d.remoteNodeAcquaintance <- addr
 }
@@ -148,6 +169,7 @@ func (d *DHTEngine) RemoteNodeAcquaintance(addr string) {
 // Asks for more peers for a torrent.
 func (d *DHTEngine) getPeers(infoHash string) {
 	closest := d.routingTable.lookupFiltered(infoHash)
+	closest = append(closest, d.routingTable6.lookupFiltered(infoHash)...)
 	for _, r := range closest {
 		go d.getPeersFrom(r, infoHash)
 	}
@@ -156,15 +178,30 @@ func (d *DHTEngine) getPeers(infoHash string) {
 // DoDHT is the DHT node main loop and should be run as a goroutine by the torrent client.
 func (d *DHTEngine) DoDHT() {
 	socketChan := make(chan packetType)
-	socket, err := listen(d.port)
-	if err != nil {
+	socket, err := listen("udp4", d.port)
+	socket6, err6 := listen("udp6", d.port)
+	if err != nil && err6 != nil {
+		l4g.Warn("DHT: Listen failed: %v, %v", err, err6)
 		return
 	}
-	d.conn = socket
-	go readFromSocket(socket, socketChan)
+	d.conn, d.conn6 = socket, socket6
+	close(d.ready)
+	var otherChan chan packetType
+	if d.shared != nil {
+		otherChan = d.shared.packets
+	}
+	if socket != nil {
+		go readFromSocket(socket, socketChan, otherChan)
+	}
+	if socket6 != nil {
+		go readFromSocket(socket6, socketChan, otherChan)
+	}
 
 	// Bootstrap the network.
 	d.ping(dhtRouter)
+	if router6, err := net.ResolveUDPAddr("udp6", dhtRouter); err == nil {
+		d.ping(router6.String())
+	}
 	cleanupTicker := time.Tick(cleanupPeriod)
 
 	saveTicker := make(<-chan time.Time)
@@ -209,27 +246,44 @@ func (d *DHTEngine) DoDHT() {
 			}
 		case <-cleanupTicker:
 			d.routingTable.cleanup()
+			d.routingTable6.cleanup()
 		case <-saveTicker:
-			tbl := d.routingTable.reachableNodes()
-			if len(tbl) > 5 {
-				d.store.Remotes = tbl
-				saveStore(*d.store)
+			d.saveRoutingTable()
+		case done := <-d.saveRequest:
+			if d.store != nil {
+				d.saveRoutingTable()
 			}
+			close(done)
 		}
 	}
 }
 
+func (d *DHTEngine) saveRoutingTable() {
+	tbl := d.routingTable.reachableNodes()
+	for addr, id := range d.routingTable6.reachableNodes() {
+		tbl[addr] = id
+	}
+	if len(tbl) > 5 {
+		d.store.Remotes = tbl
+		saveStore(*d.store)
+	}
+}
+
 func (d *DHTEngine) helloFromPeer(addr string) {
 	// We've got a new node id. We need to:
 	// - see if we know it already, skip accordingly.
 	// - ping it and see if it's reachable.
 	// - if it responds, save it in the routing table.
-	_, addrResolved, ok := d.routingTable.hostPortToNode(addr)
+	table := d.tableForHostPort(addr)
+	if table == nil {
+		return
+	}
+	_, addrResolved, ok := table.hostPortToNode(addr)
 	if ok {
 		// Node host+port already known.
 		return
 	}
-	if d.routingTable.length() < maxNodes {
+	if table.length() < maxNodes {
 		d.ping(addrResolved)
 		return
 	}
@@ -246,6 +300,7 @@ func (d *DHTEngine) process(p packetType) {
 		// there that we don't support or understand.
 		return
 	}
+	table := d.tableFor(p.raddr)
 	r, err := readResponse(p)
 	if err != nil {
 		l4g.Warn("DHT: readResponse Error: %v, %q", err, string(p.b))
@@ -254,10 +309,10 @@ func (d *DHTEngine) process(p packetType) {
 	switch {
 	// Response.
 	case r.Y == "r":
-		node, addr, ok := d.routingTable.hostPortToNode(p.raddr.String())
+		node, addr, ok := table.hostPortToNode(p.raddr.String())
 		if !ok {
 			l4g.Info("DHT: Received reply from a host we don't know: %v", p.raddr)
-			if d.routingTable.length() < maxNodes {
+			if table.length() < maxNodes {
 				d.ping(addr)
 			}
 			// TODO: Add this guy to a list of dubious hosts.
@@ -266,7 +321,7 @@ func (d *DHTEngine) process(p packetType) {
 		// Fix the node ID.
 		if node.id == "" {
 			node.id = r.R.Id
-			d.routingTable.update(node)
+			table.update(node)
 		}
 		if query, ok := node.pendingQueries[r.T]; ok {
 			if !node.reachable {
@@ -293,9 +348,9 @@ func (d *DHTEngine) process(p packetType) {
 			l4g.Info("DHT: Unknown query id: %v", r.T)
 		}
 	case r.Y == "q":
-		if _, addr, ok := d.routingTable.hostPortToNode(p.raddr.String()); !ok {
+		if _, addr, ok := table.hostPortToNode(p.raddr.String()); !ok {
 			// Another candidate for the routing table. See if it's reachable.
-			if d.routingTable.length() < maxNodes {
+			if table.length() < maxNodes {
 				d.ping(addr)
 			}
 		}
@@ -317,8 +372,54 @@ func (d *DHTEngine) process(p packetType) {
 	}
 }
 
+// tableFor returns the routing table for the address family of addr, or nil
+// if we have no socket for it.
+func (d *DHTEngine) tableFor(addr *net.UDPAddr) *routingTable {
+	if addr.IP.To4() != nil {
+		if d.conn == nil {
+			return nil
+		}
+		return d.routingTable
+	}
+	if d.conn6 == nil {
+		return nil
+	}
+	return d.routingTable6
+}
+
+func (d *DHTEngine) tableForHostPort(hostPort string) *routingTable {
+	addr, err := net.ResolveUDPAddr("udp", hostPort)
+	if err != nil {
+		return nil
+	}
+	return d.tableFor(addr)
+}
+
+// connFor returns the socket for the address family of addr.
+func (d *DHTEngine) connFor(addr *net.UDPAddr) *net.UDPConn {
+	if addr.IP.To4() != nil {
+		return d.conn
+	}
+	return d.conn6
+}
+
+// want lists the address families of the nodes we want in replies (BEP 32).
+func (d *DHTEngine) want() []string {
+	if d.conn6 == nil {
+		return []string{"n4"}
+	}
+	if d.conn == nil {
+		return []string{"n6"}
+	}
+	return []string{"n4", "n6"}
+}
+
 func (d *DHTEngine) ping(address string) {
-	r, err := d.routingTable.forceNode("", address)
+	table := d.tableForHostPort(address)
+	if table == nil {
+		return
+	}
+	r, err := table.forceNode("", address)
 	if err != nil {
 		l4g.Info("ping error: %v", err)
 		return
@@ -328,7 +429,7 @@ func (d *DHTEngine) ping(address string) {
 
 	queryArguments := map[string]interface{}{"id": d.nodeId}
 	query := queryMessage{t, "q", "ping", queryArguments}
-	sendMsg(d.conn, r.address, query)
+	sendMsg(d.connFor(r.address), r.address, query)
 	totalSentPing.Add(1)
 }
 
@@ -340,20 +441,25 @@ func (d *DHTEngine) getPeersFrom(r *DHTRemoteNode, ih string) {
 	queryArguments := map[string]interface{}{
 		"id":        d.nodeId,
 		"info_hash": ih,
+		"want":      d.want(),
 	}
 	query := queryMessage{transId, "q", ty, queryArguments}
 	l4g.Trace(func() string {
 		x := hashDistance(r.id, ih)
 		return fmt.Sprintf("DHT sending get_peers. nodeID: %x , InfoHash: %x , distance: %x", r.id, ih, x)
 	})
-	sendMsg(d.conn, r.address, query)
+	sendMsg(d.connFor(r.address), r.address, query)
 }
 
 // announcePeer sends a message to the destination address to advertise that
 // our node is a peer for this infohash, using the provided token to
 // 'authenticate'.
 func (d *DHTEngine) announcePeer(address *net.UDPAddr, ih string, token string) {
-	r, err := d.routingTable.forceNode("", address.String())
+	table := d.tableFor(address)
+	if table == nil {
+		return
+	}
+	r, err := table.forceNode("", address.String())
 	if err != nil {
 		l4g.Trace("announcePeer:", err)
 		return
@@ -368,7 +474,7 @@ func (d *DHTEngine) announcePeer(address *net.UDPAddr, ih string, token string)
 		"token":     token,
 	}
 	query := queryMessage{transId, "q", ty, queryArguments}
-	sendMsg(d.conn, address, query)
+	sendMsg(d.connFor(address), address, query)
 }
 
 func (d *DHTEngine) replyGetPeers(addr *net.UDPAddr, r responseType) {
@@ -390,22 +496,22 @@ func (d *DHTEngine) replyGetPeers(addr *net.UDPAddr, r responseType) {
 		R: r0,
 	}
 
-	if peers, ok := d.infoHashPeers[ih]; ok {
-		peerContacts := make([]string, 0, len(peers))
-		for p, _ := range peers {
+	// Only peers of the address family of the querying node are useful to
+	// it.
+	peerContacts := make([]string, 0, len(d.infoHashPeers[ih]))
+	for p, _ := range d.infoHashPeers[ih] {
+		if (len(p) == 18) == (addr.IP.To4() == nil) {
 			peerContacts = append(peerContacts, p)
 		}
+	}
+	if len(peerContacts) > 0 {
 		l4g.Trace("replyGetPeers: Giving peers! %v wanted %x, and we knew %d peers!", addr.String(), ih, len(peerContacts))
 		reply.R["values"] = peerContacts
 	} else {
-		n := make([]string, 0, kNodes)
-		for _, r := range d.routingTable.lookupFiltered(ih) {
-			n = append(n, r.id+nettools.DottedPortToBinary(r.address.String()))
-		}
-		l4g.Trace("replyGetPeers: Nodes only. Giving %d", len(n))
-		reply.R["nodes"] = strings.Join(n, "")
+		d.putNodes(reply.R, ih, addr, r.A.Want, true)
+		l4g.Trace("replyGetPeers: Nodes only.")
 	}
-	sendMsg(d.conn, addr, reply)
+	sendMsg(d.connFor(addr), addr, reply)
 }
 
 func (d *DHTEngine) replyFindNode(addr *net.UDPAddr, r responseType) {
@@ -426,14 +532,47 @@ func (d *DHTEngine) replyFindNode(addr *net.UDPAddr, r responseType) {
 	// XXX we currently can't give out the peer contact. Probably requires
 	// processing announce_peer.  XXX If there was a total match, that guy
 	// is the last.
-	neighbors := d.routingTable.lookup(node)
+	d.putNodes(reply.R, node, addr, r.A.Want, false)
+	l4g.Trace("replyFindNode: Nodes only.")
+	sendMsg(d.connFor(addr), addr, reply)
+}
+
+// putNodes adds the nodes closest to target to a reply: IPv4 nodes in
+// "nodes" and IPv6 nodes in "nodes6". Unless the query says which it wants,
+// only the address family of the querying node is given (BEP 32).
+func (d *DHTEngine) putNodes(reply map[string]interface{}, target string, addr *net.UDPAddr, want []string, filtered bool) {
+	n4, n6 := addr.IP.To4() != nil, addr.IP.To4() == nil
+	if len(want) > 0 {
+		n4, n6 = false, false
+		for _, w := range want {
+			switch w {
+			case "n4":
+				n4 = true
+			case "n6":
+				n6 = true
+			}
+		}
+	}
+	if n4 {
+		reply["nodes"] = compactNodes(d.routingTable, target, filtered)
+	}
+	if n6 {
+		reply["nodes6"] = compactNodes(d.routingTable6, target, filtered)
+	}
+}
+
+func compactNodes(table *routingTable, target string, filtered bool) string {
+	var nodes []*DHTRemoteNode
+	if filtered {
+		nodes = table.lookupFiltered(target)
+	} else {
+		nodes = table.lookup(target)
+	}
 	n := make([]string, 0, kNodes)
-	for _, r := range neighbors {
+	for _, r := range nodes {
 		n = append(n, r.id+nettools.DottedPortToBinary(r.address.String()))
 	}
-	l4g.Trace("replyFindNode: Nodes only. Giving %d", len(n))
-	reply.R["nodes"] = strings.Join(n, "")
-	sendMsg(d.conn, addr, reply)
+	return strings.Join(n, "")
 }
 
 func (d *DHTEngine) replyPing(addr *net.UDPAddr, response responseType) {
@@ -443,7 +582,7 @@ func (d *DHTEngine) replyPing(addr *net.UDPAddr, response responseType) {
 		Y: "r",
 		R: map[string]interface{}{"id": d.nodeId},
 	}
-	sendMsg(d.conn, addr, reply)
+	sendMsg(d.connFor(addr), addr, reply)
 }
 
 // Process another node's response to a get_peers query. If the response
@@ -473,23 +612,29 @@ func (d *DHTEngine) processGetPeerResults(node *DHTRemoteNode, resp responseType
 			d.PeersRequestResults <- result
 		}
 	}
-	if resp.R.Nodes != "" {
-		for id, address := range parseNodesString(resp.R.Nodes) {
-			// XXX
-			// If it's in our routing table already, ignore it.
-			_, addr, ok := d.routingTable.hostPortToNode(address)
-			if ok {
-				totalDupes.Add(1)
-			} else {
-				// And it is actually new. Interesting.
-				l4g.Trace(func() string {
-					x := hashDistance(query.ih, node.id)
-					return fmt.Sprintf("DHT: Got new node reference: %x@%v from %x@%v. Distance: %x.", id, address, node.id, addr, x)
-				})
-				if _, err := d.routingTable.forceNode(id, addr); err == nil {
-					if len(d.infoHashPeers[query.ih]) < d.numTargetPeers {
-						d.getPeers(query.ih)
-					}
+	nodes := parseNodesString(resp.R.Nodes, nodeContactLen)
+	for id, address := range parseNodesString(resp.R.Nodes6, nodeContactLen6) {
+		nodes[id] = address
+	}
+	for id, address := range nodes {
+		table := d.tableForHostPort(address)
+		if table == nil {
+			continue
+		}
+		// XXX
+		// If it's in our routing table already, ignore it.
+		_, addr, ok := table.hostPortToNode(address)
+		if ok {
+			totalDupes.Add(1)
+		} else {
+			// And it is actually new. Interesting.
+			l4g.Trace(func() string {
+				x := hashDistance(query.ih, node.id)
+				return fmt.Sprintf("DHT: Got new node reference: %x@%v from %x@%v. Distance: %x.", id, address, node.id, addr, x)
+			})
+			if _, err := table.forceNode(id, addr); err == nil {
+				if len(d.infoHashPeers[query.ih]) < d.numTargetPeers {
+					d.getPeers(query.ih)
 				}
 			}
 		}
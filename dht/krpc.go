@@ -37,6 +37,7 @@ type queryType struct {
 const (
 	maxUDPPacketSize = 4096
 	nodeContactLen   = 26
+	nodeContactLen6  = 38 // BEP 32.
 	nodeIdLen        = 20
 )
 
@@ -45,16 +46,17 @@ var (
 )
 
 // The 'nodes' response is a string with fixed length contacts concatenated arbitrarily.
-func parseNodesString(nodes string) (parsed map[string]string) {
+// contactLen is nodeContactLen for 'nodes' and nodeContactLen6 for 'nodes6'.
+func parseNodesString(nodes string, contactLen int) (parsed map[string]string) {
 	parsed = make(map[string]string)
-	if len(nodes)%nodeContactLen > 0 {
+	if len(nodes)%contactLen > 0 {
 		l4g.Info("DHT: Invalid length of nodes.")
-		l4g.Info("DHT: Should be a multiple of %d, got %d", nodeContactLen, len(nodes))
+		l4g.Info("DHT: Should be a multiple of %d, got %d", contactLen, len(nodes))
 		return
 	}
-	for i := 0; i < len(nodes); i += nodeContactLen {
+	for i := 0; i < len(nodes); i += contactLen {
 		id := nodes[i : i+nodeIdLen]
-		address := nettools.BinaryToDottedPort(nodes[i+nodeIdLen : i+nodeContactLen])
+		address := nettools.BinaryToDottedPort(nodes[i+nodeIdLen : i+contactLen])
 		parsed[id] = address
 	}
 	return
@@ -76,6 +78,7 @@ type getPeersResponse struct {
 	Values []string "values"
 	Id     string   "id"
 	Nodes  string   "nodes"
+	Nodes6 string   "nodes6"
 	Token  string   "token"
 }
 
@@ -85,6 +88,8 @@ type answerType struct {
 	InfoHash string "info_hash"
 	Port     int    "port"
 	Token    string "token"
+	// Address families of the nodes wanted in the reply (BEP 32).
+	Want []string "want"
 }
 
 // Generic stuff we read from the wire, not knowing what it is. This is as generic as can be.
@@ -149,9 +154,10 @@ type packetType struct {
 	raddr *net.UDPAddr
 }
 
-func listen(listenPort int) (socket *net.UDPConn, err error) {
+// listen opens a UDP socket on network, "udp4" or "udp6".
+func listen(network string, listenPort int) (socket *net.UDPConn, err error) {
 	// debug.Printf("DHT: Listening for peers on port: %d\n", listenPort)
-	listener, err := net.ListenPacket("udp4", ":"+strconv.Itoa(listenPort))
+	listener, err := net.ListenPacket(network, ":"+strconv.Itoa(listenPort))
 	if err != nil {
 		// debug.Println("DHT: Listen failed:", err)
 	}
@@ -161,8 +167,9 @@ func listen(listenPort int) (socket *net.UDPConn, err error) {
 	return
 }
 
-// Read from UDP socket, writes slice of byte into channel.
-func readFromSocket(socket *net.UDPConn, conChan chan packetType) {
+// Read from UDP socket, writes slice of byte into channel. Packets that are
+// not DHT messages go to otherChan instead, if it isn't nil.
+func readFromSocket(socket *net.UDPConn, conChan chan packetType, otherChan chan packetType) {
 	for {
 		b := make([]byte, maxUDPPacketSize)
 		n, addr, err := socket.ReadFromUDP(b)
@@ -172,6 +179,14 @@ func readFromSocket(socket *net.UDPConn, conChan chan packetType) {
 		}
 		if n > 0 && err == nil {
 			p := packetType{b, addr}
+			if otherChan != nil && b[0] != 'd' {
+				select {
+				case otherChan <- p:
+				default:
+					// Like the network, drop what can't be handled.
+				}
+				continue
+			}
 			conChan <- p
 			continue
 		}
@@ -0,0 +1,21 @@
+package dht
+
+import (
+	"testing"
+)
+
+func TestParseNodesString(t *testing.T) {
+	id := "01234567890123456789"
+	nodes := parseNodesString(id+"\x7f\x00\x00\x01\x1a\xe1", nodeContactLen)
+	if got := nodes[id]; got != "127.0.0.1:6881" {
+		t.Errorf("nodes: got %q, wanted 127.0.0.1:6881", got)
+	}
+	v6 := "\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01"
+	nodes = parseNodesString(id+v6+"\x1a\xe1", nodeContactLen6)
+	if got := nodes[id]; got != "[2001:db8::1]:6881" {
+		t.Errorf("nodes6: got %q, wanted [2001:db8::1]:6881", got)
+	}
+	if nodes = parseNodesString(id+v6, nodeContactLen6); len(nodes) != 0 {
+		t.Errorf("Parsed a truncated nodes6 string: %v", nodes)
+	}
+}
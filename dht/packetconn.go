@@ -0,0 +1,81 @@
+package dht
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// PacketConn returns a connection on the node's UDP socket, for other
+// protocols that share the port, such as uTP (BEP 29). It reads the packets
+// that aren't DHT messages. It must be called before DoDHT.
+func (d *DHTEngine) PacketConn() net.PacketConn {
+	if d.shared == nil {
+		d.shared = &sharedConn{d: d, packets: make(chan packetType, 100), closed: make(chan bool)}
+	}
+	return d.shared
+}
+
+// sharedConn is the net.PacketConn returned by PacketConn. Closing it
+// doesn't close the DHT socket.
+type sharedConn struct {
+	d         *DHTEngine
+	packets   chan packetType
+	closeOnce sync.Once
+	closed    chan bool
+}
+
+func (c *sharedConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	select {
+	case p := <-c.packets:
+		return copy(b, p.b), p.raddr, nil
+	case <-c.closed:
+		return 0, nil, errors.New("use of closed DHT packet connection")
+	}
+}
+
+func (c *sharedConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.d.ready:
+	default:
+		return 0, errors.New("DHT socket is not listening yet")
+	}
+	conn := c.d.conn
+	if a, ok := addr.(*net.UDPAddr); ok {
+		conn = c.d.connFor(a)
+	}
+	if conn == nil {
+		return 0, errors.New("DHT has no socket for " + addr.String())
+	}
+	return conn.WriteTo(b, addr)
+}
+
+func (c *sharedConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *sharedConn) LocalAddr() net.Addr {
+	select {
+	case <-c.d.ready:
+		if c.d.conn == nil {
+			return c.d.conn6.LocalAddr()
+		}
+		return c.d.conn.LocalAddr()
+	default:
+		return &net.UDPAddr{Port: c.d.port}
+	}
+}
+
+func (c *sharedConn) SetDeadline(t time.Time) error {
+	return errors.New("deadlines are not supported")
+}
+
+func (c *sharedConn) SetReadDeadline(t time.Time) error {
+	return c.SetDeadline(t)
+}
+
+func (c *sharedConn) SetWriteDeadline(t time.Time) error {
+	return c.SetDeadline(t)
+}
@@ -4,11 +4,20 @@ import (
 	"flag"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/nictuku/Taipei-Torrent/taipei"
 )
 
-var torrent string
+// Time limits of the shutdown steps.
+const (
+	stopTorrentsTimeout = 30 * time.Second // Trackers get 10 seconds of it.
+	portMappingTimeout  = 10 * time.Second
+	saveDHTTimeout      = 10 * time.Second
+)
+
 var debugp bool
 
 func main() {
@@ -17,29 +26,91 @@ func main() {
 	flag.Parse()
 
 	args := flag.Args()
-	if len(args) != 1 {
+	if len(args) > 0 && args[0] == "create" {
+		create(args[1:])
+		return
+	}
+	// With the control API, torrents can be added later.
+	controlled := flag.Lookup("controlAddr").Value.String() != ""
+	if len(args) < 1 && !controlled {
 		log.Println("Torrent file or torrent URL required.")
 		usage()
 	}
 
-	torrent = args[0]
+	// Signals are watched from the start, so a second one can end a long
+	// startup, like the check of the pieces we have.
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	interrupted := make(chan bool)
+	go func() {
+		sig := <-signals
+		log.Println("Got", sig, "- shutting down. Again to force exit.")
+		close(interrupted)
+		<-signals
+		log.Println("Forced exit.")
+		os.Exit(1)
+	}()
 
 	log.Println("Starting.")
-	ts, err := taipei.NewTorrentSession(torrent)
+	client, err := taipei.NewClient()
 	if err != nil {
-		log.Println("Could not create torrent session.", err)
+		log.Println("Could not start the client.", err)
 		return
 	}
-	err = ts.DoTorrent()
-	if err != nil {
-		log.Println("Failed: ", err)
-	} else {
-		log.Println("Done")
+	for _, torrent := range args {
+		select {
+		case <-interrupted:
+			// Don't load the others.
+		default:
+			if _, err := client.AddTorrent(torrent); err != nil {
+				log.Println("Could not create torrent session for", torrent, err)
+			}
+		}
+	}
+	finished := make(chan bool)
+	if !controlled {
+		go func() {
+			client.Wait()
+			close(finished)
+		}()
+	}
+	select {
+	case <-finished:
+	case <-interrupted:
+	}
+	shutdown(client)
+	log.Println("Done")
+}
+
+// shutdown leaves the swarms and cleans up what outlives the process.
+func shutdown(client *taipei.Client) {
+	step("Stopping torrents.", stopTorrentsTimeout, client.StopTorrents)
+	step("Deleting port mappings.", portMappingTimeout, func() {
+		if err := client.DeletePortMapping(); err != nil {
+			log.Println("Unable to delete port mapping", err)
+		}
+	})
+	step("Saving the DHT routing table.", saveDHTTimeout, client.SaveDHT)
+}
+
+// step runs f, but doesn't wait for it longer than timeout.
+func step(name string, timeout time.Duration, f func()) {
+	log.Println(name)
+	done := make(chan bool)
+	go func() {
+		f()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Println("Gave up after", timeout)
 	}
 }
 
 func usage() {
-	log.Printf("usage: Taipei-Torrent [options] (torrent-file | torrent-url)")
+	log.Printf("usage: Taipei-Torrent [options] (torrent-file | torrent-url)...")
+	log.Printf("       Taipei-Torrent create [create options] (file | directory)")
 
 	flag.PrintDefaults()
 	os.Exit(2)
@@ -1,14 +1,32 @@
 package nettools
 
-import "fmt"
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
 
+// BinaryToDottedPort converts a compact address, 6 bytes for IPv4 or 18
+// bytes for IPv6, into host:port form.
 func BinaryToDottedPort(port string) string {
+	if len(port) == 18 {
+		return net.JoinHostPort(net.IP(port[0:16]).String(),
+			strconv.Itoa(int(port[16])<<8|int(port[17])))
+	}
 	return fmt.Sprintf("%d.%d.%d.%d:%d", port[0], port[1], port[2], port[3],
 		(uint16(port[4])<<8)|uint16(port[5]))
 }
 
-// 97.98.99.100:25958 becames "abcdef".
+// 97.98.99.100:25958 becames "abcdef". IPv6 addresses, like [::1]:25958,
+// become 18 bytes.
 func DottedPortToBinary(b string) string {
+	if host, port, err := net.SplitHostPort(b); err == nil {
+		ip := net.ParseIP(host)
+		p, err := strconv.Atoi(port)
+		if ip != nil && ip.To4() == nil && err == nil {
+			return string(append(ip, byte(p>>8), byte(p)))
+		}
+	}
 	a := make([]byte, 6, 6)
 	var c uint16
 
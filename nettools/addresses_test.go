@@ -0,0 +1,20 @@
+package nettools
+
+import (
+	"testing"
+)
+
+func TestCompactAddresses(t *testing.T) {
+	tests := []struct{ addr, compact string }{
+		{"97.98.99.100:25958", "abcdef"},
+		{"[2001:db8::1]:6881", "\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x1a\xe1"},
+	}
+	for _, test := range tests {
+		if got := DottedPortToBinary(test.addr); got != test.compact {
+			t.Errorf("DottedPortToBinary(%q) = %q, wanted %q", test.addr, got, test.compact)
+		}
+		if got := BinaryToDottedPort(test.compact); got != test.addr {
+			t.Errorf("BinaryToDottedPort(%q) = %q, wanted %q", test.compact, got, test.addr)
+		}
+	}
+}
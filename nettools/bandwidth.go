@@ -0,0 +1,90 @@
+package nettools
+
+import (
+	"sync"
+	"time"
+)
+
+// Longest sleep between checks of the bucket, so that rate changes take effect
+// quickly.
+const maxRateLimitSleep = 100 * time.Millisecond
+
+// RateLimiter is a token bucket that limits throughput to a number of bytes
+// per second. It is safe for concurrent use, and the rate can be changed at
+// any time. A nil *RateLimiter doesn't limit anything.
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // Bytes per second. Zero means unlimited.
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimiter(bytesPerSecond int64) *RateLimiter {
+	r := &RateLimiter{last: time.Now()}
+	r.SetRate(bytesPerSecond)
+	return r
+}
+
+// SetRate changes the limit. Zero or less means unlimited.
+func (r *RateLimiter) SetRate(bytesPerSecond int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if bytesPerSecond < 0 {
+		bytesPerSecond = 0
+	}
+	r.refill(time.Now())
+	r.rate = float64(bytesPerSecond)
+	if r.tokens > r.rate {
+		r.tokens = r.rate
+	}
+}
+
+// Rate returns the limit in bytes per second, or zero if unlimited.
+func (r *RateLimiter) Rate() int64 {
+	if r == nil {
+		return 0
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return int64(r.rate)
+}
+
+// refill adds the tokens earned since the last refill. The bucket holds at
+// most one second worth of tokens. Must be called with r.mu held.
+func (r *RateLimiter) refill(now time.Time) {
+	r.tokens += now.Sub(r.last).Seconds() * r.rate
+	if r.tokens > r.rate {
+		r.tokens = r.rate
+	}
+	r.last = now
+}
+
+// Wait blocks until n bytes can be transferred.
+func (r *RateLimiter) Wait(n int) {
+	if r == nil {
+		return
+	}
+	for {
+		r.mu.Lock()
+		r.refill(time.Now())
+		// Messages bigger than the bucket go through when it is full,
+		// and leave it in debt.
+		if r.rate == 0 || r.tokens >= float64(n) || r.tokens >= r.rate {
+			if r.rate != 0 {
+				r.tokens -= float64(n)
+			}
+			r.mu.Unlock()
+			return
+		}
+		need := float64(n) - r.tokens
+		if need > r.rate {
+			need = r.rate
+		}
+		sleep := time.Duration(need / r.rate * float64(time.Second))
+		r.mu.Unlock()
+		if sleep > maxRateLimitSleep {
+			sleep = maxRateLimitSleep
+		}
+		time.Sleep(sleep)
+	}
+}
@@ -0,0 +1,31 @@
+package nettools
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	r := NewRateLimiter(1024 * 1024)
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		r.Wait(20 * 1024)
+	}
+	// 200 KiB at 1 MiB/s, starting with an empty bucket.
+	if d := time.Since(start); d < 150*time.Millisecond || d > time.Second {
+		t.Errorf("Sending 200 KiB at 1 MiB/s took %v", d)
+	}
+
+	r.SetRate(0)
+	start = time.Now()
+	r.Wait(100 * 1024 * 1024)
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Errorf("Unlimited rate limiter waited %v", d)
+	}
+
+	var none *RateLimiter
+	none.Wait(1)
+	if none.Rate() != 0 {
+		t.Errorf("Nil rate limiter has a rate")
+	}
+}
@@ -0,0 +1,153 @@
+package taipei
+
+// Tit-for-tat choking.
+//
+// Every chokeInterval we unchoke the uploadSlots interested peers that gave
+// us the most data recently (or, when seeding, that took the most data from
+// us), plus one optimistic unchoke that rotates every optimisticRounds, so
+// new peers get a chance to show what they can do.
+//
+// References:
+// - http://bittorrent.org/beps/bep_0003.html
+// - http://wiki.theory.org/BitTorrentSpecification#Choking_and_Optimistic_Unchoking
+
+import (
+	"flag"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+const (
+	chokeInterval    = 10 * time.Second
+	optimisticRounds = 3 // Rotate the optimistic unchoke every 30 seconds.
+	// Peers that haven't sent us any data for this long while we were
+	// interested are snubbed: they don't get regular upload slots.
+	snubTimeout = time.Minute
+	// Peers connected less than this are three times more likely to be
+	// picked for the optimistic unchoke.
+	newPeerPeriod = time.Minute
+)
+
+var uploadSlots int
+
+func init() {
+	flag.IntVar(&uploadSlots, "uploadSlots", 4,
+		"Number of peers we upload to, besides the optimistic unchoke.")
+}
+
+// updateRates computes how fast the peer sent us data, and we sent it data,
+// since the last call.
+func (p *peerState) updateRates(interval time.Duration) {
+	seconds := interval.Seconds()
+	p.downloadRate = float64(p.downloaded-p.lastDownloaded) / seconds
+	p.uploadRate = float64(p.uploaded-p.lastUploaded) / seconds
+	p.lastDownloaded = p.downloaded
+	p.lastUploaded = p.uploaded
+}
+
+func (p *peerState) isSnubbed(now time.Time) bool {
+	return p.am_interested && now.Sub(p.lastPieceTime) > snubTimeout
+}
+
+type peersByRate struct {
+	peers   []*peerState
+	seeding bool
+}
+
+func (a peersByRate) Len() int      { return len(a.peers) }
+func (a peersByRate) Swap(i, j int) { a.peers[i], a.peers[j] = a.peers[j], a.peers[i] }
+func (a peersByRate) Less(i, j int) bool {
+	if a.seeding {
+		return a.peers[i].uploadRate > a.peers[j].uploadRate
+	}
+	return a.peers[i].downloadRate > a.peers[j].downloadRate
+}
+
+// chooseUnchoked picks the peers that get the regular upload slots: the
+// fastest interested peers that aren't snubbing us.
+func chooseUnchoked(peers []*peerState, seeding bool, slots int, now time.Time) map[*peerState]bool {
+	candidates := make([]*peerState, 0, len(peers))
+	for _, p := range peers {
+		if p.peer_interested && (seeding || !p.isSnubbed(now)) {
+			candidates = append(candidates, p)
+		}
+	}
+	// Shuffle first so that ties are broken randomly.
+	for i := range candidates {
+		j := rand.Intn(i + 1)
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	}
+	sort.Stable(peersByRate{candidates, seeding})
+	if len(candidates) > slots {
+		candidates = candidates[:slots]
+	}
+	unchoked := make(map[*peerState]bool, len(candidates))
+	for _, p := range candidates {
+		unchoked[p] = true
+	}
+	return unchoked
+}
+
+// chooseOptimistic picks a random interested peer that didn't get a regular
+// slot. Newly connected peers are favored since they have nothing to offer
+// yet. Returns nil if there is no such peer.
+func chooseOptimistic(peers []*peerState, unchoked map[*peerState]bool, now time.Time) *peerState {
+	candidates := make([]*peerState, 0, len(peers))
+	for _, p := range peers {
+		if !p.peer_interested || unchoked[p] {
+			continue
+		}
+		candidates = append(candidates, p)
+		if now.Sub(p.connectedAt) < newPeerPeriod {
+			candidates = append(candidates, p, p)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	return candidates[rand.Intn(len(candidates))]
+}
+
+// rechoke recomputes who we upload to. It runs every chokeInterval.
+func (t *TorrentSession) rechoke() {
+	now := time.Now()
+	peers := make([]*peerState, 0, len(t.peers))
+	for _, p := range t.peers {
+		p.updateRates(chokeInterval)
+		peers = append(peers, p)
+	}
+	unchoked := chooseUnchoked(peers, t.isComplete(), uploadSlots, now)
+
+	t.chokeRound++
+	o := t.optimisticUnchoke
+	if o == nil || t.peers[o.address] != o || !o.peer_interested || unchoked[o] ||
+		t.chokeRound%optimisticRounds == 0 {
+		o = chooseOptimistic(peers, unchoked, now)
+		t.optimisticUnchoke = o
+	}
+	if o != nil {
+		unchoked[o] = true
+	}
+
+	for _, p := range peers {
+		p.SetChoke(!unchoked[p])
+	}
+}
+
+// unchokeIfSlotFree unchokes a peer that just became interested right away
+// if there is a free slot, instead of waiting for the next rechoke.
+func (t *TorrentSession) unchokeIfSlotFree(p *peerState) {
+	if !p.am_choking {
+		return
+	}
+	n := 0
+	for _, peer := range t.peers {
+		if !peer.am_choking && peer != t.optimisticUnchoke {
+			n++
+		}
+	}
+	if n < uploadSlots {
+		p.SetChoke(false)
+	}
+}
@@ -0,0 +1,40 @@
+package taipei
+
+import (
+	"testing"
+	"time"
+)
+
+func TestChooseUnchoked(t *testing.T) {
+	now := time.Now()
+	peer := func(interested bool, down, up float64, lastPiece time.Duration) *peerState {
+		return &peerState{peer_interested: interested, am_interested: true,
+			downloadRate: down, uploadRate: up, lastPieceTime: now.Add(-lastPiece)}
+	}
+	fast := peer(true, 1000, 10, 0)
+	medium := peer(true, 500, 20, 0)
+	slow := peer(true, 100, 30, 0)
+	uninterested := peer(false, 2000, 40, 0)
+	snubbing := peer(true, 3000, 50, 2*time.Minute)
+	peers := []*peerState{slow, uninterested, fast, snubbing, medium}
+
+	unchoked := chooseUnchoked(peers, false, 2, now)
+	if len(unchoked) != 2 || !unchoked[fast] || !unchoked[medium] {
+		t.Errorf("Leeching: wanted the fast and medium peers unchoked, got %v", unchoked)
+	}
+
+	// When seeding, we rank by upload rate and don't care about snubbing.
+	unchoked = chooseUnchoked(peers, true, 2, now)
+	if len(unchoked) != 2 || !unchoked[snubbing] || !unchoked[slow] {
+		t.Errorf("Seeding: wanted the snubbing and slow peers unchoked, got %v", unchoked)
+	}
+
+	o := chooseOptimistic(peers, unchoked, now)
+	if o != fast && o != medium {
+		t.Errorf("Optimistic unchoke should be an interested choked peer, got %v", o)
+	}
+	all := map[*peerState]bool{fast: true, medium: true, slow: true, snubbing: true}
+	if o := chooseOptimistic(peers, all, now); o != nil {
+		t.Errorf("Wanted no optimistic unchoke candidate, got %v", o)
+	}
+}
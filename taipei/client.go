@@ -0,0 +1,338 @@
+package taipei
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nictuku/Taipei-Torrent/dht"
+	"github.com/nictuku/Taipei-Torrent/nettools"
+	"github.com/nictuku/Taipei-Torrent/utp"
+)
+
+// How long an incoming connection has to send its handshake before we give
+// up on it.
+const handshakeTimeout = 30 * time.Second
+
+var maxUploadRate, maxDownloadRate int64
+var useUTP bool
+
+func init() {
+	flag.Int64Var(&maxUploadRate, "maxUploadRate", 0,
+		"Upload rate limit for all torrents together, in KiB/s. 0 means no limit.")
+	flag.Int64Var(&maxDownloadRate, "maxDownloadRate", 0,
+		"Download rate limit for all torrents together, in KiB/s. 0 means no limit.")
+	flag.BoolVar(&useUTP, "useUTP", false, "Also connect to peers over uTP, on the UDP listen port.")
+}
+
+// Client runs many torrent sessions in one process. The sessions share a
+// single listen port, for TCP and for uTP, and a single DHT node; incoming
+// connections are routed to the right session by the info hash in their
+// handshake.
+type Client struct {
+	listenPort    int
+	nat           NAT // Forwards the listen port, with UPnP.
+	dht           *dht.DHTEngine
+	utp           *utp.Socket
+	lsd           *localDiscovery
+	uploadLimit   *nettools.RateLimiter
+	downloadLimit *nettools.RateLimiter
+
+	mu       sync.Mutex
+	sessions map[string]*TorrentSession // key: info hash
+	running  sync.WaitGroup
+	quit     chan bool // Closed by StopTorrents, to end the background loops.
+	quitOnce sync.Once
+}
+
+// NewClient opens the shared listen port and, if enabled, starts the shared
+// DHT node and uTP socket.
+func NewClient() (c *Client, err error) {
+	if !validEncryption(encryption) {
+		return nil, errors.New("unknown encryption policy: " + encryption)
+	}
+	listenPort, nat, err := chooseListenPort()
+	if err != nil {
+		log.Println("Could not choose listen port.")
+		log.Println("Peer connectivity will be affected.")
+	}
+	c = &Client{sessions: make(map[string]*TorrentSession), nat: nat, quit: make(chan bool),
+		uploadLimit:   nettools.NewRateLimiter(maxUploadRate * 1024),
+		downloadLimit: nettools.NewRateLimiter(maxDownloadRate * 1024)}
+	listener, err := c.listenForPeerConnections(listenPort)
+	if err != nil {
+		return nil, err
+	}
+	if useDHT {
+		// TODO: UPnP UDP port mapping.
+		if c.dht, err = dht.NewDHTNode(c.listenPort, TARGET_NUM_PEERS, true); err != nil {
+			log.Println("DHT node creation error", err)
+			listener.Close()
+			return nil, err
+		}
+	}
+	if useUTP {
+		// uTP shares the UDP port of the DHT.
+		if c.dht != nil {
+			c.utp = utp.NewSocket(c.dht.PacketConn())
+		} else if c.utp, err = utp.Listen(":" + strconv.Itoa(c.listenPort)); err != nil {
+			log.Println("uTP listen failed:", err)
+			listener.Close()
+			return nil, err
+		}
+	}
+	// The DHT node opens its socket in DoDHT, which only starts once
+	// everything else is set up, so it has nothing to stop here.
+	closeAll := func() {
+		listener.Close()
+		if c.utp != nil {
+			c.utp.Close()
+		}
+	}
+	if err = c.startStreaming(); err != nil {
+		log.Println("Could not start streaming:", err)
+		closeAll()
+		return nil, err
+	}
+	if err = c.startControl(); err != nil {
+		log.Println("Could not start the control API:", err)
+		closeAll()
+		return nil, err
+	}
+	if err = c.startLSD(); err != nil {
+		log.Println("Could not start local service discovery:", err)
+		closeAll()
+		return nil, err
+	}
+	if c.dht != nil {
+		go c.dht.DoDHT()
+		go c.routeDHTPeers()
+	}
+	if c.utp != nil {
+		go c.acceptPeerConnections(c.utp)
+	}
+	go c.acceptPeerConnections(listener)
+	go c.scrapeLoop()
+	return
+}
+
+func (c *Client) listenForPeerConnections(port int) (listener net.Listener, err error) {
+	// Without a host, both IPv4 and IPv6 connections are accepted.
+	listener, err = net.Listen("tcp", ":"+strconv.Itoa(port))
+	if err != nil {
+		log.Println("Listen failed:", err)
+		return
+	}
+	c.listenPort = port
+	// If port was not set by UPnP, and was 0, get the actual port
+	// so we can send it to trackers.
+	if port == 0 {
+		_, p, err := net.SplitHostPort(listener.Addr().String())
+		if err == nil {
+			c.listenPort, err = strconv.Atoi(p)
+		}
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	log.Println("Listening for peers on port:", c.listenPort)
+	return
+}
+
+func (c *Client) acceptPeerConnections(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Println("Listener failed:", err)
+			return
+		}
+		// log.Println("A peer contacted us", conn.RemoteAddr().String())
+		go c.routeIncoming(conn)
+	}
+}
+
+// routeIncoming reads the handshake of an incoming connection, encrypted or
+// not, and hands the connection over to the session for the info hash the
+// peer asked for.
+func (c *Client) routeIncoming(conn net.Conn) {
+	var header [68]byte
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	peerConn, err := acceptEncryption(conn, encryption, c.infoHashes)
+	if err == nil {
+		_, err = io.ReadFull(peerConn, header[:])
+	}
+	conn.SetDeadline(time.Time{})
+	if err != nil || !bytes.Equal(header[0:20], kBitTorrentHeader) {
+		conn.Close()
+		return
+	}
+	ts := c.session(string(header[28:48]))
+	if ts == nil {
+		// log.Printf("Peer %v asked for unknown info hash %x", conn.RemoteAddr(), header[28:48])
+		conn.Close()
+		return
+	}
+	// The session reads the handshake itself, so give it back.
+	select {
+	case ts.conChan <- &replayConn{peerConn, io.MultiReader(bytes.NewReader(header[:]), peerConn)}:
+	case <-ts.done:
+		conn.Close()
+	}
+}
+
+// routeDHTPeers dispatches the peers found by the shared DHT node to the
+// sessions that asked for them.
+func (c *Client) routeDHTPeers() {
+	for result := range c.dht.PeersRequestResults {
+		for ih, peers := range result {
+			ts := c.session(ih)
+			if ts == nil {
+				continue
+			}
+			select {
+			case ts.dhtPeersChan <- peers:
+			default:
+				// The session is busy. The DHT will find more.
+			}
+		}
+	}
+}
+
+func (c *Client) session(infoHash string) *TorrentSession {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sessions[infoHash]
+}
+
+// infoHashes lists the torrents of the running sessions.
+func (c *Client) infoHashes() (ihs []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for ih := range c.sessions {
+		ihs = append(ihs, ih)
+	}
+	return
+}
+
+// AddTorrent creates a session for the torrent file, URL or magnet link and
+// starts downloading it.
+func (c *Client) AddTorrent(torrent string) (ts *TorrentSession, err error) {
+	return c.AddTorrentContext(context.Background(), torrent)
+}
+
+// AddTorrentContext is like AddTorrent, and the session stops when ctx is
+// done.
+func (c *Client) AddTorrentContext(ctx context.Context, torrent string) (ts *TorrentSession, err error) {
+	ts, err = NewTorrentSession(torrent, c.listenPort)
+	if err != nil {
+		return nil, err
+	}
+	ts.dht = c.dht
+	ts.utp = c.utp
+	ts.globalUploadLimit = c.uploadLimit
+	ts.globalDownloadLimit = c.downloadLimit
+	ih := ts.m.InfoHash
+
+	c.mu.Lock()
+	if _, ok := c.sessions[ih]; ok {
+		c.mu.Unlock()
+		if ts.fileStore != nil {
+			ts.fileStore.Close()
+		}
+		return nil, errors.New("torrent is already running: " + torrent)
+	}
+	c.sessions[ih] = ts
+	c.mu.Unlock()
+
+	if c.lsd != nil {
+		go c.lsdAnnounce(ih)
+	}
+	c.running.Add(1)
+	go func() {
+		defer c.running.Done()
+		if err := ts.DoTorrentContext(ctx); err != nil && err != ctx.Err() {
+			log.Printf("Torrent %x failed: %v", ih, err)
+		}
+		c.mu.Lock()
+		// Unless it was removed, and maybe added again, already.
+		if c.sessions[ih] == ts {
+			delete(c.sessions, ih)
+		}
+		c.mu.Unlock()
+	}()
+	return
+}
+
+// SetRateLimits limits how fast all the torrents together upload and
+// download piece data, in bytes per second. Zero means no limit. It can be
+// called at any time; see also TorrentSession.SetRateLimits.
+func (c *Client) SetRateLimits(upload, download int64) {
+	c.uploadLimit.SetRate(upload)
+	c.downloadLimit.SetRate(download)
+}
+
+// RateLimits returns the limits set with SetRateLimits.
+func (c *Client) RateLimits() (upload, download int64) {
+	return c.uploadLimit.Rate(), c.downloadLimit.Rate()
+}
+
+// StopTorrents stops all the sessions, like TorrentSession.Stop, and waits
+// for them. The client doesn't scrape the trackers, announce the torrents
+// on the local network, or take uTP connections, anymore.
+func (c *Client) StopTorrents() {
+	c.quitOnce.Do(func() { close(c.quit) })
+	var wg sync.WaitGroup
+	for _, ih := range c.infoHashes() {
+		if ts := c.session(ih); ts != nil {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ts.Stop()
+			}()
+		}
+	}
+	wg.Wait()
+	if c.utp != nil {
+		c.utp.Close()
+	}
+}
+
+// DeletePortMapping removes the UPnP forwarding of the listen port, if
+// there is one.
+func (c *Client) DeletePortMapping() error {
+	if c.nat == nil {
+		return nil
+	}
+	return c.nat.DeletePortMapping("TCP", c.listenPort)
+}
+
+// SaveDHT saves the routing table of the DHT node, if there is one.
+func (c *Client) SaveDHT() {
+	if c.dht != nil {
+		c.dht.Save()
+	}
+}
+
+// Wait blocks until all sessions are finished.
+func (c *Client) Wait() {
+	c.running.Wait()
+}
+
+// replayConn is a connection whose first bytes were already consumed by the
+// client, and are played back before reading from the network again.
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,36 @@
+package taipei
+
+import (
+	"net"
+	"strconv"
+	"testing"
+)
+
+func TestNewClientFailureClosesPorts(t *testing.T) {
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, p, _ := net.SplitHostPort(l.Addr().String())
+	l.Close()
+	savedPort, savedUTP, savedStream := port, useUTP, streamAddr
+	defer func() { port, useUTP, streamAddr = savedPort, savedUTP, savedStream }()
+	port, _ = strconv.Atoi(p)
+	useUTP = true
+	streamAddr = "no such address"
+
+	if c, err := NewClient(); err == nil {
+		c.StopTorrents()
+		t.Fatal("NewClient worked without a streaming address")
+	}
+	// The TCP and uTP ports are free again.
+	if l, err = net.Listen("tcp", ":"+p); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	pc, err := net.ListenPacket("udp", ":"+p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc.Close()
+}
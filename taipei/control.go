@@ -0,0 +1,376 @@
+package taipei
+
+// Control API.
+//
+// With -controlAddr, the client runs an HTTP server that other processes can
+// drive it with. Requests and answers are JSON:
+//
+//   GET    /torrents                 lists the torrents
+//   POST   /torrents                 adds {"torrent": file, URL or magnet}
+//   GET    /torrents/<info hash>     is the status of a torrent
+//   DELETE /torrents/<info hash>     stops and removes a torrent
+//   POST   /torrents/<info hash>/pause
+//   POST   /torrents/<info hash>/resume
+//   GET    /torrents/<info hash>/peers
+//   GET    /torrents/<info hash>/files
+//   GET    /settings                 are the settings that can be changed
+//   PUT    /settings                 changes them
+//
+// With -controlToken, requests must have an "Authorization: Bearer <token>"
+// header. Errors are answered as {"error": message}.
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+var controlAddr, controlToken string
+
+func init() {
+	flag.StringVar(&controlAddr, "controlAddr", "", "Address of the HTTP/JSON control API, like "+
+		"localhost:8081. Empty disables it.")
+	flag.StringVar(&controlToken, "controlToken", "", "Token the control API requires, as an "+
+		"\"Authorization: Bearer <token>\" header. Empty means no authentication.")
+}
+
+type TorrentStatus struct {
+	InfoHash     string  `json:"infoHash"` // Hex encoded.
+	Name         string  `json:"name"`
+	State        string  `json:"state"` // metadata, checking, downloading, finished, seeding or paused.
+	Size         int64   `json:"size"`
+	Left         int64   `json:"left"`     // Bytes we still want.
+	Progress     float64 `json:"progress"` // From 0 to 1, of what we want.
+	Pieces       int     `json:"pieces"`
+	GoodPieces   int     `json:"goodPieces"`
+	Uploaded     int64   `json:"uploaded"`
+	Downloaded   int64   `json:"downloaded"`
+	UploadRate   float64 `json:"uploadRate"` // Bytes per second.
+	DownloadRate float64 `json:"downloadRate"`
+	Peers        int     `json:"peers"`
+	Seeds        int     `json:"seeds"`
+
+	Checking *CheckProgress `json:"checking,omitempty"`
+}
+
+type PeerStatus struct {
+	Address      string  `json:"address"`
+	Client       string  `json:"client"`
+	Incoming     bool    `json:"incoming"`
+	Encrypted    bool    `json:"encrypted"`
+	Progress     float64 `json:"progress"`
+	Uploaded     int64   `json:"uploaded"`
+	Downloaded   int64   `json:"downloaded"`
+	UploadRate   float64 `json:"uploadRate"`
+	DownloadRate float64 `json:"downloadRate"`
+	Choked       bool    `json:"choked"`     // We choke the peer.
+	Choking      bool    `json:"choking"`    // The peer chokes us.
+	Interested   bool    `json:"interested"` // The peer is interested in us.
+}
+
+type FileStatus struct {
+	Path     string  `json:"path"`
+	Length   int64   `json:"length"`
+	Priority string  `json:"priority"`
+	Progress float64 `json:"progress"` // From 0 to 1.
+}
+
+// Settings are the settings of a Client that can change while it runs.
+type Settings struct {
+	MaxUploadRate   int64 `json:"maxUploadRate"` // KiB/s, 0 means no limit.
+	MaxDownloadRate int64 `json:"maxDownloadRate"`
+}
+
+// Status returns the state of the session, for the control API.
+func (t *TorrentSession) Status() (s TorrentStatus, err error) {
+	if p, checking := t.CheckProgress(); checking {
+		// The main loop waits for the check, and the files are known.
+		return TorrentStatus{InfoHash: hex.EncodeToString([]byte(t.m.InfoHash)), Name: t.m.Info.Name,
+			State: "checking", Size: t.totalSize, Pieces: p.Pieces, Checking: &p}, nil
+	}
+	ok := t.call(func() {
+		s = TorrentStatus{InfoHash: hex.EncodeToString([]byte(t.m.InfoHash)), Name: t.m.Info.Name,
+			Size: t.totalSize, Left: t.si.Left, Pieces: t.totalPieces, GoodPieces: t.goodPieces,
+			Uploaded: t.si.Uploaded, Downloaded: t.si.Downloaded, Peers: len(t.peers)}
+		switch {
+		case t.paused:
+			s.State = "paused"
+		case !t.si.HaveTorrent:
+			s.State = "metadata"
+		case t.hasAllPieces():
+			s.State = "seeding"
+		case t.isComplete():
+			// Of the files we want only.
+			s.State = "finished"
+		default:
+			s.State = "downloading"
+		}
+		if wanted := t.wantedSize(); wanted > 0 {
+			s.Progress = float64(wanted-t.si.Left) / float64(wanted)
+		} else if t.si.HaveTorrent {
+			s.Progress = 1
+		}
+		for _, p := range t.peers {
+			s.UploadRate += p.uploadRate
+			s.DownloadRate += p.downloadRate
+			if isSeed(p) {
+				s.Seeds++
+			}
+		}
+	})
+	if !ok {
+		err = errSessionDone
+	}
+	return
+}
+
+// PeerStatus lists the peers of the session, for the control API.
+func (t *TorrentSession) PeerStatus() (peers []PeerStatus, err error) {
+	ok := t.call(func() {
+		for _, p := range t.peers {
+			ps := PeerStatus{Address: p.address, Client: p.client, Incoming: p.incoming,
+				Encrypted: p.encrypted, Uploaded: p.uploaded, Downloaded: p.downloaded,
+				UploadRate: p.uploadRate, DownloadRate: p.downloadRate, Choked: p.am_choking,
+				Choking: p.peer_choking, Interested: p.peer_interested}
+			if p.have != nil && p.have.n > 0 {
+				have := 0
+				for i := p.have.FindNextSet(0); i >= 0; i = p.have.FindNextSet(i + 1) {
+					have++
+				}
+				ps.Progress = float64(have) / float64(p.have.n)
+			}
+			peers = append(peers, ps)
+		}
+	})
+	if !ok {
+		err = errSessionDone
+	}
+	return
+}
+
+// FileStatus lists the files of the session, for the control API. It is
+// empty until we have the info dictionary of a magnet link.
+func (t *TorrentSession) FileStatus() (files []FileStatus, err error) {
+	ok := t.call(func() {
+		fs, ok := t.fileStore.(*fileStore)
+		if !t.si.HaveTorrent || !ok {
+			return
+		}
+		pieceLength := t.m.Info.PieceLength
+		for i, name := range fileNames(&t.m.Info) {
+			f := FileStatus{Path: name, Length: fs.files[i].length, Priority: t.filePriorities[i].String()}
+			start, end := fs.offsets[i], fs.offsets[i]+f.Length
+			var have int64
+			for piece := start / pieceLength; piece*pieceLength < end; piece++ {
+				if !t.pieceSet.IsSet(int(piece)) {
+					continue
+				}
+				from, to := piece*pieceLength, (piece+1)*pieceLength
+				if from < start {
+					from = start
+				}
+				if to > end {
+					to = end
+				}
+				have += to - from
+			}
+			if f.Length > 0 {
+				f.Progress = float64(have) / float64(f.Length)
+			} else {
+				f.Progress = 1
+			}
+			files = append(files, f)
+		}
+	})
+	if !ok {
+		err = errSessionDone
+	}
+	return
+}
+
+// RemoveTorrent forgets the torrent and stops its session. It can be added
+// again as soon as RemoveTorrent returns.
+func (c *Client) RemoveTorrent(infoHash string) error {
+	c.mu.Lock()
+	ts := c.sessions[infoHash]
+	delete(c.sessions, infoHash)
+	c.mu.Unlock()
+	if ts == nil {
+		return errors.New("unknown torrent")
+	}
+	ts.Stop()
+	return nil
+}
+
+// startControl runs the control API, if -controlAddr is set.
+func (c *Client) startControl() (err error) {
+	if controlAddr == "" {
+		return
+	}
+	l, err := net.Listen("tcp", controlAddr)
+	if err != nil {
+		return
+	}
+	log.Println("Control API at http://" + l.Addr().String() + "/")
+	go http.Serve(l, &controlHandler{c, controlToken})
+	return
+}
+
+type controlHandler struct {
+	c     *Client
+	token string
+}
+
+type controlError struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, controlError{err.Error()})
+}
+
+func (h *controlHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.token != "" {
+		auth := r.Header.Get("Authorization")
+		if subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+h.token)) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("bad or missing token"))
+			return
+		}
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "settings":
+		h.serveSettings(w, r)
+	case len(parts) == 1 && parts[0] == "torrents":
+		h.serveTorrents(w, r)
+	case len(parts) <= 3 && parts[0] == "torrents":
+		ih, err := hex.DecodeString(parts[1])
+		ts := h.c.session(string(ih))
+		if err != nil || ts == nil {
+			writeError(w, http.StatusNotFound, errors.New("unknown torrent"))
+			return
+		}
+		action := ""
+		if len(parts) == 3 {
+			action = parts[2]
+		}
+		h.serveTorrent(w, r, ts, action)
+	default:
+		writeError(w, http.StatusNotFound, errors.New("unknown path"))
+	}
+}
+
+func (h *controlHandler) serveTorrents(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		list := []TorrentStatus{}
+		for _, ih := range h.c.infoHashes() {
+			ts := h.c.session(ih)
+			if ts == nil {
+				continue
+			}
+			if s, err := ts.Status(); err == nil {
+				list = append(list, s)
+			}
+		}
+		writeJSON(w, http.StatusOK, list)
+	case "POST":
+		var req struct {
+			Torrent string `json:"torrent"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Torrent == "" {
+			writeError(w, http.StatusBadRequest, errors.New("expected {\"torrent\": file, URL or magnet}"))
+			return
+		}
+		ts, err := h.c.AddTorrent(req.Torrent)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		s, err := ts.Status()
+		if err != nil {
+			writeError(w, http.StatusGone, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, s)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+func (h *controlHandler) serveTorrent(w http.ResponseWriter, r *http.Request, ts *TorrentSession, action string) {
+	var v interface{}
+	var err error
+	switch {
+	case action == "" && r.Method == "GET":
+		v, err = ts.Status()
+	case action == "" && r.Method == "DELETE":
+		if err = h.c.RemoveTorrent(ts.m.InfoHash); err == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	case action == "pause" && r.Method == "POST":
+		if err = ts.Pause(); err == nil {
+			v, err = ts.Status()
+		}
+	case action == "resume" && r.Method == "POST":
+		if err = ts.Resume(); err == nil {
+			v, err = ts.Status()
+		}
+	case action == "peers" && r.Method == "GET":
+		peers, e := ts.PeerStatus()
+		if peers == nil {
+			peers = []PeerStatus{}
+		}
+		v, err = peers, e
+	case action == "files" && r.Method == "GET":
+		files, e := ts.FileStatus()
+		if files == nil {
+			files = []FileStatus{}
+		}
+		v, err = files, e
+	default:
+		writeError(w, http.StatusNotFound, errors.New("unknown action or method"))
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusGone, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, v)
+}
+
+func (h *controlHandler) serveSettings(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "PUT", "POST":
+		up, down := h.c.RateLimits()
+		s := Settings{up / 1024, down / 1024}
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if s.MaxUploadRate < 0 || s.MaxDownloadRate < 0 {
+			writeError(w, http.StatusBadRequest, errors.New("negative rate limit"))
+			return
+		}
+		h.c.SetRateLimits(s.MaxUploadRate*1024, s.MaxDownloadRate*1024)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	up, down := h.c.RateLimits()
+	writeJSON(w, http.StatusOK, Settings{up / 1024, down / 1024})
+}
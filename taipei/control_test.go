@@ -0,0 +1,155 @@
+package taipei
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/nictuku/Taipei-Torrent/nettools"
+)
+
+func TestControlAPI(t *testing.T) {
+	info := InfoDict{Name: "album", PieceLength: 10, Files: []FileDict{
+		{Length: 16, Path: []string{"a.flac"}},
+		{Length: 20, Path: []string{"b.flac"}}}}
+	// We have pieces 0 and 2.
+	ts, stop := newTestSession(info,
+		&fileStore{offsets: []int64{0, 16}, files: []fileEntry{{length: 16}, {length: 20}}}, 0, 2)
+	defer stop()
+	ts.filePriorities[0] = PriorityHigh
+	c := &Client{sessions: map[string]*TorrentSession{ts.m.InfoHash: ts},
+		uploadLimit:   nettools.NewRateLimiter(0),
+		downloadLimit: nettools.NewRateLimiter(0)}
+	server := httptest.NewServer(&controlHandler{c, "secret"})
+	defer server.Close()
+
+	do := func(method, path, token, body string, v interface{}) int {
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if v != nil {
+			if err = json.NewDecoder(resp.Body).Decode(v); err != nil {
+				t.Errorf("%s %s: %v", method, path, err)
+			}
+		}
+		return resp.StatusCode
+	}
+
+	if code := do("GET", "/torrents", "", "", nil); code != http.StatusUnauthorized {
+		t.Errorf("Got %d without a token", code)
+	}
+	if code := do("GET", "/torrents", "wrong", "", nil); code != http.StatusUnauthorized {
+		t.Errorf("Got %d with a bad token", code)
+	}
+
+	var list []TorrentStatus
+	if code := do("GET", "/torrents", "secret", "", &list); code != http.StatusOK || len(list) != 1 {
+		t.Fatalf("Got %d, %v", code, list)
+	}
+	s := list[0]
+	if s.InfoHash != strings.Repeat("78", 20) || s.Name != "album" || s.State != "downloading" ||
+		s.Left != 16 || s.Progress != 20.0/36 || s.GoodPieces != 2 {
+		t.Errorf("Got status %+v", s)
+	}
+
+	path := "/torrents/" + s.InfoHash
+	var files []FileStatus
+	if code := do("GET", path+"/files", "secret", "", &files); code != http.StatusOK {
+		t.Fatalf("Got %d", code)
+	}
+	want := []FileStatus{{"a.flac", 16, "high", 10.0 / 16}, {"b.flac", 20, "normal", 0.5}}
+	if len(files) != len(want) || files[0] != want[0] || files[1] != want[1] {
+		t.Errorf("Got files %+v, wanted %+v", files, want)
+	}
+	var peers []PeerStatus
+	if code := do("GET", path+"/peers", "secret", "", &peers); code != http.StatusOK || len(peers) != 0 {
+		t.Errorf("Got %d, peers %+v", code, peers)
+	}
+
+	if code := do("POST", path+"/pause", "secret", "", &s); code != http.StatusOK || s.State != "paused" {
+		t.Errorf("Got %d, %+v after pausing", code, s)
+	}
+	if code := do("POST", path+"/resume", "secret", "", &s); code != http.StatusOK || s.State != "downloading" {
+		t.Errorf("Got %d, %+v after resuming", code, s)
+	}
+	ts.setCheckProgress(CheckProgress{Checked: 1, Pieces: 4})
+	if code := do("GET", path, "secret", "", &s); code != http.StatusOK || s.State != "checking" ||
+		s.Checking == nil || s.Checking.Checked != 1 {
+		t.Errorf("Got %d, %+v while checking", code, s)
+	}
+	ts.checkDone()
+	if code := do("GET", "/torrents/"+strings.Repeat("79", 20), "secret", "", nil); code != http.StatusNotFound {
+		t.Errorf("Got %d for an unknown torrent", code)
+	}
+
+	var settings Settings
+	if code := do("PUT", "/settings", "secret", `{"maxUploadRate": 100}`, &settings); code != http.StatusOK ||
+		settings != (Settings{100, 0}) {
+		t.Errorf("Got %d, %+v", code, settings)
+	}
+	if up, down := c.RateLimits(); up != 100*1024 || down != 0 {
+		t.Errorf("Got rate limits %d, %d", up, down)
+	}
+	if code := do("PUT", "/settings", "secret", `{"maxDownloadRate": -1}`, nil); code != http.StatusBadRequest {
+		t.Errorf("Got %d for a negative limit", code)
+	}
+}
+
+func TestRemoveAndAddAgain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "taipei-control")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	torrent := createTestTorrent(t, dir, []byte("some data"), &CreateOptions{})
+	defer useFileDir(dir)()
+	ts, err := NewTorrentSession(torrent, 6881)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Its session never runs, so only RemoveTorrent can forget it.
+	c := &Client{sessions: map[string]*TorrentSession{ts.m.InfoHash: ts}, quit: make(chan bool),
+		uploadLimit:   nettools.NewRateLimiter(0),
+		downloadLimit: nettools.NewRateLimiter(0)}
+	defer c.Wait()
+	defer c.StopTorrents()
+	server := httptest.NewServer(&controlHandler{c, ""})
+	defer server.Close()
+
+	req, _ := http.NewRequest("DELETE", server.URL+"/torrents/"+hex.EncodeToString([]byte(ts.m.InfoHash)), nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Got %d when removing the torrent", resp.StatusCode)
+	}
+	if c.session(ts.m.InfoHash) != nil {
+		t.Error("The removed torrent is still listed")
+	}
+
+	body, _ := json.Marshal(map[string]string{"torrent": torrent})
+	resp, err = http.Post(server.URL+"/torrents", "application/json", strings.NewReader(string(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Got %d when adding the torrent again", resp.StatusCode)
+	}
+	if again := c.session(ts.m.InfoHash); again == nil || again == ts {
+		t.Error("The torrent added again isn't listed")
+	}
+}
@@ -0,0 +1,224 @@
+package taipei
+
+// Making .torrent files.
+//
+// References:
+// - http://bittorrent.org/beps/bep_0003.html
+// - http://bittorrent.org/beps/bep_0012.html
+// - http://bittorrent.org/beps/bep_0019.html
+// - http://bittorrent.org/beps/bep_0027.html
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nictuku/Taipei-Torrent/bencode"
+)
+
+const (
+	minPieceLength = 16 * 1024
+	maxPieceLength = 16 * 1024 * 1024
+	// The automatic piece length aims for about this many pieces.
+	targetPieceCount = 1500
+)
+
+// CreateOptions are the optional parts of a new torrent. Zero values are left
+// out of the torrent.
+type CreateOptions struct {
+	PieceLength  int64 // Zero picks one from the size of the content.
+	Announce     string
+	AnnounceList [][]string
+	Private      bool
+	Comment      string
+	CreatedBy    string
+	CreationDate time.Time
+	WebSeeds     []string
+}
+
+// CreateTorrent makes a torrent of the file or directory at root, and writes
+// it to w. Files of a directory are listed in lexical order of their paths,
+// so the same content always gives the same info hash, which is returned.
+// opts can be nil.
+func CreateTorrent(w io.Writer, root string, opts *CreateOptions) (infoHash string, err error) {
+	if opts == nil {
+		opts = &CreateOptions{}
+	}
+	root = filepath.Clean(root)
+	st, err := os.Stat(root)
+	if err != nil {
+		return
+	}
+	var paths []string // Relative to root, with slashes.
+	if st.IsDir() {
+		err = filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if fi.Mode().IsRegular() {
+				rel, err := filepath.Rel(root, p)
+				if err != nil {
+					return err
+				}
+				paths = append(paths, filepath.ToSlash(rel))
+			}
+			return nil
+		})
+		if err != nil {
+			return
+		}
+		if len(paths) == 0 {
+			return "", errors.New("No files to put in the torrent in " + root)
+		}
+	}
+
+	fs, files, totalSize, err := openForCreate(root, paths)
+	if err != nil {
+		return
+	}
+	defer fs.Close()
+	if totalSize == 0 {
+		return "", errors.New("Can't make a torrent of empty files")
+	}
+
+	pieceLength := opts.PieceLength
+	if pieceLength == 0 {
+		pieceLength = choosePieceLength(totalSize)
+	} else if pieceLength < minPieceLength || pieceLength&(pieceLength-1) != 0 {
+		return "", errors.New("Piece length must be a power of two, at least 16 KiB")
+	}
+	sums, err := createSums(fs, totalSize, pieceLength)
+	if err != nil {
+		return
+	}
+
+	info := map[string]interface{}{
+		"name":         filepath.Base(root),
+		"piece length": pieceLength,
+		"pieces":       string(sums),
+	}
+	if st.IsDir() {
+		info["files"] = files
+	} else {
+		info["length"] = totalSize
+	}
+	if opts.Private {
+		info["private"] = 1
+	}
+	var b bytes.Buffer
+	if err = bencode.Marshal(&b, info); err != nil {
+		return
+	}
+	h := sha1.New()
+	h.Write(b.Bytes())
+	infoHash = string(h.Sum(nil))
+
+	torrent := map[string]interface{}{"info": info}
+	if opts.Announce != "" {
+		torrent["announce"] = opts.Announce
+	} else if len(opts.AnnounceList) > 0 && len(opts.AnnounceList[0]) > 0 {
+		torrent["announce"] = opts.AnnounceList[0][0]
+	}
+	if len(opts.AnnounceList) > 0 {
+		torrent["announce-list"] = opts.AnnounceList
+	}
+	if opts.Comment != "" {
+		torrent["comment"] = opts.Comment
+	}
+	if opts.CreatedBy != "" {
+		torrent["created by"] = opts.CreatedBy
+	}
+	if !opts.CreationDate.IsZero() {
+		torrent["creation date"] = opts.CreationDate.Unix()
+	}
+	if len(opts.WebSeeds) > 0 {
+		torrent["url-list"] = opts.WebSeeds
+	}
+	err = bencode.Marshal(w, torrent)
+	return
+}
+
+// createSums is like computeSums, but fails if a file can't be read, or got
+// shorter since it was opened: the torrent would have wrong hashes.
+func createSums(fs *fileStore, totalSize, pieceLength int64) (sums []byte, err error) {
+	r := &errorReader{FileStore: fs}
+	if sums, err = computeSums(r, totalSize, pieceLength); err == nil {
+		err = r.err
+	}
+	return
+}
+
+// errorReader remembers the first error of the reads, which computeSums
+// ignores.
+type errorReader struct {
+	FileStore
+	mu  sync.Mutex
+	err error
+}
+
+func (r *errorReader) ReadAt(p []byte, off int64) (n int, err error) {
+	n, err = r.FileStore.ReadAt(p, off)
+	if err == nil && n < len(p) {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		r.mu.Lock()
+		if r.err == nil {
+			r.err = err
+		}
+		r.mu.Unlock()
+	}
+	return
+}
+
+// openForCreate opens the files of a new torrent for reading. paths is empty
+// for a single file torrent.
+func openForCreate(root string, paths []string) (fs *fileStore, files []interface{}, totalSize int64, err error) {
+	fs = new(fileStore)
+	names := []string{root}
+	if len(paths) > 0 {
+		names = make([]string, len(paths))
+		for i, p := range paths {
+			names[i] = filepath.Join(root, filepath.FromSlash(p))
+		}
+	}
+	for i, name := range names {
+		var fd *os.File
+		if fd, err = os.Open(name); err != nil {
+			fs.Close()
+			return
+		}
+		var st os.FileInfo
+		if st, err = fd.Stat(); err != nil {
+			fd.Close()
+			fs.Close()
+			return
+		}
+		fs.files = append(fs.files, fileEntry{length: st.Size(), fd: fd})
+		fs.offsets = append(fs.offsets, totalSize)
+		totalSize += st.Size()
+		if len(paths) > 0 {
+			files = append(files, map[string]interface{}{
+				"length": st.Size(),
+				"path":   strings.Split(paths[i], "/"),
+			})
+		}
+	}
+	return
+}
+
+// choosePieceLength picks a power of two piece length giving about
+// targetPieceCount pieces.
+func choosePieceLength(totalSize int64) int64 {
+	pieceLength := int64(minPieceLength)
+	for pieceLength < maxPieceLength && (totalSize+pieceLength-1)/pieceLength > targetPieceCount {
+		pieceLength *= 2
+	}
+	return pieceLength
+}
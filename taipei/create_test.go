@@ -0,0 +1,134 @@
+package taipei
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCreateTorrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "taipei-create")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "content")
+	data, err := ioutil.ReadFile("testData/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"b/c", "a", "b/a"} {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		if err = os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(p, data[:len(data)-len(name)], 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	opts := &CreateOptions{
+		AnnounceList: [][]string{{"http://a/announce", "udp://b:80"}, {"http://c/announce"}},
+		Private:      true,
+		Comment:      "test",
+		CreationDate: time.Unix(1234567890, 0),
+		WebSeeds:     []string{"http://example.com/files/"},
+	}
+	var b bytes.Buffer
+	infoHash, err := CreateTorrent(&b, root, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Same content, same info hash.
+	if again, err := CreateTorrent(ioutil.Discard, root, opts); err != nil || again != infoHash {
+		t.Errorf("Info hash changed from %x to %x (%v)", infoHash, again, err)
+	}
+
+	torrent := filepath.Join(dir, "content.torrent")
+	if err = ioutil.WriteFile(torrent, b.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	m, err := getMetaInfo(torrent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.InfoHash != infoHash {
+		t.Errorf("Got info hash %x, wanted %x", m.InfoHash, infoHash)
+	}
+	if m.Announce != "http://a/announce" || !reflect.DeepEqual(m.AnnounceList, opts.AnnounceList) {
+		t.Errorf("Unexpected trackers %v %v", m.Announce, m.AnnounceList)
+	}
+	if !reflect.DeepEqual(m.URLList, opts.WebSeeds) {
+		t.Errorf("Got web seeds %v, wanted %v", m.URLList, opts.WebSeeds)
+	}
+	if m.Comment != "test" || m.Info.Private != 1 || m.Info.Name != "content" {
+		t.Errorf("Unexpected metainfo %+v", m)
+	}
+	if m.Info.PieceLength != minPieceLength {
+		t.Errorf("Got piece length %d, wanted %d", m.Info.PieceLength, minPieceLength)
+	}
+	var paths []string
+	for _, f := range m.Info.Files {
+		paths = append(paths, filepath.Join(f.Path...))
+	}
+	if want := []string{"a", "b/a", "b/c"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("Got files %v, wanted %v", paths, want)
+	}
+
+	// The pieces match the content.
+	fs, totalSize, err := NewFileStore(&m.Info, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	if good, bad, _, err := checkPieces(fs, totalSize, m, nil); err != nil || bad != 0 || good == 0 {
+		t.Errorf("Got %d good and %d bad pieces: %v", good, bad, err)
+	}
+}
+
+func TestChoosePieceLength(t *testing.T) {
+	tests := []struct{ size, pieceLength int64 }{
+		{1, minPieceLength},
+		{1500 * minPieceLength, minPieceLength},
+		{1500*minPieceLength + 1, 2 * minPieceLength},
+		{1 << 40, maxPieceLength},
+	}
+	for _, test := range tests {
+		if got := choosePieceLength(test.size); got != test.pieceLength {
+			t.Errorf("Size %d: got piece length %d, wanted %d", test.size, got, test.pieceLength)
+		}
+	}
+}
+
+func TestCreateTorrentOfChangedFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "taipei-create")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "content")
+	if err = ioutil.WriteFile(root, bytes.Repeat([]byte("x"), 100000), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Without options.
+	if _, err = CreateTorrent(ioutil.Discard, root, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	fs, _, totalSize, err := openForCreate(root, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	// The file gets shorter while we hash it.
+	if err = os.Truncate(root, 50000); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = createSums(fs, totalSize, minPieceLength); err == nil {
+		t.Error("Expected an error for a file that got shorter")
+	}
+}
@@ -0,0 +1,180 @@
+package taipei
+
+// Extension protocol.
+//
+// References:
+// - http://bittorrent.org/beps/bep_0010.html
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/nictuku/Taipei-Torrent/bencode"
+)
+
+const (
+	extensionHandshakeId = 0
+	clientVersion        = "Taipei-Torrent"
+)
+
+// An extensionHandler implements a protocol extension for a session. It is
+// registered with TorrentSession.registerExtension.
+type extensionHandler interface {
+	// handshake is called once the peer's extended handshake has been
+	// parsed, so the extension can start talking to it.
+	handshake(t *TorrentSession, p *peerState)
+	// message handles an extension message from the peer. payload does
+	// not include the extended message id.
+	message(t *TorrentSession, p *peerState, payload []byte) error
+}
+
+type registeredExtension struct {
+	name    string
+	handler extensionHandler
+}
+
+type extendedHandshake struct {
+	M            map[string]int "m"
+	V            string         "v"
+	P            int            "p"
+	Reqq         int            "reqq"
+	YourIP       string         "yourip"
+	MetadataSize int64          "metadata_size"
+}
+
+// registerExtension makes the session advertise the extension under name.
+// Our message id for it is its position in t.extensions, plus one.
+func (t *TorrentSession) registerExtension(name string, handler extensionHandler) {
+	t.extensions = append(t.extensions, registeredExtension{name, handler})
+}
+
+// unmarshalPeerData decodes the bencoded value at the start of b into v, and
+// returns what follows it. The bencode package panics when the data doesn't
+// fit v, which we can't let a peer trigger.
+func unmarshalPeerData(b []byte, v interface{}) (rest []byte, err error) {
+	defer func() {
+		if x := recover(); x != nil {
+			err = fmt.Errorf("bad bencoded data from peer: %v", x)
+		}
+	}()
+	r := bytes.NewReader(b)
+	if err = bencode.Unmarshal(r, v); err != nil {
+		return
+	}
+	rest = b[len(b)-r.Len():]
+	return
+}
+
+// supportsExtension tells if the peer's extended handshake included the
+// extension.
+func (p *peerState) supportsExtension(name string) bool {
+	return p.theirExtensions[name] != 0
+}
+
+// sendExtensionMessage sends msg, bencoded, and then data to the peer, using
+// the peer's message id for the extension name. It does nothing if the peer
+// doesn't support the extension.
+func (t *TorrentSession) sendExtensionMessage(p *peerState, name string, msg interface{}, data []byte) {
+	id := p.theirExtensions[name]
+	if id == 0 {
+		return
+	}
+	t.sendExtensionMessageId(p, id, msg, data)
+}
+
+func (t *TorrentSession) sendExtensionMessageId(p *peerState, id int, msg interface{}, data []byte) {
+	var b bytes.Buffer
+	b.WriteByte(EXTENSION)
+	b.WriteByte(byte(id))
+	if err := bencode.Marshal(&b, msg); err != nil {
+		log.Println("Could not encode extension message:", err)
+		return
+	}
+	b.Write(data)
+	p.sendMessage(b.Bytes())
+}
+
+func (t *TorrentSession) sendExtendedHandshake(p *peerState) {
+	m := make(map[string]interface{})
+	for i, e := range t.extensions {
+		m[e.name] = i + 1
+	}
+	msg := map[string]interface{}{
+		"m":    m,
+		"v":    clientVersion,
+		"p":    t.si.Port,
+		"reqq": MAX_PEER_REQUESTS,
+	}
+	if host, _, err := net.SplitHostPort(p.address); err == nil {
+		if ip := net.ParseIP(host); ip != nil {
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			msg["yourip"] = string(ip)
+		}
+	}
+	if t.m.infoBytes != nil {
+		msg["metadata_size"] = len(t.m.infoBytes)
+	}
+	t.sendExtensionMessageId(p, extensionHandshakeId, msg, nil)
+}
+
+func (t *TorrentSession) doExtension(p *peerState, payload []byte) (err error) {
+	if len(payload) == 0 {
+		return errors.New("Empty extension message")
+	}
+	id := int(payload[0])
+	if id == extensionHandshakeId {
+		return t.doExtendedHandshake(p, payload[1:])
+	}
+	if id > len(t.extensions) {
+		// Not an id we gave out. Ignore it.
+		return
+	}
+	return t.extensions[id-1].handler.message(t, p, payload[1:])
+}
+
+func (t *TorrentSession) doExtendedHandshake(p *peerState, payload []byte) (err error) {
+	var h extendedHandshake
+	if _, err = unmarshalPeerData(payload, &h); err != nil {
+		return
+	}
+	// The handshake can be sent again later, to update some fields.
+	// Extensions missing from m keep their old id. An id of zero
+	// disables the extension. Ids that don't fit in the message byte are
+	// ignored.
+	if p.theirExtensions == nil {
+		p.theirExtensions = make(map[string]int)
+	}
+	for name, id := range h.M {
+		if id == 0 {
+			delete(p.theirExtensions, name)
+		} else if id > 0 && id <= 255 {
+			p.theirExtensions[name] = id
+		}
+	}
+	if h.V != "" {
+		p.client = h.V
+	}
+	if h.P > 0 && h.P < 65536 {
+		p.listenPort = h.P
+	}
+	if h.Reqq > 0 {
+		p.reqq = h.Reqq
+	}
+	if len(h.YourIP) == net.IPv4len || len(h.YourIP) == net.IPv6len {
+		p.ourIP = net.IP(h.YourIP)
+	}
+	if h.MetadataSize > 0 {
+		p.metadataSize = h.MetadataSize
+	}
+	for _, e := range t.extensions {
+		if p.supportsExtension(e.name) {
+			e.handler.handshake(t, p)
+		}
+	}
+	return
+}
@@ -0,0 +1,85 @@
+package taipei
+
+import (
+	"testing"
+)
+
+func TestUnmarshalPeerData(t *testing.T) {
+	payload := []byte("d8:msg_typei1e5:piecei2e10:total_sizei34000eeXYZ")
+	var msg metadataMessage
+	rest, err := unmarshalPeerData(payload, &msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.MsgType != metadataData || msg.Piece != 2 || msg.TotalSize != 34000 {
+		t.Errorf("Wrong message decoded: %+v", msg)
+	}
+	if string(rest) != "XYZ" {
+		t.Errorf("Wanted trailing data %q, got %q", "XYZ", rest)
+	}
+
+	// The bencode package panics when types don't match.
+	var v struct {
+		V string "v"
+	}
+	if _, err = unmarshalPeerData([]byte("d1:vi5ee"), &v); err == nil {
+		t.Errorf("Expected an error for an integer client name")
+	}
+}
+
+type fakeExtension struct {
+	handshakes int
+	messages   []string
+}
+
+func (f *fakeExtension) handshake(t *TorrentSession, p *peerState) {
+	f.handshakes++
+}
+
+func (f *fakeExtension) message(t *TorrentSession, p *peerState, payload []byte) error {
+	f.messages = append(f.messages, string(payload))
+	return nil
+}
+
+func TestExtendedHandshake(t *testing.T) {
+	ts := &TorrentSession{}
+	foo, bar := &fakeExtension{}, &fakeExtension{}
+	ts.registerExtension("foo", foo)
+	ts.registerExtension("bar", bar)
+	p := &peerState{}
+
+	handshake := "\x00d1:md3:fooi7e3:quxi2ee1:pi6881e4:reqqi250e1:v14:Taipei-Torrent6:yourip4:\x7f\x00\x00\x01e"
+	if err := ts.doExtension(p, []byte(handshake)); err != nil {
+		t.Fatal(err)
+	}
+	if p.theirExtensions["foo"] != 7 || !p.supportsExtension("qux") || p.supportsExtension("bar") {
+		t.Errorf("Wrong extensions table: %v", p.theirExtensions)
+	}
+	if p.listenPort != 6881 || p.reqq != 250 || p.client != "Taipei-Torrent" || p.ourIP.String() != "127.0.0.1" {
+		t.Errorf("Wrong handshake fields: %+v", p)
+	}
+	if foo.handshakes != 1 || bar.handshakes != 0 {
+		t.Errorf("Wanted only foo to be told about the handshake, got foo %d, bar %d", foo.handshakes, bar.handshakes)
+	}
+
+	// Our id for bar is 2, the order of registration.
+	if err := ts.doExtension(p, []byte("\x02hello")); err != nil {
+		t.Fatal(err)
+	}
+	// Ids we didn't give out are ignored.
+	if err := ts.doExtension(p, []byte("\x09hello")); err != nil {
+		t.Fatal(err)
+	}
+	if len(foo.messages) != 0 || len(bar.messages) != 1 || bar.messages[0] != "hello" {
+		t.Errorf("Wrong dispatch: foo got %q, bar got %q", foo.messages, bar.messages)
+	}
+
+	// A later handshake can disable an extension. Ids out of range are
+	// ignored.
+	if err := ts.doExtension(p, []byte("\x00d1:md3:bazi256e3:fooi0e3:quxi-1eee")); err != nil {
+		t.Fatal(err)
+	}
+	if p.supportsExtension("foo") || p.supportsExtension("baz") || p.theirExtensions["qux"] != 2 {
+		t.Errorf("Wrong extensions table after update: %v", p.theirExtensions)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"os"
 	"path"
 	"strings"
+	"sync"
 )
 
 type FileStore interface {
@@ -17,11 +18,25 @@ type FileStore interface {
 type fileEntry struct {
 	length int64
 	fd     *os.File
+	// Skipped files only keep the data of the pieces they share with the
+	// files we want: the first head and the last tail bytes. They are
+	// stored one after the other at partsOffset in fd, the parts file.
+	skipped     bool
+	head, tail  int64
+	partsOffset int64
 }
 
+// Name of the file where the parts of skipped files are kept, in the
+// directory of the torrent.
+const partsFileName = ".taipeitorrent.parts"
+
 type fileStore struct {
+	dir     string // Where the files are.
 	offsets []int64
 	files   []fileEntry // Stored in increasing globalOffset order
+	// Streams read off the main loop, so Close must not change the files
+	// under them.
+	mu sync.RWMutex
 }
 
 func (fe *fileEntry) open(name string, length int64) (err error) {
@@ -46,6 +61,70 @@ func (fe *fileEntry) open(name string, length int64) (err error) {
 	return
 }
 
+// partsRange tells where the data of a skipped file from off on is kept in the
+// parts file, and for how many bytes it is contiguous there. ok is false if
+// the data isn't kept at all.
+func (fe *fileEntry) partsRange(off int64) (at, n int64, ok bool) {
+	switch {
+	case off < fe.head:
+		return fe.partsOffset + off, fe.head - off, true
+	case off >= fe.length-fe.tail:
+		return fe.partsOffset + fe.head + off - (fe.length - fe.tail), fe.length - off, true
+	}
+	return 0, fe.length - fe.tail - off, false
+}
+
+func (fe *fileEntry) readAt(p []byte, off int64) (n int, err error) {
+	if !fe.skipped {
+		return fe.fd.ReadAt(p, off)
+	}
+	for len(p) > 0 {
+		at, size, ok := fe.partsRange(off)
+		if size > int64(len(p)) {
+			size = int64(len(p))
+		}
+		m := int(size)
+		if ok {
+			m, err = fe.fd.ReadAt(p[:size], at)
+		} else {
+			for i := range p[:size] {
+				p[i] = 0
+			}
+		}
+		n += m
+		if err != nil {
+			return
+		}
+		p = p[m:]
+		off += int64(m)
+	}
+	return
+}
+
+func (fe *fileEntry) writeAt(p []byte, off int64) (n int, err error) {
+	if !fe.skipped {
+		return fe.fd.WriteAt(p, off)
+	}
+	for len(p) > 0 {
+		at, size, ok := fe.partsRange(off)
+		if !ok {
+			return n, errors.New("Write to a part of a skipped file that isn't kept.")
+		}
+		if size > int64(len(p)) {
+			size = int64(len(p))
+		}
+		var m int
+		m, err = fe.fd.WriteAt(p[:size], at)
+		n += m
+		if err != nil {
+			return
+		}
+		p = p[m:]
+		off += int64(m)
+	}
+	return
+}
+
 func ensureDirectory(fullPath string) (err error) {
 	fullPath = path.Clean(fullPath)
 	if !strings.HasPrefix(fullPath, "/") {
@@ -65,7 +144,20 @@ func ensureDirectory(fullPath string) (err error) {
 }
 
 func NewFileStore(info *InfoDict, storePath string) (f FileStore, totalSize int64, err error) {
-	fs := new(fileStore)
+	fs, totalSize, err := newFileStore(info, storePath, nil)
+	if err != nil {
+		return
+	}
+	return fs, totalSize, nil
+}
+
+// newFileStore is like NewFileStore, with the priority of each file.
+// Skipped files aren't created. The parts of them that share a piece with
+// the files we want are kept in a parts file in storePath instead.
+func newFileStore(info *InfoDict, storePath string, priorities []Priority) (fs *fileStore, totalSize int64, err error) {
+	pieces, _ := piecePriorities(fileLengths(info), priorities, info.PieceLength)
+	pieceLength := info.PieceLength
+	fs = &fileStore{dir: storePath}
 	numFiles := len(info.Files)
 	if numFiles == 0 {
 		// Create dummy Files structure.
@@ -74,7 +166,49 @@ func NewFileStore(info *InfoDict, storePath string) (f FileStore, totalSize int6
 	}
 	fs.files = make([]fileEntry, numFiles)
 	fs.offsets = make([]int64, numFiles)
+	var partsSize int64
+	for i, _ := range info.Files {
+		src := &info.Files[i]
+		fs.offsets[i] = totalSize
+		totalSize += src.Length
+		if priorities == nil || priorities[i] != PrioritySkip {
+			continue
+		}
+		fe := &fs.files[i]
+		fe.length, fe.skipped, fe.partsOffset = src.Length, true, partsSize
+		if src.Length == 0 {
+			continue
+		}
+		start, end := fs.offsets[i], totalSize
+		first, last := start/pieceLength, (end-1)/pieceLength
+		if pieces[first] != PrioritySkip {
+			fe.head = (first+1)*pieceLength - start
+			if fe.head > src.Length {
+				fe.head = src.Length
+			}
+		}
+		if last != first && pieces[last] != PrioritySkip {
+			fe.tail = end - last*pieceLength
+		}
+		partsSize += fe.head + fe.tail
+	}
+	var parts *os.File
+	if partsSize > 0 {
+		var fe fileEntry
+		name := path.Join(storePath, partsFileName)
+		if err = ensureDirectory(name); err != nil {
+			return
+		}
+		if err = fe.open(name, partsSize); err != nil {
+			return
+		}
+		parts = fe.fd
+	}
 	for i, _ := range info.Files {
+		if fs.files[i].skipped {
+			fs.files[i].fd = parts
+			continue
+		}
 		src := &info.Files[i]
 		fullPath := path.Join(storePath, path.Clean(path.Join(src.Path...)))
 		err = ensureDirectory(fullPath)
@@ -85,10 +219,60 @@ func NewFileStore(info *InfoDict, storePath string) (f FileStore, totalSize int6
 		if err != nil {
 			return
 		}
-		fs.offsets[i] = totalSize
-		totalSize += src.Length
 	}
-	f = fs
+	return
+}
+
+// missesParts tells if the skipped file i doesn't keep all its data of the
+// pieces that aren't skipped with the piece priorities pp.
+func (f *fileStore) missesParts(i int, pp []Priority, pieceLength int64) bool {
+	fe := &f.files[i]
+	if !fe.skipped || fe.length == 0 {
+		return false
+	}
+	start, end := f.offsets[i], f.offsets[i]+fe.length
+	first, last := start/pieceLength, (end-1)/pieceLength
+	for piece := first; piece <= last; piece++ {
+		switch {
+		case pp[piece] == PrioritySkip:
+		case piece == first && fe.head > 0:
+		case piece == last && piece != first && fe.tail > 0:
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+// unskip stores the skipped file i, whose path in the torrent is name, in a
+// file of its own again. The parts of it that were kept are copied there.
+func (f *fileStore) unskip(i int, name string) (err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fe := &f.files[i]
+	if !fe.skipped {
+		return
+	}
+	fullPath := path.Join(f.dir, path.Clean(name))
+	if err = ensureDirectory(fullPath); err != nil {
+		return
+	}
+	var own fileEntry
+	if err = own.open(fullPath, fe.length); err != nil {
+		return
+	}
+	for _, part := range []struct{ off, n int64 }{{0, fe.head}, {fe.length - fe.tail, fe.tail}} {
+		b := make([]byte, part.n)
+		if _, err = fe.readAt(b, part.off); err == nil {
+			_, err = own.fd.WriteAt(b, part.off)
+		}
+		if err != nil {
+			own.fd.Close()
+			return
+		}
+	}
+	// The parts file stays as it is, for the other skipped files.
+	fe.fd, fe.skipped = own.fd, false
 	return
 }
 
@@ -110,6 +294,8 @@ func (f *fileStore) find(offset int64) int {
 }
 
 func (f *fileStore) ReadAt(p []byte, off int64) (n int, err error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
 	index := f.find(off)
 	for len(p) > 0 && index < len(f.offsets) {
 		chunk := int64(len(p))
@@ -120,9 +306,8 @@ func (f *fileStore) ReadAt(p []byte, off int64) (n int, err error) {
 			if space < chunk {
 				chunk = space
 			}
-			fd := entry.fd
 			var nThisTime int
-			nThisTime, err = fd.ReadAt(p[0:chunk], itemOffset)
+			nThisTime, err = entry.readAt(p[0:chunk], itemOffset)
 			n = n + nThisTime
 			if err != nil {
 				return
@@ -141,6 +326,8 @@ func (f *fileStore) ReadAt(p []byte, off int64) (n int, err error) {
 }
 
 func (f *fileStore) WriteAt(p []byte, off int64) (n int, err error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
 	index := f.find(off)
 	for len(p) > 0 && index < len(f.offsets) {
 		chunk := int64(len(p))
@@ -151,9 +338,8 @@ func (f *fileStore) WriteAt(p []byte, off int64) (n int, err error) {
 			if space < chunk {
 				chunk = space
 			}
-			fd := entry.fd
 			var nThisTime int
-			nThisTime, err = fd.WriteAt(p[0:chunk], itemOffset)
+			nThisTime, err = entry.writeAt(p[0:chunk], itemOffset)
 			n += nThisTime
 			if err != nil {
 				return
@@ -178,12 +364,30 @@ func (f *fileStore) WriteAt(p []byte, off int64) (n int, err error) {
 }
 
 func (f *fileStore) Close() (err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	for i, _ := range f.files {
 		fd := f.files[i].fd
 		if fd != nil {
+			// The parts file is shared by the skipped files, so it
+			// may be closed already.
 			fd.Close()
 			f.files[i].fd = nil
 		}
 	}
 	return
 }
+
+// Sync commits the files to stable storage.
+func (f *fileStore) Sync() (err error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for i, _ := range f.files {
+		if fd := f.files[i].fd; fd != nil {
+			if err = fd.Sync(); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
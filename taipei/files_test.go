@@ -3,7 +3,9 @@ package taipei
 import (
 	"crypto/sha1"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -32,8 +34,28 @@ func mkFileStore(tf testFile) (fs *fileStore, err error) {
 	if err != nil {
 		return fs, err
 	}
-	f := fileEntry{tf.fileLen, fd}
-	return &fileStore{[]int64{0}, []fileEntry{f}}, nil
+	f := fileEntry{length: tf.fileLen, fd: fd}
+	return &fileStore{offsets: []int64{0}, files: []fileEntry{f}}, nil
+}
+
+// Streams read while the session closes the files. Run with -race.
+func TestFileStoreCloseWhileReading(t *testing.T) {
+	fs, err := mkFileStore(tests[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		b := make([]byte, 100)
+		for {
+			if _, err := fs.ReadAt(b, 10); err != nil {
+				return
+			}
+		}
+	}()
+	fs.Close()
+	<-done
 }
 
 func TestFileStoreRead(t *testing.T) {
@@ -55,3 +77,51 @@ func TestFileStoreRead(t *testing.T) {
 		}
 	}
 }
+
+func TestSkippedFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "taipei-files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Pieces of 10 bytes: [a a a a a a b b b b] [b b b b b b b b b b]
+	// [b b b b b b c c c c] [c c].
+	info := InfoDict{PieceLength: 10, Files: []FileDict{
+		{Length: 6, Path: []string{"a"}},
+		{Length: 20, Path: []string{"b"}},
+		{Length: 6, Path: []string{"c"}}}}
+	fs, totalSize, err := newFileStore(&info, dir, []Priority{PriorityNormal, PrioritySkip, PriorityNormal})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	if totalSize != 32 {
+		t.Errorf("Got total size %d, wanted 32", totalSize)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "b")); !os.IsNotExist(err) {
+		t.Errorf("Skipped file was created: %v", err)
+	}
+	// Only the 4 + 6 bytes of b in the first and third pieces are kept.
+	if st, err := os.Stat(filepath.Join(dir, partsFileName)); err != nil || st.Size() != 10 {
+		t.Errorf("Parts file: %v, %v", st, err)
+	}
+
+	data := []byte("0123456789abcdefghij")
+	for _, piece := range []int64{0, 2} {
+		if _, err = fs.WriteAt(data[piece*5:piece*5+10], piece*10); err != nil {
+			t.Fatalf("Writing piece %d: %v", piece, err)
+		}
+	}
+	if _, err = fs.WriteAt(data[:10], 10); err == nil {
+		t.Errorf("Wrote a piece of the skipped file only")
+	}
+	for _, piece := range []int64{0, 2} {
+		got := make([]byte, 10)
+		if _, err = fs.ReadAt(got, piece*10); err != nil || string(got) != string(data[piece*5:piece*5+10]) {
+			t.Errorf("Piece %d: got %q, %v", piece, got, err)
+		}
+	}
+	if got, err := ioutil.ReadFile(filepath.Join(dir, "c")); err != nil || string(got) != "ghij\x00\x00" {
+		t.Errorf("Got %q, %v in c", got, err)
+	}
+}
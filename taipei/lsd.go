@@ -0,0 +1,222 @@
+package taipei
+
+// Local Service Discovery.
+//
+// With -useLSD, the client announces its torrents to the local network over
+// multicast, and connects to the peers it hears announcing the same torrents.
+// Clients on the same LAN then find each other without a tracker or the DHT.
+// Private torrents are never announced.
+//
+// References:
+// - http://bittorrent.org/beps/bep_0014.html
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	lsdGroup4 = "239.192.152.143:6771"
+	lsdGroup6 = "[ff15::efc0:988f]:6771"
+	// How often each torrent is announced. BEP 14 asks for no more than
+	// once a minute.
+	lsdInterval = 5 * time.Minute
+)
+
+var useLSD bool
+
+func init() {
+	flag.BoolVar(&useLSD, "useLSD", false, "Find peers on the local network with multicast announces.")
+}
+
+// localDiscovery sends and receives the announces, on the IPv4 and IPv6
+// groups.
+type localDiscovery struct {
+	port    int    // Our listen port, which we announce.
+	cookie  string // Tells our own announces apart.
+	conns   []*net.UDPConn
+	senders []*net.UDPConn // Unlike conns, their announces loop back to this host.
+	groups  []*net.UDPAddr // The group of each conn.
+}
+
+// newLocalDiscovery joins the groups. It fails only if it can join none.
+func newLocalDiscovery(port int) (l *localDiscovery, err error) {
+	var b [8]byte
+	if _, err = rand.Read(b[:]); err != nil {
+		return
+	}
+	l = &localDiscovery{port: port, cookie: hex.EncodeToString(b[:])}
+	for _, g := range []struct{ network, addr string }{{"udp4", lsdGroup4}, {"udp6", lsdGroup6}} {
+		group, e := net.ResolveUDPAddr(g.network, g.addr)
+		if e != nil {
+			err = e
+			continue
+		}
+		conn, e := net.ListenMulticastUDP(g.network, nil, group)
+		if e != nil {
+			err = e
+			continue
+		}
+		// ListenMulticastUDP turns off the loopback of what it sends, so
+		// other clients on this host would not hear us.
+		sender, e := net.ListenUDP(g.network, nil)
+		if e != nil {
+			conn.Close()
+			err = e
+			continue
+		}
+		l.conns = append(l.conns, conn)
+		l.senders = append(l.senders, sender)
+		l.groups = append(l.groups, group)
+	}
+	if len(l.conns) == 0 {
+		return nil, err
+	}
+	return l, nil
+}
+
+// announce tells the local network we have the torrent.
+func (l *localDiscovery) announce(infoHash string) {
+	for i, sender := range l.senders {
+		msg := "BT-SEARCH * HTTP/1.1\r\n" +
+			"Host: " + l.groups[i].String() + "\r\n" +
+			"Port: " + strconv.Itoa(l.port) + "\r\n" +
+			"Infohash: " + hex.EncodeToString([]byte(infoHash)) + "\r\n" +
+			"cookie: " + l.cookie + "\r\n" +
+			"\r\n\r\n"
+		if _, err := sender.WriteToUDP([]byte(msg), l.groups[i]); err != nil {
+			log.Println("LSD announce failed:", err)
+		}
+	}
+}
+
+// listen calls found with the info hashes and addresses of the peers we
+// hear announcing, until Close.
+func (l *localDiscovery) listen(found func(infoHash, peer string)) {
+	for _, conn := range l.conns {
+		go l.read(conn, found)
+	}
+}
+
+func (l *localDiscovery) read(conn *net.UDPConn, found func(infoHash, peer string)) {
+	b := make([]byte, 1500)
+	for {
+		n, addr, err := conn.ReadFromUDP(b)
+		if err != nil {
+			return
+		}
+		infoHashes, port, ok := l.parse(b[:n])
+		if !ok {
+			continue
+		}
+		host := addr.IP.String()
+		if addr.Zone != "" {
+			host += "%" + addr.Zone
+		}
+		peer := net.JoinHostPort(host, strconv.Itoa(port))
+		for _, ih := range infoHashes {
+			found(ih, peer)
+		}
+	}
+}
+
+// parse reads an announce. It is not ok if it is malformed, or ours.
+func (l *localDiscovery) parse(msg []byte) (infoHashes []string, port int, ok bool) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(msg)))
+	if err != nil || req.Method != "BT-SEARCH" || req.Header.Get("Cookie") == l.cookie {
+		return
+	}
+	port, err = strconv.Atoi(req.Header.Get("Port"))
+	if err != nil || port <= 0 || port > 65535 {
+		return
+	}
+	for _, h := range req.Header["Infohash"] {
+		ih, err := hex.DecodeString(h)
+		if err == nil && len(ih) == 20 {
+			infoHashes = append(infoHashes, string(ih))
+		}
+	}
+	return infoHashes, port, len(infoHashes) > 0
+}
+
+// Close leaves the groups. Announces fail after it.
+func (l *localDiscovery) Close() {
+	for i, conn := range l.conns {
+		conn.Close()
+		l.senders[i].Close()
+	}
+}
+
+// lsdAllowed tells if the torrent can be announced on the local network.
+// Until we have the info dictionary of a magnet link, we don't know if it is
+// private.
+func (t *TorrentSession) lsdAllowed() bool {
+	return t.si.HaveTorrent && t.m.Info.Private != 1 && !t.paused
+}
+
+// startLSD joins the LSD groups, if -useLSD is set, and announces the
+// torrents every lsdInterval. StopTorrents makes it leave the groups.
+func (c *Client) startLSD() (err error) {
+	if !useLSD {
+		return
+	}
+	if c.lsd, err = newLocalDiscovery(c.listenPort); err != nil {
+		return
+	}
+	c.lsd.listen(c.lsdPeerFound)
+	go func() {
+		ticker := time.NewTicker(lsdInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				for _, ih := range c.infoHashes() {
+					c.lsdAnnounce(ih)
+				}
+			case <-c.quit:
+				c.lsd.Close()
+				return
+			}
+		}
+	}()
+	return
+}
+
+// lsdAnnounce announces the torrent on the local network, if it is allowed.
+func (c *Client) lsdAnnounce(infoHash string) {
+	select {
+	case <-c.quit:
+		return
+	default:
+	}
+	ts := c.session(infoHash)
+	if ts == nil {
+		return
+	}
+	var allowed bool
+	if ts.call(func() { allowed = ts.lsdAllowed() }) && allowed {
+		c.lsd.announce(infoHash)
+	}
+}
+
+// lsdPeerFound connects to a peer heard on the local network, if we have
+// the torrent it announced.
+func (c *Client) lsdPeerFound(infoHash, peer string) {
+	ts := c.session(infoHash)
+	if ts == nil {
+		return
+	}
+	ts.call(func() {
+		if ts.lsdAllowed() && ts.dialNewPeer(peer) {
+			log.Println("Contacting", peer, "found on the local network")
+		}
+	})
+}
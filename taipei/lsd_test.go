@@ -0,0 +1,128 @@
+package taipei
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// multicastWorks tells if a packet sent to the IPv4 LSD group comes back to
+// this host.
+func multicastWorks() bool {
+	group, err := net.ResolveUDPAddr("udp4", lsdGroup4)
+	if err != nil {
+		return false
+	}
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	sender, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return false
+	}
+	defer sender.Close()
+	if _, err = sender.WriteToUDP([]byte("probe"), group); err != nil {
+		return false
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	b := make([]byte, 100)
+	for {
+		n, _, err := conn.ReadFromUDP(b)
+		if err != nil {
+			return false
+		}
+		if string(b[:n]) == "probe" {
+			return true
+		}
+	}
+}
+
+func TestLocalDiscovery(t *testing.T) {
+	if !multicastWorks() {
+		t.Skip("Multicast is not available.")
+	}
+	a, err := newLocalDiscovery(1111)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := newLocalDiscovery(2222)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	type announce struct{ infoHash, peer string }
+	heardByA := make(chan announce, 10)
+	heardByB := make(chan announce, 10)
+	ih := strings.Repeat("l", 20)
+	a.listen(func(infoHash, peer string) {
+		if infoHash == ih {
+			heardByA <- announce{infoHash, peer}
+		}
+	})
+	b.listen(func(infoHash, peer string) {
+		if infoHash == ih {
+			heardByB <- announce{infoHash, peer}
+		}
+	})
+
+	a.announce(ih)
+	select {
+	case got := <-heardByB:
+		if _, port, err := net.SplitHostPort(got.peer); err != nil || port != "1111" {
+			t.Errorf("Got peer %q", got.peer)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The announce wasn't heard.")
+	}
+	// A ignores its own announces.
+	select {
+	case got := <-heardByA:
+		t.Errorf("Heard our own announce from %q", got.peer)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestLocalDiscoveryParse(t *testing.T) {
+	l := &localDiscovery{cookie: "ours"}
+	msg := "BT-SEARCH * HTTP/1.1\r\nHost: 239.192.152.143:6771\r\nPort: 6881\r\n" +
+		"Infohash: " + strings.Repeat("61", 20) + "\r\nInfohash: " + strings.Repeat("62", 20) + "\r\n\r\n\r\n"
+	ihs, port, ok := l.parse([]byte(msg))
+	if !ok || port != 6881 || len(ihs) != 2 || ihs[0] != strings.Repeat("a", 20) || ihs[1] != strings.Repeat("b", 20) {
+		t.Errorf("Got %q, %d, %v", ihs, port, ok)
+	}
+	for _, bad := range []string{
+		strings.Replace(msg, "Port: 6881", "Port: 0", 1),
+		strings.Replace(msg, "BT-SEARCH", "GET", 1),
+		strings.Replace(msg, "\r\n\r\n\r\n", "\r\ncookie: ours\r\n\r\n\r\n", 1),
+		"BT-SEARCH * HTTP/1.1\r\nPort: 6881\r\nInfohash: abc\r\n\r\n\r\n",
+	} {
+		if ihs, port, ok := l.parse([]byte(bad)); ok {
+			t.Errorf("Parsed %q as %q, %d", bad, ihs, port)
+		}
+	}
+}
+
+func TestLSDAllowed(t *testing.T) {
+	for _, c := range []struct {
+		haveTorrent bool
+		private     int64
+		paused      bool
+		want        bool
+	}{
+		{true, 0, false, true},
+		{true, 1, false, false},
+		{false, 0, false, false}, // A magnet link, maybe private.
+		{true, 0, true, false},
+	} {
+		ts := &TorrentSession{m: &MetaInfo{Info: InfoDict{Private: c.private}},
+			si: &SessionInfo{HaveTorrent: c.haveTorrent}, paused: c.paused}
+		if got := ts.lsdAllowed(); got != c.want {
+			t.Errorf("Got %v for %+v", got, c)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package taipei
+
+// Metadata exchange for magnet links.
+//
+// References:
+// - http://bittorrent.org/beps/bep_0009.html
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"log"
+	"time"
+)
+
+const (
+	metadataPieceSize = 16 * 1024
+	// Refuse to download info dictionaries bigger than this.
+	maxMetadataSize = 10 * 1024 * 1024
+)
+
+// ut_metadata message types.
+const (
+	metadataRequest = iota
+	metadataData
+	metadataReject
+)
+
+type metadataMessage struct {
+	MsgType   int   "msg_type"
+	Piece     int   "piece"
+	TotalSize int64 "total_size"
+}
+
+// utMetadata is the ut_metadata extension handler.
+type utMetadata struct{}
+
+func (utMetadata) handshake(t *TorrentSession, p *peerState) {
+	t.requestMetadata(p)
+}
+
+func (utMetadata) message(t *TorrentSession, p *peerState, payload []byte) error {
+	return t.doMetadata(p, payload)
+}
+
+// doMessageWithoutMetadata handles messages from peers while we don't know
+// yet the size and number of pieces of the torrent.
+func (t *TorrentSession) doMessageWithoutMetadata(p *peerState, message []byte) (err error) {
+	switch message[0] {
+	case CHOKE:
+		p.peer_choking = true
+	case UNCHOKE:
+		p.peer_choking = false
+	case INTERESTED:
+		p.peer_interested = true
+	case NOT_INTERESTED:
+		p.peer_interested = false
+	case BITFIELD:
+		if p.temporaryBitfield != nil {
+			return errors.New("Late bitfield operation")
+		}
+		// Checked once we know how many pieces there are.
+		p.temporaryBitfield = message[1:]
+	case PORT:
+		return t.doPort(p, message)
+	case EXTENSION:
+		return t.doExtension(p, message[1:])
+	default:
+		// HAVE messages are lost; the peer will still be asked for
+		// pieces from its bitfield. There is nothing to request or send
+		// yet.
+	}
+	return
+}
+
+// requestMetadata asks the peer for the pieces of the info dictionary we're
+// still missing.
+func (t *TorrentSession) requestMetadata(p *peerState) {
+	if t.si.HaveTorrent || p.badMetadata || p.metadataSize <= 0 || p.metadataSize > maxMetadataSize {
+		return
+	}
+	if !p.supportsExtension("ut_metadata") {
+		return
+	}
+	if t.metadataSize == 0 {
+		t.metadataSize = p.metadataSize
+		numPieces := (t.metadataSize + metadataPieceSize - 1) / metadataPieceSize
+		t.metadataPieces = make([][]byte, numPieces)
+		t.metadataSenders = make([]*peerState, numPieces)
+	}
+	if p.metadataSize != t.metadataSize {
+		// Either this peer or the ones before it are lying. If the others
+		// were, we'll find out when checking the hash.
+		return
+	}
+	for i, piece := range t.metadataPieces {
+		if piece == nil {
+			msg := map[string]interface{}{"msg_type": metadataRequest, "piece": i}
+			t.sendExtensionMessage(p, "ut_metadata", msg, nil)
+		}
+	}
+}
+
+func (t *TorrentSession) doMetadata(p *peerState, payload []byte) (err error) {
+	var msg metadataMessage
+	data, err := unmarshalPeerData(payload, &msg)
+	if err != nil {
+		return
+	}
+	switch msg.MsgType {
+	case metadataRequest:
+		t.sendMetadataPiece(p, msg.Piece)
+	case metadataData:
+		if t.si.HaveTorrent || p.badMetadata || msg.Piece < 0 || msg.Piece >= len(t.metadataPieces) ||
+			msg.TotalSize != t.metadataSize {
+			return
+		}
+		// All pieces are full size, except the last one.
+		size := int64(metadataPieceSize)
+		if msg.Piece == len(t.metadataPieces)-1 {
+			size = t.metadataSize - int64(msg.Piece)*metadataPieceSize
+		}
+		if int64(len(data)) != size {
+			return errors.New("Unexpected metadata piece length")
+		}
+		t.metadataPieces[msg.Piece] = data
+		t.metadataSenders[msg.Piece] = p
+		for _, piece := range t.metadataPieces {
+			if piece == nil {
+				return
+			}
+		}
+		return t.gotMetadata()
+	case metadataReject:
+		// We'll ask someone else.
+	}
+	return
+}
+
+func (t *TorrentSession) sendMetadataPiece(p *peerState, piece int) {
+	info := t.m.infoBytes
+	begin := piece * metadataPieceSize
+	if info == nil || piece < 0 || begin >= len(info) {
+		t.sendExtensionMessage(p, "ut_metadata", map[string]interface{}{
+			"msg_type": metadataReject, "piece": piece}, nil)
+		return
+	}
+	end := begin + metadataPieceSize
+	if end > len(info) {
+		end = len(info)
+	}
+	msg := map[string]interface{}{
+		"msg_type":   metadataData,
+		"piece":      piece,
+		"total_size": len(info),
+	}
+	t.sendExtensionMessage(p, "ut_metadata", msg, info[begin:end])
+}
+
+// gotMetadata checks the info dictionary we put together against the info
+// hash and, if it matches, starts the download proper.
+func (t *TorrentSession) gotMetadata() (err error) {
+	b := bytes.Join(t.metadataPieces, nil)
+	senders := t.metadataSenders
+	t.metadataSize = 0
+	t.metadataPieces, t.metadataSenders = nil, nil
+
+	h := sha1.New()
+	h.Write(b)
+	if string(h.Sum(nil)) != t.m.InfoHash {
+		// We can't tell which of them lied, so none of them is asked
+		// again.
+		log.Println("Metadata doesn't match the info hash. Trying again with other peers.")
+		for _, p := range senders {
+			p.badMetadata = true
+		}
+		for _, p := range t.peers {
+			t.requestMetadata(p)
+		}
+		return
+	}
+	var info InfoDict
+	if _, err = unmarshalPeerData(b, &info); err != nil {
+		log.Println("Could not parse the metadata:", err)
+		return nil
+	}
+	t.m.Info = info
+	t.m.infoBytes = b
+	log.Printf("Got metadata for %x: %v", t.m.InfoHash, info.Name)
+
+	if err = t.loadKeepingAlive(); err != nil {
+		log.Println("Could not open the torrent files:", err)
+		return
+	}
+	for _, p := range t.peers {
+		if p.temporaryBitfield != nil {
+			p.have = NewBitsetFromBytes(t.totalPieces, p.temporaryBitfield)
+			p.temporaryBitfield = nil
+		}
+		if p.have == nil {
+			p.have = NewBitset(t.totalPieces)
+		}
+		t.addAvailability(p.have)
+		t.checkInteresting(p)
+		if !p.peer_choking {
+			for i := 0; i < MAX_OUR_REQUESTS; i++ {
+				t.RequestBlock(p)
+			}
+		}
+	}
+	return
+}
+
+// loadKeepingAlive runs load, which can take a while for big torrents, and
+// keeps the deadlock detector informed that the main loop is still alive.
+func (t *TorrentSession) loadKeepingAlive() (err error) {
+	done := make(chan error)
+	go func() {
+		done <- t.load()
+	}()
+	heartBeat := time.NewTicker(time.Second)
+	defer heartBeat.Stop()
+	for {
+		select {
+		case err = <-done:
+			return
+		case <-heartBeat.C:
+			t.lastHeartBeat = time.Now()
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package taipei
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/nictuku/Taipei-Torrent/bencode"
+)
+
+// metadataRequests reads the ut_metadata requests sent to the peer, and
+// returns the pieces asked for.
+func metadataRequests(t *testing.T, p *peerState) (pieces []int) {
+	for {
+		select {
+		case b := <-p.writeChan:
+			if len(b) < 2 || b[0] != EXTENSION || b[1] != 3 {
+				continue
+			}
+			var msg metadataMessage
+			if _, err := unmarshalPeerData(b[2:], &msg); err != nil || msg.MsgType != metadataRequest {
+				t.Fatalf("Unexpected message %q", b)
+			}
+			pieces = append(pieces, msg.Piece)
+		default:
+			return
+		}
+	}
+}
+
+func TestMetadataExchange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "taipei-metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer useFileDir(dir)()
+
+	// Big enough for two metadata pieces.
+	info := InfoDict{Name: "big", PieceLength: 16, Length: 16 * 1200,
+		Pieces: strings.Repeat("01234567890123456789", 1200)}
+	var b bytes.Buffer
+	if err = bencode.Marshal(&b, info); err != nil {
+		t.Fatal(err)
+	}
+	infoBytes := b.Bytes()
+	if len(infoBytes) <= metadataPieceSize || len(infoBytes) > 2*metadataPieceSize {
+		t.Fatalf("The info dictionary is %d bytes long", len(infoBytes))
+	}
+	h := sha1.New()
+	h.Write(infoBytes)
+	ts := &TorrentSession{m: &MetaInfo{InfoHash: string(h.Sum(nil))},
+		si:    &SessionInfo{},
+		peers: make(map[string]*peerState)}
+	newPeer := func(address string) *peerState {
+		p := &peerState{address: address, writeChan: make(chan []byte, 10), peer_choking: true,
+			theirExtensions: map[string]int{"ut_metadata": 3}, metadataSize: int64(len(infoBytes))}
+		ts.peers[p.address] = p
+		return p
+	}
+	bad, good := newPeer("127.0.0.1:6881"), newPeer("127.0.0.2:6881")
+
+	send := func(p *peerState, piece int, data []byte) error {
+		var msg bytes.Buffer
+		bencode.Marshal(&msg, map[string]interface{}{
+			"msg_type": metadataData, "piece": piece, "total_size": len(infoBytes)})
+		msg.Write(data)
+		return ts.doMetadata(p, msg.Bytes())
+	}
+	pieces := [][]byte{infoBytes[:metadataPieceSize], infoBytes[metadataPieceSize:]}
+
+	for _, p := range []*peerState{bad, good} {
+		ts.requestMetadata(p)
+		if got := metadataRequests(t, p); len(got) != 2 || got[0] != 0 || got[1] != 1 {
+			t.Fatalf("Requested pieces %v", got)
+		}
+	}
+	if err = send(bad, 1, pieces[1][1:]); err == nil {
+		t.Errorf("Expected an error for a short piece")
+	}
+
+	// A corrupted set doesn't match the info hash. It is asked for again,
+	// but not from the peer that sent it.
+	corrupted := append([]byte(nil), pieces[0]...)
+	corrupted[100] ^= 1
+	for i, piece := range [][]byte{corrupted, pieces[1]} {
+		if err = send(bad, i, piece); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ts.si.HaveTorrent {
+		t.Fatal("Took metadata that doesn't match the info hash")
+	}
+	if got := metadataRequests(t, bad); got != nil {
+		t.Fatalf("Asked the bad peer for pieces %v again", got)
+	}
+	if got := metadataRequests(t, good); len(got) != 2 || got[0] != 0 || got[1] != 1 {
+		t.Fatalf("Requested pieces %v after a bad set", got)
+	}
+	// What the bad peer sends now is ignored.
+	if err = send(bad, 0, corrupted); err != nil {
+		t.Fatal(err)
+	}
+
+	// The pieces can come in any order.
+	for _, i := range []int{1, 0} {
+		if err = send(good, i, pieces[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ts.fileStore != nil {
+		defer ts.fileStore.Close()
+	}
+	if !ts.si.HaveTorrent || !bytes.Equal(ts.m.infoBytes, infoBytes) || ts.m.Info.Name != "big" {
+		t.Fatalf("Didn't take the metadata: %+v", ts.m.Info)
+	}
+	if ts.totalPieces != 1200 || ts.goodPieces != 0 || good.have == nil || good.have.n != 1200 {
+		t.Errorf("Got %d pieces, %d good, peer has %v", ts.totalPieces, ts.goodPieces, good.have)
+	}
+	// Later pieces are ignored.
+	if err = send(good, 0, pieces[0]); err != nil || metadataRequests(t, good) != nil {
+		t.Errorf("Got %v for a late piece", err)
+	}
+}
@@ -37,10 +37,14 @@ type MetaInfo struct {
 	Info         InfoDict
 	InfoHash     string
 	Announce     string
-	CreationDate string "creation date"
+	AnnounceList [][]string "announce-list"
+	CreationDate string     "creation date"
 	Comment      string
 	CreatedBy    string "created by"
 	Encoding     string
+	URLList      []string // Web seeds (BEP 19).
+
+	infoBytes []byte // The bencoded info dictionary, as hashed.
 }
 
 func getString(m map[string]interface{}, k string) string {
@@ -52,6 +56,43 @@ func getString(m map[string]interface{}, k string) string {
 	return ""
 }
 
+// getStringList reads a string or a list of strings, like url-list.
+// Elements of the wrong type are skipped.
+func getStringList(m map[string]interface{}, k string) (strs []string) {
+	switch v := m[k].(type) {
+	case string:
+		if v != "" {
+			strs = []string{v}
+		}
+	case []interface{}:
+		for _, s := range v {
+			if s, ok := s.(string); ok && s != "" {
+				strs = append(strs, s)
+			}
+		}
+	}
+	return
+}
+
+// getStringLists reads a list of lists of strings, like announce-list.
+// Elements of the wrong type are skipped.
+func getStringLists(m map[string]interface{}, k string) (lists [][]string) {
+	l, _ := m[k].([]interface{})
+	for _, v := range l {
+		inner, _ := v.([]interface{})
+		var strs []string
+		for _, s := range inner {
+			if s, ok := s.(string); ok {
+				strs = append(strs, s)
+			}
+		}
+		if len(strs) > 0 {
+			lists = append(lists, strs)
+		}
+	}
+	return
+}
+
 func getMetaInfo(torrent string) (metaInfo *MetaInfo, err error) {
 	var input io.ReadCloser
 	if strings.HasPrefix(torrent, "http:") {
@@ -61,10 +102,7 @@ func getMetaInfo(torrent string) (metaInfo *MetaInfo, err error) {
 		}
 		input = r.Body
 	} else if strings.HasPrefix(torrent, "magnet:") {
-		input, err = torrentFromMagnet(torrent)
-		if err != nil {
-			return
-		}
+		return metaInfoFromMagnet(torrent)
 	} else {
 		if input, err = os.Open(torrent); err != nil {
 			return
@@ -101,6 +139,7 @@ func getMetaInfo(torrent string) (metaInfo *MetaInfo, err error) {
 	hash.Write(b.Bytes())
 
 	var m2 MetaInfo
+	m2.infoBytes = append([]byte(nil), b.Bytes()...)
 	err = bencode.Unmarshal(&b, &m2.Info)
 	if err != nil {
 		return
@@ -108,10 +147,12 @@ func getMetaInfo(torrent string) (metaInfo *MetaInfo, err error) {
 
 	m2.InfoHash = string(hash.Sum(nil))
 	m2.Announce = getString(topMap, "announce")
+	m2.AnnounceList = getStringLists(topMap, "announce-list")
 	m2.CreationDate = getString(topMap, "creation date")
 	m2.Comment = getString(topMap, "comment")
 	m2.CreatedBy = getString(topMap, "created by")
 	m2.Encoding = getString(topMap, "encoding")
+	m2.URLList = getStringList(topMap, "url-list")
 
 	metaInfo = &m2
 	return
@@ -126,18 +167,20 @@ type TrackerResponse struct {
 	Complete       int
 	Incomplete     int
 	Peers          string
+	Peers6         string "peers6" // BEP 7.
 }
 
 type SessionInfo struct {
-	PeerId     string
-	Port       int
-	Uploaded   int64
-	Downloaded int64
-	Left       int64
+	PeerId      string
+	Port        int
+	Uploaded    int64
+	Downloaded  int64
+	Left        int64
+	HaveTorrent bool // False until we have the info dictionary of a magnet link.
 }
 
 func getTrackerInfo(url string) (tr *TrackerResponse, err error) {
-	r, err := http.Get(url)
+	r, err := trackerClient.Get(url)
 	if err != nil {
 		return
 	}
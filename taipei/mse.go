@@ -0,0 +1,377 @@
+package taipei
+
+// Message stream encryption.
+//
+// The peers agree on a secret with a Diffie-Hellman exchange, and the one that
+// dialed proves which torrent it wants without sending the info hash in the
+// clear. After that the BitTorrent stream is RC4 encrypted in each direction,
+// or left in plaintext if that is what the peers settled on.
+//
+// References:
+// - http://wiki.vuze.com/w/Message_Stream_Encryption
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"io"
+	"math/big"
+	"net"
+	"time"
+)
+
+// Encryption policies.
+const (
+	encryptionDisabled  = "disabled"  // Plaintext only.
+	encryptionPreferred = "preferred" // Encrypt if the peer can, else plaintext.
+	encryptionRequired  = "required"  // Never talk to peers in plaintext.
+)
+
+// Should be overriden by flag. Not thread safe.
+var encryption string
+
+func init() {
+	flag.StringVar(&encryption, "encryption", encryptionPreferred,
+		"Peer connection encryption: disabled, preferred or required.")
+}
+
+const (
+	mseKeyLength = 96 // Of the public keys and the shared secret.
+	mseMaxPad    = 512
+	// RC4 keystream bytes thrown away before use.
+	mseDiscard = 1024
+	// Ways to carry the BitTorrent stream, in crypto_provide and
+	// crypto_select.
+	mseCryptoPlaintext = 0x01
+	mseCryptoRC4       = 0x02
+)
+
+var msePrime, _ = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD1"+
+	"29024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F1437"+
+	"4FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+
+var mseGenerator = big.NewInt(2)
+
+// Verification constant.
+var mseVC = make([]byte, 8)
+
+func validEncryption(policy string) bool {
+	return policy == encryptionDisabled || policy == encryptionPreferred || policy == encryptionRequired
+}
+
+// mseConn is a connection established with an MSE handshake. Nil ciphers
+// mean the stream is in plaintext.
+type mseConn struct {
+	net.Conn
+	r        io.Reader // Holds on to what was read past the handshake.
+	enc, dec *rc4.Cipher
+}
+
+func (c *mseConn) Read(b []byte) (n int, err error) {
+	n, err = c.r.Read(b)
+	if c.dec != nil {
+		c.dec.XORKeyStream(b[:n], b[:n])
+	}
+	return
+}
+
+func (c *mseConn) Write(b []byte) (int, error) {
+	if c.enc == nil {
+		return c.Conn.Write(b)
+	}
+	buf := make([]byte, len(b))
+	c.enc.XORKeyStream(buf, b)
+	return c.Conn.Write(buf)
+}
+
+// isEncrypted tells if the traffic of the connection is encrypted.
+func isEncrypted(conn net.Conn) bool {
+	switch c := conn.(type) {
+	case *replayConn:
+		return isEncrypted(c.Conn)
+	case *mseConn:
+		return c.enc != nil
+	}
+	return false
+}
+
+// dialEncrypted connects to a peer with dial, encrypting the connection as
+// the policy asks. With the preferred policy, peers that fail the encrypted
+// handshake are dialed again in plaintext.
+func dialEncrypted(dial func(addr string) (net.Conn, error), peer, infoHash, policy string) (conn net.Conn, err error) {
+	if policy == encryptionDisabled {
+		return dial(peer)
+	}
+	if conn, err = dial(peer); err != nil {
+		return
+	}
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	encrypted, err := mseInitiate(conn, infoHash, policy)
+	if err == nil {
+		conn.SetDeadline(time.Time{})
+		return encrypted, nil
+	}
+	conn.Close()
+	if policy == encryptionRequired {
+		return nil, err
+	}
+	return dial(peer)
+}
+
+// acceptEncryption reads the start of an incoming connection and, if it is
+// an encrypted handshake, answers it. Either way, the returned connection
+// reads the plaintext BitTorrent handshake. skeys returns the info hashes of
+// the torrents we serve.
+func acceptEncryption(conn net.Conn, policy string, skeys func() []string) (net.Conn, error) {
+	first := make([]byte, len(kBitTorrentHeader))
+	if _, err := io.ReadFull(conn, first); err != nil {
+		return nil, err
+	}
+	if bytes.Equal(first, kBitTorrentHeader) {
+		if policy == encryptionRequired {
+			return nil, errors.New("plaintext connections are not allowed")
+		}
+		return &replayConn{conn, io.MultiReader(bytes.NewReader(first), conn)}, nil
+	}
+	if policy == encryptionDisabled {
+		return nil, errors.New("encrypted connections are not allowed")
+	}
+	return mseAccept(conn, first, policy, skeys)
+}
+
+// mseInitiate does the handshake of the dialing side, for the torrent with
+// the info hash skey.
+func mseInitiate(conn net.Conn, skey, policy string) (net.Conn, error) {
+	x, y, err := mseKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	if _, err = conn.Write(append(y, msePad()...)); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	yb := make([]byte, mseKeyLength)
+	if _, err = io.ReadFull(r, yb); err != nil {
+		return nil, err
+	}
+	s := mseSecret(x, yb)
+	enc := mseCipher("keyA", s, skey)
+	dec := mseCipher("keyB", s, skey)
+
+	provide := uint32(mseCryptoRC4)
+	if policy != encryptionRequired {
+		provide |= mseCryptoPlaintext
+	}
+	msg := mseHash("req1", s)
+	msg = append(msg, mseXor(mseHash("req2", skey), mseHash("req3", s))...)
+	// VC, crypto_provide, empty PadC and no initial payload.
+	plain := make([]byte, 16)
+	binary.BigEndian.PutUint32(plain[8:12], provide)
+	encrypted := make([]byte, len(plain))
+	enc.XORKeyStream(encrypted, plain)
+	if _, err = conn.Write(append(msg, encrypted...)); err != nil {
+		return nil, err
+	}
+
+	// The answer starts after PadB, with the encrypted VC.
+	vc := make([]byte, len(mseVC))
+	dec.XORKeyStream(vc, mseVC)
+	if err = mseSync(r, vc, mseMaxPad+len(vc)); err != nil {
+		return nil, err
+	}
+	answer := make([]byte, 6)
+	if _, err = io.ReadFull(r, answer); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(answer, answer)
+	selected := binary.BigEndian.Uint32(answer[0:4])
+	padD := int(binary.BigEndian.Uint16(answer[4:6]))
+	if padD > mseMaxPad {
+		return nil, errors.New("PadD is too long")
+	}
+	pad := make([]byte, padD)
+	if _, err = io.ReadFull(r, pad); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(pad, pad)
+	switch {
+	case selected == mseCryptoRC4 && provide&mseCryptoRC4 != 0:
+		return &mseConn{conn, r, enc, dec}, nil
+	case selected == mseCryptoPlaintext && provide&mseCryptoPlaintext != 0:
+		return &mseConn{conn, r, nil, nil}, nil
+	}
+	return nil, errors.New("peer selected an encryption we didn't offer")
+}
+
+// mseAccept does the handshake of the accepting side. first holds the bytes
+// already read from the connection.
+func mseAccept(conn net.Conn, first []byte, policy string, skeys func() []string) (net.Conn, error) {
+	r := bufio.NewReader(io.MultiReader(bytes.NewReader(first), conn))
+	ya := make([]byte, mseKeyLength)
+	if _, err := io.ReadFull(r, ya); err != nil {
+		return nil, err
+	}
+	x, y, err := mseKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	if _, err = conn.Write(append(y, msePad()...)); err != nil {
+		return nil, err
+	}
+	s := mseSecret(x, ya)
+
+	// The request starts after PadA.
+	req1 := mseHash("req1", s)
+	if err = mseSync(r, req1, mseMaxPad+len(req1)); err != nil {
+		return nil, err
+	}
+	req2 := make([]byte, sha1.Size)
+	if _, err = io.ReadFull(r, req2); err != nil {
+		return nil, err
+	}
+	req2 = mseXor(req2, mseHash("req3", s))
+	skey := ""
+	for _, ih := range skeys() {
+		if bytes.Equal(req2, mseHash("req2", ih)) {
+			skey = ih
+			break
+		}
+	}
+	if skey == "" {
+		return nil, errors.New("peer asked for an unknown torrent")
+	}
+	enc := mseCipher("keyB", s, skey)
+	dec := mseCipher("keyA", s, skey)
+
+	request := make([]byte, 14)
+	if _, err = io.ReadFull(r, request); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(request, request)
+	if !bytes.Equal(request[0:8], mseVC) {
+		return nil, errors.New("bad verification constant")
+	}
+	provide := binary.BigEndian.Uint32(request[8:12])
+	padC := int(binary.BigEndian.Uint16(request[12:14]))
+	if padC > mseMaxPad {
+		return nil, errors.New("PadC is too long")
+	}
+	// PadC, then the length of the initial payload.
+	pad := make([]byte, padC+2)
+	if _, err = io.ReadFull(r, pad); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(pad, pad)
+	ia := make([]byte, binary.BigEndian.Uint16(pad[padC:]))
+	if _, err = io.ReadFull(r, ia); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(ia, ia)
+
+	var selected uint32
+	if provide&mseCryptoRC4 != 0 {
+		selected = mseCryptoRC4
+	} else if provide&mseCryptoPlaintext != 0 && policy != encryptionRequired {
+		selected = mseCryptoPlaintext
+	} else {
+		return nil, errors.New("peer offered no encryption we accept")
+	}
+	// VC, crypto_select and empty PadD.
+	answer := make([]byte, 14)
+	binary.BigEndian.PutUint32(answer[8:12], selected)
+	enc.XORKeyStream(answer, answer)
+	if _, err = conn.Write(answer); err != nil {
+		return nil, err
+	}
+
+	c := &mseConn{conn, r, nil, nil}
+	if selected == mseCryptoRC4 {
+		c.enc, c.dec = enc, dec
+	}
+	if len(ia) > 0 {
+		return &replayConn{c, io.MultiReader(bytes.NewReader(ia), c)}, nil
+	}
+	return c, nil
+}
+
+// mseKeyPair makes a private key x and its public key y.
+func mseKeyPair() (x *big.Int, y []byte, err error) {
+	b := make([]byte, 20)
+	if _, err = rand.Read(b); err != nil {
+		return
+	}
+	x = new(big.Int).SetBytes(b)
+	y = mseBytes(new(big.Int).Exp(mseGenerator, x, msePrime))
+	return
+}
+
+func mseSecret(x *big.Int, y []byte) []byte {
+	return mseBytes(new(big.Int).Exp(new(big.Int).SetBytes(y), x, msePrime))
+}
+
+// mseBytes is n in big endian, padded to mseKeyLength.
+func mseBytes(n *big.Int) []byte {
+	b := n.Bytes()
+	return append(make([]byte, mseKeyLength-len(b)), b...)
+}
+
+// msePad makes random padding of random length.
+func msePad() []byte {
+	var n [2]byte
+	rand.Read(n[:])
+	pad := make([]byte, int(binary.BigEndian.Uint16(n[:]))%(mseMaxPad+1))
+	rand.Read(pad)
+	return pad
+}
+
+func mseHash(parts ...interface{}) []byte {
+	h := sha1.New()
+	for _, p := range parts {
+		switch v := p.(type) {
+		case string:
+			io.WriteString(h, v)
+		case []byte:
+			h.Write(v)
+		}
+	}
+	return h.Sum(nil)
+}
+
+func mseXor(a, b []byte) []byte {
+	c := make([]byte, len(a))
+	for i := range a {
+		c[i] = a[i] ^ b[i]
+	}
+	return c
+}
+
+// mseCipher makes the RC4 cipher of one direction. The dialing side
+// encrypts with "keyA", the other side with "keyB".
+func mseCipher(key string, s []byte, skey string) *rc4.Cipher {
+	c, _ := rc4.NewCipher(mseHash(key, s, skey))
+	discard := make([]byte, mseDiscard)
+	c.XORKeyStream(discard, discard)
+	return c
+}
+
+// mseSync reads up to and including pattern, which must show up within the
+// next max bytes.
+func mseSync(r *bufio.Reader, pattern []byte, max int) error {
+	buf := make([]byte, 0, max)
+	for len(buf) < max {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		buf = append(buf, b)
+		if bytes.HasSuffix(buf, pattern) {
+			return nil
+		}
+	}
+	return errors.New("MSE handshake out of sync")
+}
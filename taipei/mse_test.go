@@ -0,0 +1,98 @@
+package taipei
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+// mseHandshake connects a dialing side to an accepting side over loopback,
+// and returns both ends of the established connection.
+func mseHandshake(t *testing.T, skey, dialPolicy, acceptPolicy string, skeys []string) (dialed, accepted net.Conn, dialErr, acceptErr error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		conn, err := l.Accept()
+		if err != nil {
+			acceptErr = err
+			return
+		}
+		accepted, acceptErr = acceptEncryption(conn, acceptPolicy, func() []string { return skeys })
+		if acceptErr != nil {
+			conn.Close()
+		}
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dialPolicy == encryptionDisabled {
+		// Plaintext handshakes start with the header.
+		dialed = conn
+		_, dialErr = conn.Write(kBitTorrentHeader)
+	} else if dialed, dialErr = mseInitiate(conn, skey, dialPolicy); dialErr != nil {
+		conn.Close()
+	}
+	<-done
+	return
+}
+
+func TestMSE(t *testing.T) {
+	skey := "01234567890123456789"
+	for _, policy := range []string{encryptionPreferred, encryptionRequired} {
+		dialed, accepted, err1, err2 := mseHandshake(t, skey, policy, encryptionPreferred, []string{"x", skey})
+		if err1 != nil || err2 != nil {
+			t.Fatalf("Handshake failed: %v, %v", err1, err2)
+		}
+		if !isEncrypted(dialed) || !isEncrypted(accepted) {
+			t.Errorf("%v: connection is not encrypted", policy)
+		}
+		for _, dir := range [][2]net.Conn{{dialed, accepted}, {accepted, dialed}} {
+			msg := []byte("some BitTorrent messages")
+			go dir[0].Write(msg)
+			got := make([]byte, len(msg))
+			if _, err := io.ReadFull(dir[1], got); err != nil || !bytes.Equal(got, msg) {
+				t.Errorf("%v: got %q, wanted %q (%v)", policy, got, msg, err)
+			}
+		}
+		dialed.Close()
+		accepted.Close()
+	}
+}
+
+func TestMSEPolicies(t *testing.T) {
+	skey := "01234567890123456789"
+	// Plaintext handshakes go through, unless encryption is required.
+	dialed, accepted, _, err := mseHandshake(t, skey, encryptionDisabled, encryptionPreferred, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(kBitTorrentHeader))
+	if _, err = io.ReadFull(accepted, got); err != nil || !bytes.Equal(got, kBitTorrentHeader) {
+		t.Errorf("Got %q, wanted the plaintext header (%v)", got, err)
+	}
+	if isEncrypted(accepted) {
+		t.Errorf("Plaintext connection reported as encrypted")
+	}
+	dialed.Close()
+	accepted.Close()
+
+	dialed, _, _, err = mseHandshake(t, skey, encryptionDisabled, encryptionRequired, nil)
+	defer dialed.Close()
+	if err == nil {
+		t.Errorf("Accepted a plaintext connection while encryption is required")
+	}
+
+	if _, _, err1, err2 := mseHandshake(t, skey, encryptionPreferred, encryptionDisabled, []string{skey}); err1 == nil || err2 == nil {
+		t.Errorf("Accepted an encrypted connection while encryption is disabled")
+	}
+	if _, _, err1, err2 := mseHandshake(t, skey, encryptionPreferred, encryptionPreferred, []string{"x"}); err1 == nil || err2 == nil {
+		t.Errorf("Accepted an encrypted connection for an unknown torrent")
+	}
+}
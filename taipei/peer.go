@@ -4,6 +4,8 @@ import (
 	"io"
 	"net"
 	"time"
+
+	"github.com/nictuku/Taipei-Torrent/nettools"
 )
 
 const MAX_OUR_REQUESTS = 2
@@ -30,6 +32,37 @@ type peerState struct {
 	peer_interested bool // peer is interested in this client
 	peer_requests   map[uint64]bool
 	our_requests    map[uint64]time.Time // What we requested, when we requested it
+	connectedAt     time.Time
+	incoming        bool // The peer connected to us.
+	encrypted       bool // The connection is encrypted (MSE).
+
+	// Transfer statistics, for the choker.
+	downloaded     int64 // Bytes of piece data the peer sent us.
+	uploaded       int64 // Bytes of piece data we sent the peer.
+	lastDownloaded int64 // downloaded at the last rechoke.
+	lastUploaded   int64 // uploaded at the last rechoke.
+	downloadRate   float64
+	uploadRate     float64
+	lastPieceTime  time.Time // When the peer last sent us piece data.
+
+	// From the extended handshake (BEP 10)
+	theirExtensions   map[string]int // Extension name to the peer's message id.
+	client            string         // Client name and version.
+	listenPort        int            // Zero if unknown.
+	reqq              int            // Requests the peer queues without dropping.
+	ourIP             net.IP         // Our address, as seen by the peer.
+	metadataSize      int64
+	badMetadata       bool   // Sent pieces of metadata that didn't match the info hash.
+	temporaryBitfield []byte // Bitfield received before we had the metadata.
+
+	// Peer exchange (BEP 11)
+	pexSent         map[string]bool // Peers we told this peer about.
+	lastPexReceived time.Time
+
+	// Rate limits on piece data, usually the session's and the client's.
+	// Nil entries don't limit anything.
+	uploadLimits   []*nettools.RateLimiter
+	downloadLimits []*nettools.RateLimiter
 }
 
 func queueingWriter(in, out chan []byte) {
@@ -69,15 +102,19 @@ func NewPeerState(conn net.Conn) *peerState {
 	writeChan := make(chan []byte)
 	writeChan2 := make(chan []byte)
 	go queueingWriter(writeChan, writeChan2)
+	now := time.Now()
 	return &peerState{writeChan: writeChan, writeChan2: writeChan2, conn: conn,
 		am_choking: true, peer_choking: true,
+		connectedAt: now, lastPieceTime: now,
 		peer_requests: make(map[uint64]bool, MAX_PEER_REQUESTS),
 		our_requests:  make(map[uint64]time.Time, MAX_OUR_REQUESTS)}
 }
 
 func (p *peerState) Close() {
 	p.conn.Close()
-	// No need to close p.writeChan. Further writes to p.conn will just fail.
+	// Lets the writer goroutines exit. Nothing must be sent to the peer
+	// after this.
+	close(p.writeChan)
 }
 
 func (p *peerState) AddRequest(index, begin, length uint32) {
@@ -170,7 +207,7 @@ func bytesToUint32(buf []byte) uint32 {
 
 func readNBOUint32(conn net.Conn) (n uint32, err error) {
 	var buf [4]byte
-	_, err = conn.Read(buf[0:])
+	_, err = io.ReadFull(conn, buf[0:])
 	if err != nil {
 		return
 	}
@@ -178,6 +215,12 @@ func readNBOUint32(conn net.Conn) (n uint32, err error) {
 	return
 }
 
+func waitLimits(limits []*nettools.RateLimiter, n int) {
+	for _, l := range limits {
+		l.Wait(n)
+	}
+}
+
 // This func is designed to be run as a goroutine. It
 // listens for messages on a channel and sends them to a peer.
 
@@ -190,6 +233,9 @@ func (p *peerState) peerWriter(errorChan chan peerMessage, header []byte) {
 	// log.Println("Writing messages")
 	for msg := range p.writeChan2 {
 		// log.Println("Writing", len(msg), conn.RemoteAddr())
+		if len(msg) > 0 && msg[0] == PIECE {
+			waitLimits(p.uploadLimits, len(msg))
+		}
 		err = writeNBOUint32(p.conn, uint32(len(msg)))
 		if err != nil {
 			goto exit
@@ -211,14 +257,14 @@ exit:
 func (p *peerState) peerReader(msgChan chan peerMessage) {
 	// log.Println("Reading header.")
 	var header [68]byte
-	_, err := p.conn.Read(header[0:1])
+	_, err := io.ReadFull(p.conn, header[0:1])
 	if err != nil {
 		goto exit
 	}
 	if header[0] != 19 {
 		goto exit
 	}
-	_, err = p.conn.Read(header[1:20])
+	_, err = io.ReadFull(p.conn, header[1:20])
 	if err != nil {
 		goto exit
 	}
@@ -226,7 +272,7 @@ func (p *peerState) peerReader(msgChan chan peerMessage) {
 		goto exit
 	}
 	// Read rest of header
-	_, err = p.conn.Read(header[20:])
+	_, err = io.ReadFull(p.conn, header[20:])
 	if err != nil {
 		goto exit
 	}
@@ -247,6 +293,11 @@ func (p *peerState) peerReader(msgChan chan peerMessage) {
 		if err != nil {
 			goto exit
 		}
+		// Not reading from the connection for a while makes TCP slow the
+		// peer down.
+		if n > 0 && buf[0] == PIECE {
+			waitLimits(p.downloadLimits, len(buf))
+		}
 		msgChan <- peerMessage{p, buf}
 	}
 
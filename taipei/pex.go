@@ -0,0 +1,213 @@
+package taipei
+
+// Peer exchange.
+//
+// Every minute, peers that support ut_pex are told which peers we connected
+// to and disconnected from since the last message. The peers they tell us
+// about are dialed like the ones from trackers. PEX is never used for private
+// torrents.
+//
+// References:
+// - http://bittorrent.org/beps/bep_0011.html
+// - http://bittorrent.org/beps/bep_0007.html (IPv6 peers)
+
+import (
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/nictuku/Taipei-Torrent/nettools"
+)
+
+const (
+	pexInterval = time.Minute
+	// Messages that come sooner than this after the previous one from the
+	// same peer are ignored.
+	pexMinInterval = 45 * time.Second
+	// Most peers of each address family added or dropped in a message we
+	// send.
+	pexMaxPeers = 50
+	// Most new peers we dial from one message.
+	pexMaxAccepted = 50
+)
+
+// Flags of added peers.
+const (
+	pexPrefersEncryption = 0x01
+	pexSeed              = 0x02
+	pexReachable         = 0x10
+)
+
+type pexMessage struct {
+	Added    string "added"
+	AddedF   string "added.f"
+	Dropped  string "dropped"
+	Added6   string "added6"
+	Added6F  string "added6.f"
+	Dropped6 string "dropped6"
+}
+
+// utPex is the ut_pex extension handler.
+type utPex struct{}
+
+func (utPex) handshake(t *TorrentSession, p *peerState) {
+}
+
+func (utPex) message(t *TorrentSession, p *peerState, payload []byte) (err error) {
+	if !t.pexEnabled() {
+		return
+	}
+	now := time.Now()
+	if now.Sub(p.lastPexReceived) < pexMinInterval {
+		return
+	}
+	p.lastPexReceived = now
+	var msg pexMessage
+	if _, err = unmarshalPeerData(payload, &msg); err != nil {
+		return
+	}
+	n := 0
+	added := parseCompactPeers(msg.Added, 6, pexMaxAccepted)
+	added = append(added, parseCompactPeers(msg.Added6, 18, pexMaxAccepted-len(added))...)
+	for _, peer := range added {
+		if len(t.peers) >= MAX_NUM_PEERS {
+			break
+		}
+		if t.dialNewPeer(peer) {
+			n++
+		}
+	}
+	if n > 0 {
+		log.Println("Contacting", n, "new peers (thanks PEX!)")
+	}
+	return
+}
+
+func (t *TorrentSession) pexEnabled() bool {
+	return t.m.Info.Private != 1
+}
+
+// parseCompactPeers decodes at most max peers from the compact format, where
+// each takes size bytes: 6 for IPv4 and 18 for IPv6.
+func parseCompactPeers(compact string, size, max int) (peers []string) {
+	for i := 0; i+size <= len(compact) && len(peers) < max; i += size {
+		peers = append(peers, nettools.BinaryToDottedPort(compact[i:i+size]))
+	}
+	return
+}
+
+// pexAddress is the address other peers can connect to the peer at, or "" if
+// we don't know it.
+func pexAddress(p *peerState) string {
+	host, _, err := net.SplitHostPort(p.address)
+	if err != nil {
+		return ""
+	}
+	if p.listenPort != 0 {
+		return net.JoinHostPort(host, strconv.Itoa(p.listenPort))
+	}
+	if p.incoming {
+		// The remote port of incoming connections isn't a listen port.
+		return ""
+	}
+	return p.address
+}
+
+func pexFlags(p *peerState) (flags byte) {
+	if !p.incoming {
+		flags |= pexReachable
+	}
+	if isSeed(p) {
+		flags |= pexSeed
+	}
+	if p.encrypted {
+		flags |= pexPrefersEncryption
+	}
+	return
+}
+
+// sendPex tells the peers that support ut_pex about our other peers.
+func (t *TorrentSession) sendPex() {
+	if !t.pexEnabled() {
+		return
+	}
+	current := make(map[string]byte)
+	for _, p := range t.peers {
+		if addr := pexAddress(p); addr != "" {
+			current[addr] = pexFlags(p)
+		}
+	}
+	for _, p := range t.peers {
+		if !p.supportsExtension("ut_pex") {
+			continue
+		}
+		if p.pexSent == nil {
+			p.pexSent = make(map[string]bool)
+		}
+		msg := pexDiff(current, p.pexSent, pexAddress(p))
+		if msg != (pexMessage{}) {
+			t.sendExtensionMessage(p, "ut_pex", map[string]interface{}{
+				"added":    msg.Added,
+				"added.f":  msg.AddedF,
+				"dropped":  msg.Dropped,
+				"added6":   msg.Added6,
+				"added6.f": msg.Added6F,
+				"dropped6": msg.Dropped6,
+			}, nil)
+		}
+	}
+}
+
+// pexDiff makes the message telling a peer about the changes between what we
+// told it before, sent, and the current peers. sent is updated. The peer's
+// own address, self, is left out.
+func pexDiff(current map[string]byte, sent map[string]bool, self string) (msg pexMessage) {
+	// Indexed by the length of the compact addresses.
+	added := map[int][]byte{}
+	flags := map[int][]byte{}
+	dropped := map[int][]byte{}
+	for addr, f := range current {
+		if sent[addr] || addr == self {
+			continue
+		}
+		compact := compactAddr(addr)
+		if compact == "" || len(added[len(compact)]) >= len(compact)*pexMaxPeers {
+			continue
+		}
+		added[len(compact)] = append(added[len(compact)], compact...)
+		flags[len(compact)] = append(flags[len(compact)], f)
+		sent[addr] = true
+	}
+	for addr := range sent {
+		if _, ok := current[addr]; ok {
+			continue
+		}
+		compact := compactAddr(addr)
+		if len(dropped[len(compact)]) >= len(compact)*pexMaxPeers {
+			continue
+		}
+		dropped[len(compact)] = append(dropped[len(compact)], compact...)
+		delete(sent, addr)
+	}
+	return pexMessage{string(added[6]), string(flags[6]), string(dropped[6]),
+		string(added[18]), string(flags[18]), string(dropped[18])}
+}
+
+// compactAddr returns the compact form of a host:port address, 6 bytes long
+// for IPv4 and 18 for IPv6, or "".
+func compactAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return ""
+	}
+	ip := net.ParseIP(host)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	n, err := strconv.Atoi(port)
+	if ip == nil || err != nil || n <= 0 || n > 65535 {
+		return ""
+	}
+	return string(append(ip, byte(n>>8), byte(n)))
+}
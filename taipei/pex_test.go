@@ -0,0 +1,64 @@
+package taipei
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPexDiff(t *testing.T) {
+	sent := make(map[string]bool)
+	current := map[string]byte{
+		"1.2.3.4:6881":  pexReachable,
+		"5.6.7.8:1":     pexSeed,
+		"[::1]:6881":    pexReachable,
+		"9.9.9.9:51413": 0, // The peer we send to.
+	}
+	msg := pexDiff(current, sent, "9.9.9.9:51413")
+	added := parseCompactPeers(msg.Added, 6, 10)
+	if len(added) != 2 || len(msg.AddedF) != 2 || msg.Dropped != "" {
+		t.Fatalf("Unexpected first message %q", msg)
+	}
+	for i, addr := range added {
+		if current[addr] != msg.AddedF[i] {
+			t.Errorf("Peer %v: got flags %x, wanted %x", addr, msg.AddedF[i], current[addr])
+		}
+	}
+	if added6 := parseCompactPeers(msg.Added6, 18, 10); !reflect.DeepEqual(added6, []string{"[::1]:6881"}) || msg.Added6F != string([]byte{pexReachable}) {
+		t.Errorf("Got added6 %v, flags %q", added6, msg.Added6F)
+	}
+
+	// Nothing changed.
+	if msg = pexDiff(current, sent, "9.9.9.9:51413"); msg != (pexMessage{}) {
+		t.Errorf("Unexpected message %q", msg)
+	}
+
+	delete(current, "5.6.7.8:1")
+	current["10.0.0.1:80"] = 0
+	msg = pexDiff(current, sent, "9.9.9.9:51413")
+	if added := parseCompactPeers(msg.Added, 6, 10); !reflect.DeepEqual(added, []string{"10.0.0.1:80"}) {
+		t.Errorf("Got added %v", added)
+	}
+	if dropped := parseCompactPeers(msg.Dropped, 6, 10); !reflect.DeepEqual(dropped, []string{"5.6.7.8:1"}) {
+		t.Errorf("Got dropped %v", dropped)
+	}
+
+	delete(current, "[::1]:6881")
+	msg = pexDiff(current, sent, "9.9.9.9:51413")
+	if dropped6 := parseCompactPeers(msg.Dropped6, 18, 10); !reflect.DeepEqual(dropped6, []string{"[::1]:6881"}) || msg.Dropped != "" {
+		t.Errorf("Got dropped6 %v, dropped %q", dropped6, msg.Dropped)
+	}
+}
+
+func TestParseCompactPeers(t *testing.T) {
+	compact := "\x01\x02\x03\x04\x1a\xe1\x05\x06\x07\x08\x00\x01\x09"
+	if got := parseCompactPeers(compact, 6, 10); !reflect.DeepEqual(got, []string{"1.2.3.4:6881", "5.6.7.8:1"}) {
+		t.Errorf("Got %v", got)
+	}
+	if got := parseCompactPeers(compact, 6, 1); len(got) != 1 {
+		t.Errorf("Got %v, wanted only one peer", got)
+	}
+	compact6 := "\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x1a\xe1"
+	if got := parseCompactPeers(compact6, 18, 10); !reflect.DeepEqual(got, []string{"[2001:db8::1]:6881"}) {
+		t.Errorf("Got %v", got)
+	}
+}
@@ -0,0 +1,75 @@
+package taipei
+
+// Rarest-first piece picking.
+//
+// We keep count of how many connected peers have each piece, and download
+// the pieces that fewest peers have first, so that they don't disappear from
+// the swarm when those peers leave. The first few pieces are picked at random
+// instead: getting any complete piece quickly matters more then, so we have
+// something to trade. Either way, pieces of higher priority files come first,
+// and those of skipped files are never picked.
+
+import (
+	"math/rand"
+)
+
+// Pick pieces at random until we have this many.
+const randomPieceCount = 4
+
+func (t *TorrentSession) addAvailability(have *Bitset) {
+	if have == nil || t.pieceAvailability == nil {
+		return
+	}
+	for i := have.FindNextSet(0); i >= 0; i = have.FindNextSet(i + 1) {
+		t.pieceAvailability[i]++
+	}
+}
+
+func (t *TorrentSession) removeAvailability(have *Bitset) {
+	if have == nil || t.pieceAvailability == nil {
+		return
+	}
+	for i := have.FindNextSet(0); i >= 0; i = have.FindNextSet(i + 1) {
+		t.pieceAvailability[i]--
+	}
+}
+
+// ChoosePiece picks the next piece to download from the peer, or returns -1
+// if the peer has nothing we need that isn't already being downloaded.
+// Pieces that streams wait for come first.
+func (t *TorrentSession) ChoosePiece(p *peerState) (piece int) {
+	if piece = t.chooseStreamPiece(p); piece >= 0 {
+		return
+	}
+	random := t.goodPieces < randomPieceCount
+	piece = -1
+	maxPriority := PrioritySkip
+	minAvailability := 0
+	ties := 0
+	for i := 0; i < t.totalPieces; i++ {
+		if !t.needPiece(i) || !p.have.IsSet(i) {
+			continue
+		}
+		if _, ok := t.activePieces[i]; ok || t.verifying[i] {
+			continue
+		}
+		a := t.pieceAvailability[i]
+		if random {
+			a = 0
+		}
+		priority := t.piecePriority(i)
+		switch {
+		case piece == -1 || priority > maxPriority || priority == maxPriority && a < minAvailability:
+			piece, maxPriority, minAvailability, ties = i, priority, a, 1
+		case priority < maxPriority:
+		case a == minAvailability:
+			// Reservoir sampling, so every tied piece has the same
+			// chance of being picked.
+			ties++
+			if rand.Intn(ties) == 0 {
+				piece = i
+			}
+		}
+	}
+	return
+}
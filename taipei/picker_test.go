@@ -0,0 +1,102 @@
+package taipei
+
+import (
+	"testing"
+)
+
+func newPickerSession(n int) *TorrentSession {
+	return &TorrentSession{
+		totalPieces:       n,
+		pieceSet:          NewBitset(n),
+		activePieces:      make(map[int]*ActivePiece),
+		pieceAvailability: make([]int, n),
+	}
+}
+
+func TestChoosePieceRarestFirst(t *testing.T) {
+	ts := newPickerSession(6)
+	ts.goodPieces = randomPieceCount
+
+	a := &peerState{have: NewBitset(6)}
+	b := &peerState{have: NewBitset(6)}
+	c := &peerState{have: NewBitset(6)}
+	for i := 0; i < 6; i++ {
+		a.have.Set(i)
+	}
+	b.have.Set(1)
+	b.have.Set(2)
+	b.have.Set(3)
+	c.have.Set(1)
+	c.have.Set(3)
+	for _, p := range []*peerState{a, b, c} {
+		ts.addAvailability(p.have)
+	}
+	// Availability is now [1 3 2 3 1 1]. We have piece 0 and piece 4 is
+	// being downloaded, so 5 is the rarest piece left.
+	ts.pieceSet.Set(0)
+	ts.activePieces[4] = &ActivePiece{}
+	if piece := ts.ChoosePiece(a); piece != 5 {
+		t.Errorf("Wanted piece 5, got %d", piece)
+	}
+	if piece := ts.ChoosePiece(b); piece != 2 {
+		t.Errorf("Wanted piece 2, got %d", piece)
+	}
+	// Pieces 1 and 3 are tied.
+	seen := make(map[int]bool)
+	for i := 0; i < 100; i++ {
+		seen[ts.ChoosePiece(c)] = true
+	}
+	if len(seen) != 2 || !seen[1] || !seen[3] {
+		t.Errorf("Wanted pieces 1 and 3 to be picked, got %v", seen)
+	}
+
+	// Once a peer leaves, its pieces become rarer.
+	ts.removeAvailability(a.have)
+	ts.pieceSet.Set(2)
+	if ts.pieceAvailability[5] != 0 {
+		t.Errorf("Wanted no availability for piece 5, got %d", ts.pieceAvailability[5])
+	}
+	if piece := ts.ChoosePiece(&peerState{have: NewBitset(6)}); piece != -1 {
+		t.Errorf("Peer with nothing should give no piece, got %d", piece)
+	}
+}
+
+func TestChoosePieceRandomFirst(t *testing.T) {
+	ts := newPickerSession(4)
+	p := &peerState{have: NewBitset(4)}
+	for i := 0; i < 4; i++ {
+		p.have.Set(i)
+	}
+	ts.pieceAvailability = []int{1, 5, 5, 5}
+	seen := make(map[int]bool)
+	for i := 0; i < 200; i++ {
+		seen[ts.ChoosePiece(p)] = true
+	}
+	if len(seen) != 4 {
+		t.Errorf("Wanted the first pieces picked at random, got %v", seen)
+	}
+}
+
+func TestChoosePiecePriority(t *testing.T) {
+	ts := newPickerSession(3)
+	ts.goodPieces = randomPieceCount
+	ts.piecePriorities = []Priority{PrioritySkip, PriorityLow, PriorityHigh}
+	p := &peerState{have: NewBitset(3)}
+	for i := 0; i < 3; i++ {
+		p.have.Set(i)
+	}
+	// Piece 2 is the most common, but of a higher priority.
+	ts.addAvailability(p.have)
+	ts.pieceAvailability[2]++
+	if piece := ts.ChoosePiece(p); piece != 2 {
+		t.Errorf("Wanted piece 2, got %d", piece)
+	}
+	ts.pieceSet.Set(2)
+	if piece := ts.ChoosePiece(p); piece != 1 {
+		t.Errorf("Wanted piece 1, got %d", piece)
+	}
+	ts.pieceSet.Set(1)
+	if piece := ts.ChoosePiece(p); piece != -1 {
+		t.Errorf("Got piece %d of a skipped file", piece)
+	}
+}
@@ -4,10 +4,41 @@ package taipei
 import (
 	"crypto/sha1"
 	"errors"
+	"flag"
+	"log"
 	"runtime"
+	"sync"
+	"time"
+
+	"github.com/nictuku/Taipei-Torrent/nettools"
 )
 
-func checkPieces(fs FileStore, totalLength int64, m *MetaInfo) (good, bad int, goodBits *Bitset, err error) {
+const checkProgressInterval = 5 * time.Second
+
+var checkRate int64
+
+// Throttles the reads of checks, so they don't starve other disk users. It is
+// shared by all the torrents, and set from -checkRate by the first check.
+var checkLimit = nettools.NewRateLimiter(0)
+var checkLimitOnce sync.Once
+
+func init() {
+	flag.Int64Var(&checkRate, "checkRate", 0, "How fast existing files are read to check them, in MiB/s. "+
+		"0 means no limit.")
+}
+
+// CheckProgress is how far the check of the pieces we already have is.
+type CheckProgress struct {
+	Checked int           `json:"checked"`
+	Pieces  int           `json:"pieces"`
+	Rate    float64       `json:"rate"` // Bytes read per second.
+	Left    time.Duration `json:"left"` // Estimated; in nanoseconds in JSON.
+}
+
+// checkPieces hashes all the pieces, and compares them to the torrent.
+// report, if not nil, is told how the check goes.
+func checkPieces(fs FileStore, totalLength int64, m *MetaInfo,
+	report func(CheckProgress)) (good, bad int, goodBits *Bitset, err error) {
 	pieceLength := m.Info.PieceLength
 	numPieces := int((totalLength + pieceLength - 1) / pieceLength)
 	goodBits = NewBitset(int(numPieces))
@@ -16,7 +47,8 @@ func checkPieces(fs FileStore, totalLength int64, m *MetaInfo) (good, bad int, g
 		err = errors.New("Incorrect Info.Pieces length")
 		return
 	}
-	currentSums, err := computeSums(fs, totalLength, m.Info.PieceLength)
+	currentSums, err := computeSumsOf(fs, totalLength, m.Info.PieceLength, allPieces(totalLength, pieceLength),
+		report)
 	if err != nil {
 		return
 	}
@@ -45,12 +77,30 @@ func checkEqual(ref string, current []byte) bool {
 type chunk struct {
 	i    int64
 	data []byte
+	size int // Size of the piece, once data holds its hash.
 }
 
 // computeSums reads the file content and computes the SHA1 hash for each
 // piece. Spawns parallel goroutines to compute the hashes, since each
 // computation takes ~30ms.
 func computeSums(fs FileStore, totalLength int64, pieceLength int64) (sums []byte, err error) {
+	return computeSumsOf(fs, totalLength, pieceLength, allPieces(totalLength, pieceLength), nil)
+}
+
+func allPieces(totalLength int64, pieceLength int64) []int {
+	pieces := make([]int, (totalLength+pieceLength-1)/pieceLength)
+	for i := range pieces {
+		pieces[i] = i
+	}
+	return pieces
+}
+
+// computeSumsOf is like computeSums, for some of the pieces only. The hashes
+// are returned in the order of pieces. Progress is logged regularly, and
+// given to report, if it is not nil, after each piece.
+func computeSumsOf(fs FileStore, totalLength int64, pieceLength int64, pieces []int,
+	report func(CheckProgress)) (sums []byte, err error) {
+	checkLimitOnce.Do(func() { checkLimit.SetRate(checkRate * 1024 * 1024) })
 	// Calculate the SHA1 hash for each piece in parallel goroutines.
 	hashes := make(chan chunk)
 	results := make(chan chunk, 3)
@@ -61,36 +111,92 @@ func computeSums(fs FileStore, totalLength int64, pieceLength int64) (sums []byt
 	// Read file content and send to "pieces", keeping order.
 	numPieces := (totalLength + pieceLength - 1) / pieceLength
 	go func() {
-		for i := int64(0); i < numPieces; i++ {
+		for i, p := range pieces {
 			piece := make([]byte, pieceLength, pieceLength)
-			if i == numPieces-1 {
-				piece = piece[0 : totalLength-i*pieceLength]
+			if int64(p) == numPieces-1 {
+				piece = piece[0 : totalLength-int64(p)*pieceLength]
 			}
+			checkLimit.Wait(len(piece))
 			// Ignore errors.
-			fs.ReadAt(piece, i*pieceLength)
-			hashes <- chunk{i: i, data: piece}
+			fs.ReadAt(piece, int64(p)*pieceLength)
+			hashes <- chunk{i: int64(i), data: piece, size: len(piece)}
 		}
 		close(hashes)
 	}()
 
 	// Merge back the results.
-	sums = make([]byte, sha1.Size*numPieces)
-	for i := int64(0); i < numPieces; i++ {
+	progress := newCheckProgress(len(pieces), report)
+	sums = make([]byte, sha1.Size*len(pieces))
+	for _ = range pieces {
 		h := <-results
 		copy(sums[h.i*sha1.Size:], h.data)
+		progress.add(h.size)
 	}
+	progress.finish()
 	return
 }
 
+// checkProgress logs how a long check is going, and tells onProgress.
+type checkProgress struct {
+	total, done int
+	bytes       int64
+	start       time.Time
+	lastReport  time.Time
+	onProgress  func(CheckProgress)
+}
+
+func newCheckProgress(total int, onProgress func(CheckProgress)) *checkProgress {
+	now := time.Now()
+	return &checkProgress{total: total, start: now, lastReport: now, onProgress: onProgress}
+}
+
+func (c *checkProgress) add(bytes int) {
+	c.done++
+	c.bytes += int64(bytes)
+	now := time.Now()
+	if c.onProgress != nil {
+		c.onProgress(c.progress(now))
+	}
+	if now.Sub(c.lastReport) >= checkProgressInterval {
+		c.lastReport = now
+		c.report(now)
+	}
+}
+
+func (c *checkProgress) finish() {
+	if c.lastReport != c.start {
+		// Only long checks get a final report.
+		c.report(time.Now())
+	}
+}
+
+func (c *checkProgress) progress(now time.Time) (p CheckProgress) {
+	p = CheckProgress{Checked: c.done, Pieces: c.total}
+	elapsed := now.Sub(c.start)
+	if elapsed > 0 {
+		p.Rate = float64(c.bytes) / elapsed.Seconds()
+	}
+	if c.done > 0 {
+		p.Left = elapsed * time.Duration(c.total-c.done) / time.Duration(c.done)
+	}
+	return
+}
+
+func (c *checkProgress) report(now time.Time) {
+	p := c.progress(now)
+	log.Printf("Checked %d of %d pieces (%.1f MiB/s, %v left)", p.Checked, p.Pieces,
+		p.Rate/(1024*1024), p.Left-p.Left%time.Second)
+}
+
 func hashPiece(h chan chunk, result chan chunk) {
 	hasher := sha1.New()
 	for piece := range h {
 		hasher.Reset()
 		_, err := hasher.Write(piece.data)
 		if err != nil {
-			result <- chunk{piece.i, nil}
+			result <- chunk{piece.i, nil, len(piece.data)}
 		} else {
-			result <- chunk{piece.i, hasher.Sum(nil)}
+			result <- chunk{piece.i, hasher.Sum(nil), len(piece.data)}
 		}
 	}
 }
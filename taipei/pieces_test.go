@@ -30,3 +30,36 @@ func TestComputeSums(t *testing.T) {
 		}
 	}
 }
+
+func TestComputeSumsOf(t *testing.T) {
+	pieceLen := int64(25)
+	for _, testFile := range tests {
+		fs, err := mkFileStore(testFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		all, err := computeSums(fs, testFile.fileLen, pieceLen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Out of order, and including the short last piece.
+		pieces := []int{40, 3, 0, 17}
+		var progress []CheckProgress
+		sums, err := computeSumsOf(fs, testFile.fileLen, pieceLen, pieces, func(p CheckProgress) {
+			progress = append(progress, p)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(progress) != len(pieces) || progress[3].Checked != 4 || progress[3].Pieces != 4 {
+			t.Errorf("Got progress %+v", progress)
+		}
+		for i, p := range pieces {
+			got := sums[i*sha1.Size : (i+1)*sha1.Size]
+			want := all[p*sha1.Size : (p+1)*sha1.Size]
+			if string(got) != string(want) {
+				t.Errorf("Piece %d: got hash %X, wanted %X", p, got, want)
+			}
+		}
+	}
+}
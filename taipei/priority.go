@@ -0,0 +1,247 @@
+package taipei
+
+// File priorities.
+//
+// Each file of a torrent has a priority. Skipped files are not downloaded:
+// only the pieces they share with other files are, and the parts of those
+// pieces that belong to skipped files are kept in a parts file instead. The
+// pieces of high priority files are picked before those of normal and low
+// ones. Priorities are given with -filePriorities, and each session can
+// change them with SetFilePriorities while it runs. A skipped file gets a file
+// of its own once a piece we want needs more of it than the parts file keeps.
+
+import (
+	"errors"
+	"flag"
+	"path"
+	"strings"
+)
+
+type Priority int
+
+const (
+	PrioritySkip Priority = iota
+	PriorityLow
+	PriorityNormal
+	PriorityHigh
+)
+
+var priorityNames = []string{"skip", "low", "normal", "high"}
+
+func (p Priority) String() string {
+	if p < 0 || int(p) >= len(priorityNames) {
+		return "unknown"
+	}
+	return priorityNames[p]
+}
+
+func parsePriority(s string) (p Priority, err error) {
+	for i, name := range priorityNames {
+		if s == name {
+			return Priority(i), nil
+		}
+	}
+	return 0, errors.New("unknown priority " + s)
+}
+
+var filePriorities string
+
+func init() {
+	flag.StringVar(&filePriorities, "filePriorities", "", "Priorities of the files of the torrents, as a "+
+		"comma-separated list of pattern=priority rules. The priority is skip, low, normal or high. A pattern "+
+		"matches the path of a file in the torrent, or of a directory it is in, like path.Match. The last "+
+		"matching rule wins; files no rule matches are normal. For example: *=skip,linux-amd64=normal")
+}
+
+type priorityRule struct {
+	pattern  string
+	priority Priority
+}
+
+// parsePriorityRules parses the rules of -filePriorities.
+func parsePriorityRules(spec string) (rules []priorityRule, err error) {
+	if spec == "" {
+		return
+	}
+	for _, r := range strings.Split(spec, ",") {
+		i := strings.LastIndex(r, "=")
+		if i < 0 {
+			return nil, errors.New("file priority rule without a priority: " + r)
+		}
+		var p Priority
+		if p, err = parsePriority(r[i+1:]); err != nil {
+			return nil, err
+		}
+		if _, err = path.Match(r[:i], ""); err != nil {
+			return nil, errors.New("bad file priority pattern: " + r[:i])
+		}
+		rules = append(rules, priorityRule{r[:i], p})
+	}
+	return
+}
+
+// priorityOf returns the priority the rules give to the file at name, a
+// slash separated path in the torrent.
+func priorityOf(rules []priorityRule, name string) Priority {
+	p := PriorityNormal
+	for _, r := range rules {
+		for dir := name; dir != "." && dir != "/"; dir = path.Dir(dir) {
+			if ok, _ := path.Match(r.pattern, dir); ok {
+				p = r.priority
+				break
+			}
+		}
+	}
+	return p
+}
+
+// fileNames returns the paths of the files of a torrent, like priorityOf
+// wants them.
+func fileNames(info *InfoDict) (names []string) {
+	if len(info.Files) == 0 {
+		return []string{info.Name}
+	}
+	for _, f := range info.Files {
+		names = append(names, strings.Join(f.Path, "/"))
+	}
+	return
+}
+
+func fileLengths(info *InfoDict) (lengths []int64) {
+	if len(info.Files) == 0 {
+		return []int64{info.Length}
+	}
+	for _, f := range info.Files {
+		lengths = append(lengths, f.Length)
+	}
+	return
+}
+
+// piecePriorities returns the priority of each piece, the highest of the
+// files it holds data of, and how many of its bytes belong to files that
+// aren't skipped. priorities is nil if every file is normal.
+func piecePriorities(lengths []int64, priorities []Priority, pieceLength int64) (pp []Priority, wanted []int64) {
+	var total int64
+	for _, l := range lengths {
+		total += l
+	}
+	numPieces := (total + pieceLength - 1) / pieceLength
+	pp = make([]Priority, numPieces)
+	wanted = make([]int64, numPieces)
+	var start int64
+	for i, l := range lengths {
+		end := start + l
+		p := PriorityNormal
+		if priorities != nil {
+			p = priorities[i]
+		}
+		if l == 0 {
+			// Empty files have no data in any piece.
+			continue
+		}
+		for piece := start / pieceLength; piece*pieceLength < end; piece++ {
+			if p > pp[piece] {
+				pp[piece] = p
+			}
+			if p != PrioritySkip {
+				from, to := piece*pieceLength, (piece+1)*pieceLength
+				if from < start {
+					from = start
+				}
+				if to > end {
+					to = end
+				}
+				wanted[piece] += to - from
+			}
+		}
+		start = end
+	}
+	return
+}
+
+// setPriorities gives the files their priority from the rules. It must be
+// called before the files are opened.
+func (t *TorrentSession) setPriorities() {
+	names := fileNames(&t.m.Info)
+	t.filePriorities = make([]Priority, len(names))
+	for i, name := range names {
+		t.filePriorities[i] = priorityOf(t.priorityRules, name)
+	}
+	t.piecePriorities, t.wantedLengths = piecePriorities(fileLengths(&t.m.Info), t.filePriorities,
+		t.m.Info.PieceLength)
+}
+
+// SetFilePriorities changes the priorities of the files of the torrent, given
+// in the order of its info dictionary. It fails until we have the info
+// dictionary of a magnet link.
+func (t *TorrentSession) SetFilePriorities(priorities []Priority) (err error) {
+	if !t.call(func() { err = t.setFilePriorities(priorities) }) {
+		return errSessionDone
+	}
+	return
+}
+
+func (t *TorrentSession) setFilePriorities(priorities []Priority) error {
+	if !t.si.HaveTorrent {
+		return errors.New("the files of the torrent aren't known yet")
+	}
+	names := fileNames(&t.m.Info)
+	if len(priorities) != len(names) {
+		return errors.New("the torrent has a different number of files")
+	}
+	for _, p := range priorities {
+		if p < PrioritySkip || p > PriorityHigh {
+			return errors.New("unknown priority " + p.String())
+		}
+	}
+	pp, wanted := piecePriorities(fileLengths(&t.m.Info), priorities, t.m.Info.PieceLength)
+	if fs, ok := t.fileStore.(*fileStore); ok {
+		for i := range fs.files {
+			if !fs.missesParts(i, pp, t.m.Info.PieceLength) {
+				continue
+			}
+			if err := fs.unskip(i, names[i]); err != nil {
+				return err
+			}
+		}
+	}
+	wasComplete := t.isComplete()
+	t.filePriorities = append([]Priority(nil), priorities...)
+	t.piecePriorities, t.wantedLengths = pp, wanted
+	t.si.Left, t.missingPieces = 0, 0
+	for i := 0; i < t.totalPieces; i++ {
+		if t.needPiece(i) {
+			t.si.Left += t.wantedLengths[i]
+			t.missingPieces++
+		}
+	}
+	if !wasComplete && t.isComplete() {
+		t.startSeeding()
+	}
+	for _, p := range t.peers {
+		if p.have != nil {
+			t.checkInteresting(p)
+		}
+	}
+	return nil
+}
+
+// wantedSize is the size of the data of the files we don't skip.
+func (t *TorrentSession) wantedSize() (size int64) {
+	for _, l := range t.wantedLengths {
+		size += l
+	}
+	return
+}
+
+func (t *TorrentSession) piecePriority(piece int) Priority {
+	if t.piecePriorities == nil {
+		return PriorityNormal
+	}
+	return t.piecePriorities[piece]
+}
+
+// needPiece tells if we want the piece and don't have it yet.
+func (t *TorrentSession) needPiece(piece int) bool {
+	return !t.pieceSet.IsSet(piece) && t.piecePriority(piece) != PrioritySkip
+}
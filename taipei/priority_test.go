@@ -0,0 +1,118 @@
+package taipei
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPriorityRules(t *testing.T) {
+	rules, err := parsePriorityRules("*=skip,linux-amd64=normal,*/*.debug=low,linux-amd64/tools/big=high")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]Priority{
+		"README":                  PrioritySkip,
+		"darwin/app":              PrioritySkip,
+		"linux-amd64/app":         PriorityNormal,
+		"linux-amd64/app.debug":   PriorityLow,
+		"linux-amd64/tools/big/x": PriorityHigh,
+	} {
+		if got := priorityOf(rules, name); got != want {
+			t.Errorf("%v: got %v, wanted %v", name, got, want)
+		}
+	}
+	if got := priorityOf(nil, "anything"); got != PriorityNormal {
+		t.Errorf("Got %v without rules, wanted normal", got)
+	}
+	for _, bad := range []string{"a", "a=never", "[=skip"} {
+		if _, err = parsePriorityRules(bad); err == nil {
+			t.Errorf("Expected an error for %q", bad)
+		}
+	}
+}
+
+func TestPiecePriorities(t *testing.T) {
+	// Pieces of 10 bytes: [a a a a a a b b b b] [b b b b c c c c c c] [c c c].
+	lengths := []int64{6, 0, 8, 9}
+	priorities := []Priority{PriorityHigh, PriorityHigh, PrioritySkip, PriorityLow}
+	pp, wanted := piecePriorities(lengths, priorities, 10)
+	if want := []Priority{PriorityHigh, PriorityLow, PriorityLow}; !reflect.DeepEqual(pp, want) {
+		t.Errorf("Got priorities %v, wanted %v", pp, want)
+	}
+	if want := []int64{6, 6, 3}; !reflect.DeepEqual(wanted, want) {
+		t.Errorf("Got wanted lengths %v, wanted %v", wanted, want)
+	}
+}
+
+func TestSetFilePriorities(t *testing.T) {
+	dir, err := ioutil.TempDir("", "taipei-priority")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer useFileDir(dir)()
+	// Pieces of 10 bytes: [a a a a a a b b b b] [b b b b b b b b b b] [c c c c c c c c c c].
+	info := InfoDict{PieceLength: 10, Files: []FileDict{
+		{Length: 6, Path: []string{"a"}},
+		{Length: 14, Path: []string{"b"}},
+		{Length: 10, Path: []string{"c"}}}}
+	skipB := []Priority{PriorityNormal, PrioritySkip, PriorityNormal}
+	fs, _, err := newFileStore(&info, dir, skipB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	// We have piece 0, the start of b in the parts file.
+	data := []byte("0123456789")
+	if _, err = fs.WriteAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	ts, stop := newTestSession(info, fs, 0)
+	defer stop()
+
+	check := func(left int64, missing int, state string) {
+		s, err := ts.Status()
+		if err != nil || ts.si.Left != left || ts.missingPieces != missing || s.State != state {
+			t.Errorf("Got %d bytes and %d pieces left, state %v, wanted %d, %d, %v, err %v",
+				ts.si.Left, ts.missingPieces, s.State, left, missing, state, err)
+		}
+	}
+	if err = ts.SetFilePriorities(skipB); err != nil {
+		t.Fatal(err)
+	}
+	check(10, 1, "downloading")
+	if _, err = os.Stat(filepath.Join(dir, "b")); !os.IsNotExist(err) {
+		t.Errorf("Skipped file b exists: %v", err)
+	}
+
+	// Piece 1 needs all of b.
+	if err = ts.SetFilePriorities([]Priority{PrioritySkip, PriorityHigh, PrioritySkip}); err != nil {
+		t.Fatal(err)
+	}
+	check(10, 1, "downloading")
+	if fs.files[1].skipped {
+		t.Fatal("File b is still skipped")
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "b"))
+	if err != nil || len(b) != 14 || !bytes.Equal(b[:4], data[6:]) {
+		t.Errorf("Got %q for b, err %v", b, err)
+	}
+	got := make([]byte, 10)
+	if _, err = fs.ReadAt(got, 0); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("Got %q for piece 0, err %v", got, err)
+	}
+
+	// Only what we have is left.
+	if err = ts.SetFilePriorities([]Priority{PriorityNormal, PrioritySkip, PrioritySkip}); err != nil {
+		t.Fatal(err)
+	}
+	check(0, 0, "finished")
+
+	if err = ts.SetFilePriorities([]Priority{PriorityNormal}); err == nil {
+		t.Error("Expected an error for too few priorities")
+	}
+}
@@ -0,0 +1,290 @@
+package taipei
+
+// Fast resume.
+//
+// The pieces we have are saved regularly in a resume file, along with the
+// size and modification time of each file of the torrent. On startup, the
+// pieces of the files that still match are trusted, and only the pieces of
+// the files that changed are hashed again.
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const resumeSaveInterval = time.Minute
+
+var resumeDir string
+
+func init() {
+	dir := ""
+	if home := os.Getenv("HOME"); home != "" {
+		dir = filepath.Join(home, ".taipeitorrent", "resume")
+	}
+	flag.StringVar(&resumeDir, "resumeDir", dir, "Directory where the pieces we have are saved, "+
+		"so they don't have to be checked again on restart. Empty disables fast resume.")
+}
+
+type resumeFile struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+}
+
+type resumeData struct {
+	InfoHash    string // Hex encoded.
+	PieceLength int64
+	Pieces      []byte // Bitfield of the pieces we have.
+	Files       []resumeFile
+}
+
+// statFiles returns the state of the files of the store, as saved in the
+// resume file.
+func (f *fileStore) statFiles() (files []resumeFile, err error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	files = make([]resumeFile, len(f.files))
+	for i, fe := range f.files {
+		if fe.skipped && fe.fd == nil {
+			// Nothing of it is kept.
+			files[i] = resumeFile{Size: fe.length}
+			continue
+		}
+		if fe.fd == nil {
+			return nil, errors.New("file store is closed")
+		}
+		var st os.FileInfo
+		if st, err = fe.fd.Stat(); err != nil {
+			return
+		}
+		files[i] = resumeFile{fe.fd.Name(), st.Size(), st.ModTime()}
+		if fe.skipped {
+			// The parts file holds what we keep of it.
+			files[i].Size = fe.length
+		}
+	}
+	return
+}
+
+func (t *TorrentSession) resumePath() string {
+	if resumeDir == "" {
+		return ""
+	}
+	return filepath.Join(resumeDir, hex.EncodeToString([]byte(t.m.InfoHash))+".resume")
+}
+
+// checkPiecesResuming finds out which pieces we have, like checkPieces. It
+// uses the resume file to only check the pieces of files that changed since
+// it was written. Pieces we don't want are never checked, and we don't have
+// them: not all of their data is kept.
+func (t *TorrentSession) checkPiecesResuming() (good, bad int, goodBits *Bitset, err error) {
+	goodBits, recheck := t.loadResume()
+	if goodBits == nil && t.piecePriorities == nil {
+		return checkPieces(t.fileStore, t.totalSize, t.m, t.setCheckProgress)
+	}
+	numPieces := int((t.totalSize + t.m.Info.PieceLength - 1) / t.m.Info.PieceLength)
+	resumed := goodBits != nil
+	if !resumed {
+		if len(t.m.Info.Pieces) != numPieces*sha1.Size {
+			err = errors.New("Incorrect Info.Pieces length")
+			return
+		}
+		goodBits = NewBitset(numPieces)
+		recheck = make([]int, numPieces)
+		for i := range recheck {
+			recheck[i] = i
+		}
+	}
+	wanted := recheck[:0]
+	for _, piece := range recheck {
+		if t.piecePriority(piece) != PrioritySkip {
+			wanted = append(wanted, piece)
+		}
+	}
+	recheck = wanted
+	for i := 0; i < numPieces; i++ {
+		if t.piecePriority(i) == PrioritySkip {
+			goodBits.Clear(i)
+		}
+	}
+	if len(recheck) > 0 {
+		if resumed {
+			log.Println("Checking", len(recheck), "pieces of files that changed since the last run.")
+		}
+		var sums []byte
+		sums, err = computeSumsOf(t.fileStore, t.totalSize, t.m.Info.PieceLength, recheck, t.setCheckProgress)
+		if err != nil {
+			return
+		}
+		ref := t.m.Info.Pieces
+		for i, piece := range recheck {
+			sum := sums[i*sha1.Size : (i+1)*sha1.Size]
+			if checkEqual(ref[piece*sha1.Size:(piece+1)*sha1.Size], sum) {
+				goodBits.Set(piece)
+			} else {
+				goodBits.Clear(piece)
+			}
+		}
+	}
+	for i := 0; i < goodBits.n; i++ {
+		if goodBits.IsSet(i) {
+			good++
+		} else {
+			bad++
+		}
+	}
+	return
+}
+
+// loadResume reads the resume file. It returns the pieces we had, and the
+// pieces that must be checked again because their files changed. goodBits is
+// nil if there is no usable resume file.
+func (t *TorrentSession) loadResume() (goodBits *Bitset, recheck []int) {
+	fs, ok := t.fileStore.(*fileStore)
+	p := t.resumePath()
+	if !ok || p == "" {
+		return
+	}
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("Could not read resume file:", err)
+		}
+		return
+	}
+	var r resumeData
+	if err = json.Unmarshal(b, &r); err != nil {
+		log.Println("Could not parse resume file:", err)
+		return
+	}
+	pieceLength := t.m.Info.PieceLength
+	numPieces := int((t.totalSize + pieceLength - 1) / pieceLength)
+	if r.InfoHash != hex.EncodeToString([]byte(t.m.InfoHash)) || r.PieceLength != pieceLength ||
+		len(r.Files) != len(fs.files) {
+		log.Println("Resume file doesn't match the torrent, ignoring it.")
+		return
+	}
+	if goodBits = NewBitsetFromBytes(numPieces, r.Pieces); goodBits == nil {
+		log.Println("Bad bitfield in resume file, ignoring it.")
+		return
+	}
+	files, err := fs.statFiles()
+	if err != nil {
+		log.Println("Could not check files against the resume file:", err)
+		return nil, nil
+	}
+	checked := make(map[int]bool)
+	for i, f := range files {
+		saved := r.Files[i]
+		if f.Path == saved.Path && f.Size == saved.Size && f.ModTime.Equal(saved.ModTime) {
+			continue
+		}
+		if f.Size == 0 {
+			continue
+		}
+		start := fs.offsets[i]
+		for piece := int(start / pieceLength); piece <= int((start+f.Size-1)/pieceLength); piece++ {
+			if !checked[piece] {
+				checked[piece] = true
+				recheck = append(recheck, piece)
+			}
+		}
+	}
+	return
+}
+
+// saveResume writes the resume file, if the pieces we have changed since the
+// last time. Syncing big torrents can take long, so it is written in the
+// background, one save at a time; if one is still running, the next call
+// saves again.
+func (t *TorrentSession) saveResume() {
+	if !t.resumeSaved(false) {
+		return
+	}
+	fs, ok := t.fileStore.(*fileStore)
+	p := t.resumePath()
+	if !ok || p == "" || t.pieceSet == nil || !t.resumeDirty {
+		return
+	}
+	r := resumeData{
+		InfoHash:    hex.EncodeToString([]byte(t.m.InfoHash)),
+		PieceLength: t.m.Info.PieceLength,
+		Pieces:      append([]byte(nil), t.pieceSet.b...),
+	}
+	saving := make(chan bool)
+	t.resumeSaving, t.resumeDirty = saving, false
+	go func() {
+		t.resumeErr = writeResume(fs, p, r)
+		close(saving)
+	}()
+}
+
+// resumeSaved tells if no resume file is being saved anymore. With wait, it
+// waits for the save to end. A failed save leaves the pieces dirty.
+func (t *TorrentSession) resumeSaved(wait bool) bool {
+	if t.resumeSaving == nil {
+		return true
+	}
+	if wait {
+		<-t.resumeSaving
+	} else {
+		select {
+		case <-t.resumeSaving:
+		default:
+			return false
+		}
+	}
+	if t.resumeErr != nil {
+		log.Println("Could not save resume file:", t.resumeErr)
+		t.resumeDirty = true
+	}
+	t.resumeSaving, t.resumeErr = nil, nil
+	return true
+}
+
+// writeResume writes r, with the state of the files of fs, to the resume file
+// p. The file is replaced atomically, so a crash leaves either the old or the
+// new one.
+func writeResume(fs *fileStore, p string, r resumeData) (err error) {
+	// What we claim to have must be on disk before the resume file says so.
+	if err = fs.Sync(); err != nil {
+		return
+	}
+	if r.Files, err = fs.statFiles(); err != nil {
+		return
+	}
+	if err = os.MkdirAll(resumeDir, 0750); err != nil {
+		return
+	}
+	tmp, err := ioutil.TempFile(resumeDir, "taipeitorrent")
+	if err != nil {
+		return
+	}
+	err = json.NewEncoder(tmp).Encode(r)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	// The file has to be closed already otherwise it can't be renamed on
+	// Windows.
+	tmp.Close()
+	if err == nil {
+		err = os.Rename(tmp.Name(), p)
+		if err != nil {
+			// Windows can't rename over an existing file.
+			os.Remove(p)
+			err = os.Rename(tmp.Name(), p)
+		}
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return
+}
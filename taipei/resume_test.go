@@ -0,0 +1,79 @@
+package taipei
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "taipei-resume")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(d string) { resumeDir = d }(resumeDir)
+	resumeDir = filepath.Join(dir, "resume")
+
+	data, err := ioutil.ReadFile("testData/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b"} {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Piece 10 spans both files.
+	info := InfoDict{PieceLength: 100, Files: []FileDict{
+		{Length: int64(len(data)), Path: []string{"a"}},
+		{Length: int64(len(data)), Path: []string{"b"}}}}
+	fs, totalSize, err := NewFileStore(&info, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	sums, err := computeSums(fs, totalSize, info.PieceLength)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info.Pieces = string(sums)
+	ts := &TorrentSession{m: &MetaInfo{Info: info, InfoHash: strings.Repeat("x", 20)},
+		fileStore: fs, totalSize: totalSize}
+
+	// No resume file yet: everything is checked.
+	good, bad, pieceSet, err := ts.checkPiecesResuming()
+	if err != nil || good != 21 || bad != 0 {
+		t.Fatalf("Got %d good and %d bad pieces, err %v", good, bad, err)
+	}
+
+	// Pretend we didn't have piece 0. As file a doesn't change, it will be
+	// trusted and not checked again.
+	pieceSet.Clear(0)
+	ts.pieceSet = pieceSet
+	ts.resumeDirty = true
+	ts.saveResume()
+	if !ts.resumeSaved(true) || ts.resumeDirty {
+		t.Fatal("Resume file not saved")
+	}
+
+	// Change file b.
+	if _, err = fs.WriteAt([]byte("garbage"), int64(len(data))+500); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Hour)
+	if err = os.Chtimes(filepath.Join(dir, "b"), later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	good, bad, pieceSet, err = ts.checkPiecesResuming()
+	if err != nil || good != 19 || bad != 2 {
+		t.Fatalf("Got %d good and %d bad pieces, err %v", good, bad, err)
+	}
+	if pieceSet.IsSet(0) || pieceSet.IsSet(15) || !pieceSet.IsSet(10) {
+		t.Errorf("Pieces 0 and 15 should be missing, 10 should be there")
+	}
+}
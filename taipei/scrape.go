@@ -0,0 +1,209 @@
+package taipei
+
+// Tracker scrapes: asking trackers about the swarms of many torrents at once,
+// without announcing.
+//
+// References:
+// - http://bittorrent.org/beps/bep_0015.html
+// - http://bittorrent.org/beps/bep_0048.html
+
+import (
+	"errors"
+	"log"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/nictuku/Taipei-Torrent/bencode"
+)
+
+const (
+	// How often each torrent is scraped.
+	scrapeInterval = 15 * time.Minute
+	// How often we look for torrents that need a scrape.
+	scrapeCheckInterval = time.Minute
+	// Keeps scrape URLs to a reasonable length.
+	httpMaxScrapeHashes = 50
+)
+
+// ScrapeInfo is what a tracker knows about a torrent.
+type ScrapeInfo struct {
+	Complete   int // Seeders.
+	Downloaded int // Number of times the torrent was downloaded.
+	Incomplete int // Leechers.
+}
+
+// scrapeTracker asks the tracker with the given announce URL about the
+// torrents with the given info hashes. Hashes the tracker said nothing about
+// are missing from the result.
+func scrapeTracker(announce string, infoHashes []string) (result map[string]ScrapeInfo, err error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return nil, errors.New("Invalid announce URL " + announce + ": " + err.Error())
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return httpScrape(u, infoHashes)
+	case "udp":
+		return udpScrape(u.Host, infoHashes)
+	}
+	return nil, errors.New("Unsupported tracker URL scheme: " + announce)
+}
+
+// httpScrapeURL derives the scrape URL of an HTTP tracker from its announce
+// URL. Only trackers whose announce path ends with "announce" support
+// scraping.
+func httpScrapeURL(u *url.URL) (scrape *url.URL, err error) {
+	dir, file := path.Split(u.Path)
+	if !strings.HasPrefix(file, "announce") {
+		return nil, errors.New("Tracker doesn't support scrape: " + u.String())
+	}
+	scrape = new(url.URL)
+	*scrape = *u
+	scrape.Path = dir + "scrape" + strings.TrimPrefix(file, "announce")
+	return
+}
+
+func httpScrape(u *url.URL, infoHashes []string) (result map[string]ScrapeInfo, err error) {
+	scrape, err := httpScrapeURL(u)
+	if err != nil {
+		return
+	}
+	result = make(map[string]ScrapeInfo, len(infoHashes))
+	for len(infoHashes) > 0 {
+		batch := infoHashes
+		if len(batch) > httpMaxScrapeHashes {
+			batch = batch[:httpMaxScrapeHashes]
+		}
+		infoHashes = infoHashes[len(batch):]
+
+		q := scrape.Query()
+		for _, ih := range batch {
+			q.Add("info_hash", ih)
+		}
+		batchURL := *scrape
+		batchURL.RawQuery = q.Encode()
+		if err = httpScrapeBatch(batchURL.String(), result); err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+func httpScrapeBatch(u string, result map[string]ScrapeInfo) (err error) {
+	r, err := trackerClient.Get(u)
+	if err != nil {
+		return
+	}
+	defer r.Body.Close()
+	if r.StatusCode >= 400 {
+		return errors.New("Scrape failed: " + r.Status)
+	}
+	data, err := bencode.Decode(r.Body)
+	if err != nil {
+		return
+	}
+	top, _ := data.(map[string]interface{})
+	if reason := getString(top, "failure reason"); reason != "" {
+		return errors.New("Scrape failed: " + reason)
+	}
+	files, _ := top["files"].(map[string]interface{})
+	for ih, v := range files {
+		f, _ := v.(map[string]interface{})
+		result[ih] = ScrapeInfo{
+			Complete:   getInt(f, "complete"),
+			Downloaded: getInt(f, "downloaded"),
+			Incomplete: getInt(f, "incomplete"),
+		}
+	}
+	return
+}
+
+func getInt(m map[string]interface{}, k string) int {
+	if v, ok := m[k].(int64); ok {
+		return int(v)
+	}
+	return 0
+}
+
+// ScrapeInfo returns what the tracker said about the torrent at the last
+// scrape, and when that was. The time is zero if there was no scrape yet. It
+// is safe to call from any goroutine.
+func (t *TorrentSession) ScrapeInfo() (info ScrapeInfo, updated time.Time) {
+	t.scrapeMu.Lock()
+	defer t.scrapeMu.Unlock()
+	return t.scrape, t.scraped
+}
+
+func (t *TorrentSession) setScrapeInfo(info ScrapeInfo) {
+	t.scrapeMu.Lock()
+	defer t.scrapeMu.Unlock()
+	t.scrape, t.scraped = info, time.Now()
+}
+
+// scrapeDue returns the tracker to scrape, if it is time to, or "". The
+// scrape then counts as done, whether it works or not.
+func (t *TorrentSession) scrapeDue(now time.Time) string {
+	t.scrapeMu.Lock()
+	defer t.scrapeMu.Unlock()
+	if t.scrapeURL == "" || now.Sub(t.scrapeTried) < scrapeInterval {
+		return ""
+	}
+	t.scrapeTried = now
+	return t.scrapeURL
+}
+
+// setScrapeURL sets the tracker to scrape: the one we announce to.
+func (t *TorrentSession) setScrapeURL(u string) {
+	t.scrapeMu.Lock()
+	defer t.scrapeMu.Unlock()
+	t.scrapeURL = u
+}
+
+// scrapeLoop regularly scrapes the trackers of all the sessions, until
+// StopTorrents. Torrents that use the same tracker are asked about in the
+// same requests.
+func (c *Client) scrapeLoop() {
+	ticker := time.NewTicker(scrapeCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.scrapeAll()
+		case <-c.quit:
+			return
+		}
+	}
+}
+
+func (c *Client) scrapeAll() {
+	now := time.Now()
+	byTracker := make(map[string][]*TorrentSession)
+	c.mu.Lock()
+	for _, ts := range c.sessions {
+		if u := ts.scrapeDue(now); u != "" {
+			byTracker[u] = append(byTracker[u], ts)
+		}
+	}
+	c.mu.Unlock()
+
+	for u, sessions := range byTracker {
+		go func(u string, sessions []*TorrentSession) {
+			hashes := make([]string, len(sessions))
+			for i, ts := range sessions {
+				hashes[i] = ts.m.InfoHash
+			}
+			result, err := scrapeTracker(u, hashes)
+			if err != nil {
+				log.Println("Could not scrape", u, err)
+				return
+			}
+			for _, ts := range sessions {
+				if info, ok := result[ts.m.InfoHash]; ok {
+					ts.setScrapeInfo(info)
+				}
+			}
+		}(u, sessions)
+	}
+}
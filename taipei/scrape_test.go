@@ -0,0 +1,92 @@
+package taipei
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/nictuku/Taipei-Torrent/bencode"
+)
+
+func TestHTTPScrapeURL(t *testing.T) {
+	tests := []struct{ announce, scrape string }{
+		{"http://example.com/announce", "http://example.com/scrape"},
+		{"http://example.com/x/announce", "http://example.com/x/scrape"},
+		{"http://example.com/announce.php", "http://example.com/scrape.php"},
+		{"http://example.com/announce?x=2/4", "http://example.com/scrape?x=2/4"},
+		{"http://example.com/x%064announce", ""},
+		{"http://example.com/a", ""},
+	}
+	for _, test := range tests {
+		u, err := url.Parse(test.announce)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scrape, err := httpScrapeURL(u)
+		got := ""
+		if err == nil {
+			got = scrape.String()
+		}
+		if test.scrape == "" && err == nil {
+			t.Errorf("%v: got %v, wanted an error", test.announce, got)
+		} else if test.scrape != "" && got != test.scrape {
+			t.Errorf("%v: got %v, wanted %v", test.announce, got, test.scrape)
+		}
+	}
+}
+
+func TestHTTPScrape(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path != "/scrape" {
+			t.Errorf("Unexpected scrape path %v", r.URL.Path)
+		}
+		files := make(map[string]interface{})
+		for _, ih := range r.URL.Query()["info_hash"] {
+			files[ih] = map[string]interface{}{"complete": int(ih[0]), "downloaded": 10, "incomplete": 3}
+		}
+		var b bytes.Buffer
+		if err := bencode.Marshal(&b, map[string]interface{}{"files": files}); err != nil {
+			t.Error(err)
+		}
+		w.Write(b.Bytes())
+	}))
+	defer ts.Close()
+
+	hashes := make([]string, httpMaxScrapeHashes+1)
+	for i := range hashes {
+		hashes[i] = string(bytes.Repeat([]byte{byte(i)}, 20))
+	}
+	result, err := scrapeTracker(ts.URL+"/announce", hashes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests != 2 {
+		t.Errorf("Scraped %d hashes with %d requests, wanted 2", len(hashes), requests)
+	}
+	for i, ih := range hashes {
+		want := ScrapeInfo{Complete: i, Downloaded: 10, Incomplete: 3}
+		if got, ok := result[ih]; !ok || got != want {
+			t.Errorf("Hash %d: got %+v, wanted %+v", i, got, want)
+		}
+	}
+}
+
+func TestScrapeLoopStops(t *testing.T) {
+	c := &Client{sessions: make(map[string]*TorrentSession), quit: make(chan bool)}
+	done := make(chan bool)
+	go func() {
+		c.scrapeLoop()
+		close(done)
+	}()
+	c.StopTorrents()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The scrape loop still runs after StopTorrents")
+	}
+}
@@ -0,0 +1,323 @@
+package taipei
+
+// Streaming over HTTP.
+//
+// With -streamAddr, the client runs an HTTP server that serves the files of
+// its torrents while they download, with Range support:
+//
+//   /                        lists the torrents
+//   /<info hash>/            lists the files of a torrent
+//   /<info hash>/<path>      is the file at path in the torrent
+//
+// A read of data we don't have yet blocks until it is downloaded. The piece
+// it needs, and the next ones in a read-ahead window, are picked before any
+// other.
+
+import (
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// How much of a file is downloaded ahead of where it's read.
+const streamReadAhead = 8 * 1024 * 1024
+
+var streamAddr string
+
+func init() {
+	flag.StringVar(&streamAddr, "streamAddr", "", "Address of the HTTP server that streams the files of "+
+		"the torrents while they download, like localhost:8080. Empty disables it.")
+}
+
+var errSessionDone = errors.New("torrent session is over")
+
+// call runs f on the main loop of the session, and waits for it. It returns
+// false if the session is over.
+func (t *TorrentSession) call(f func()) bool {
+	done := make(chan bool)
+	select {
+	case t.calls <- func() { f(); close(done) }:
+	case <-t.done:
+		return false
+	}
+	<-done
+	return true
+}
+
+type streamFile struct {
+	name           string
+	offset, length int64 // Where the file is in the torrent.
+	skipped        bool
+}
+
+// streamFiles lists the files of the torrent. It is empty until we have the
+// info dictionary of a magnet link.
+func (t *TorrentSession) streamFiles() (files []streamFile, pieceLength int64, err error) {
+	ok := t.call(func() {
+		fs, ok := t.fileStore.(*fileStore)
+		if !t.si.HaveTorrent || !ok {
+			return
+		}
+		for i, name := range fileNames(&t.m.Info) {
+			files = append(files, streamFile{name, fs.offsets[i], fs.files[i].length,
+				t.filePriorities[i] == PrioritySkip})
+		}
+		pieceLength = t.m.Info.PieceLength
+	})
+	if !ok {
+		return nil, 0, errSessionDone
+	}
+	return
+}
+
+// streamPiece makes the pieces from first to last, which a stream reads
+// next, the first ones we download. The stream's pieces are added to owned,
+// until releaseStream. It returns a channel closed once we have the first
+// one, or nil if we have it already.
+func (t *TorrentSession) streamPiece(first, last int, owned map[int]bool) (ready chan bool) {
+	for i := first; i <= last && i < t.totalPieces; i++ {
+		if t.needPiece(i) && !owned[i] {
+			t.streamPieces[i]++
+			owned[i] = true
+		}
+	}
+	if t.pieceSet.IsSet(first) {
+		return nil
+	}
+	ready = make(chan bool)
+	t.pieceWaiters[first] = append(t.pieceWaiters[first], ready)
+	return
+}
+
+// streamPieceDone wakes up the streams waiting for a piece we now have.
+func (t *TorrentSession) streamPieceDone(piece int) {
+	delete(t.streamPieces, piece)
+	for _, ready := range t.pieceWaiters[piece] {
+		close(ready)
+	}
+	delete(t.pieceWaiters, piece)
+}
+
+// releaseStream forgets the pieces a stream wanted, unless other streams want
+// them too.
+func (t *TorrentSession) releaseStream(owned map[int]bool) {
+	for i := range owned {
+		if n, ok := t.streamPieces[i]; ok && n > 1 {
+			t.streamPieces[i] = n - 1
+		} else {
+			delete(t.streamPieces, i)
+		}
+		delete(owned, i)
+	}
+}
+
+// removeWaiter forgets the channel a stream waited on for the piece.
+func (t *TorrentSession) removeWaiter(piece int, ready chan bool) {
+	waiters := t.pieceWaiters[piece]
+	for i, w := range waiters {
+		if w == ready {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(waiters) == 0 {
+		delete(t.pieceWaiters, piece)
+	} else {
+		t.pieceWaiters[piece] = waiters
+	}
+}
+
+// chooseStreamPiece picks the first piece streams want from the peer, or
+// returns -1.
+func (t *TorrentSession) chooseStreamPiece(p *peerState) (piece int) {
+	piece = -1
+	for i := range t.streamPieces {
+		if piece >= 0 && i > piece {
+			continue
+		}
+		if !t.needPiece(i) {
+			delete(t.streamPieces, i)
+			continue
+		}
+		if _, ok := t.activePieces[i]; ok || t.verifying[i] || !p.have.IsSet(i) {
+			continue
+		}
+		piece = i
+	}
+	return
+}
+
+// waitForPiece blocks until we have the piece, with the ones up to last
+// downloaded next, or until cancel is closed. The stream then doesn't want
+// any of its pieces anymore.
+func (t *TorrentSession) waitForPiece(piece, last int, owned map[int]bool, cancel <-chan struct{}) error {
+	var ready chan bool
+	if !t.call(func() { ready = t.streamPiece(piece, last, owned) }) {
+		return errSessionDone
+	}
+	if ready == nil {
+		return nil
+	}
+	select {
+	case <-ready:
+		return nil
+	case <-t.done:
+		return errSessionDone
+	case <-cancel:
+		t.call(func() {
+			t.removeWaiter(piece, ready)
+			t.releaseStream(owned)
+		})
+		return errors.New("stream canceled")
+	}
+}
+
+// streamReader reads a file of a torrent, waiting for the data it doesn't
+// have yet. It is an io.ReadSeeker, as http.ServeContent wants.
+type streamReader struct {
+	t           *TorrentSession
+	file        streamFile
+	pieceLength int64
+	pos         int64
+	cancel      <-chan struct{}
+	pieces      map[int]bool // Those we asked for; see streamPiece.
+}
+
+// release tells the session the stream doesn't want its pieces anymore.
+func (r *streamReader) release() {
+	r.t.call(func() { r.t.releaseStream(r.pieces) })
+}
+
+func (r *streamReader) Read(p []byte) (n int, err error) {
+	if r.pos >= r.file.length {
+		return 0, io.EOF
+	}
+	off := r.file.offset + r.pos
+	piece := off / r.pieceLength
+	// One piece at a time, so we read only what we have.
+	if size := (piece+1)*r.pieceLength - off; int64(len(p)) > size {
+		p = p[:size]
+	}
+	if size := r.file.length - r.pos; int64(len(p)) > size {
+		p = p[:size]
+	}
+	last := (off + streamReadAhead) / r.pieceLength
+	if end := (r.file.offset + r.file.length - 1) / r.pieceLength; last > end {
+		last = end
+	}
+	if err = r.t.waitForPiece(int(piece), int(last), r.pieces, r.cancel); err != nil {
+		return
+	}
+	n, err = r.t.fileStore.ReadAt(p, off)
+	r.pos += int64(n)
+	return
+}
+
+func (r *streamReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.file.length
+	}
+	if offset < 0 {
+		return r.pos, errors.New("seek before the start of the file")
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+// startStreaming runs the streaming server, if -streamAddr is set.
+func (c *Client) startStreaming() (err error) {
+	if streamAddr == "" {
+		return
+	}
+	l, err := net.Listen("tcp", streamAddr)
+	if err != nil {
+		return
+	}
+	log.Println("Streaming files at http://" + l.Addr().String() + "/")
+	go http.Serve(l, http.HandlerFunc(c.serveStream))
+	return
+}
+
+func (c *Client) serveStream(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if parts[0] == "" {
+		c.serveTorrentList(w)
+		return
+	}
+	ih, err := hex.DecodeString(parts[0])
+	ts := c.session(string(ih))
+	if err != nil || ts == nil || len(parts) < 2 {
+		http.NotFound(w, r)
+		return
+	}
+	files, pieceLength, err := ts.streamFiles()
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if parts[1] == "" {
+		serveFileList(w, parts[0], files)
+		return
+	}
+	for _, f := range files {
+		if f.name != parts[1] {
+			continue
+		}
+		if f.skipped {
+			http.Error(w, "The file is skipped.", http.StatusNotFound)
+			return
+		}
+		name := f.name[strings.LastIndex(f.name, "/")+1:]
+		reader := &streamReader{t: ts, file: f, pieceLength: pieceLength,
+			cancel: r.Context().Done(), pieces: make(map[int]bool)}
+		defer reader.release()
+		http.ServeContent(w, r, name, time.Time{}, reader)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+func (c *Client) serveTorrentList(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintln(w, "<pre>")
+	for _, ih := range c.infoHashes() {
+		ts := c.session(ih)
+		if ts == nil {
+			continue
+		}
+		var name string
+		if !ts.call(func() { name = ts.m.Info.Name }) {
+			continue
+		}
+		h := hex.EncodeToString([]byte(ih))
+		fmt.Fprintf(w, "<a href=\"/%s/\">%s</a> %s\n", h, h, html.EscapeString(name))
+	}
+	fmt.Fprintln(w, "</pre>")
+}
+
+func serveFileList(w http.ResponseWriter, ih string, files []streamFile) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintln(w, "<pre>")
+	for _, f := range files {
+		name := html.EscapeString(f.name)
+		if f.skipped {
+			fmt.Fprintf(w, "%s (skipped)\n", name)
+			continue
+		}
+		u := &url.URL{Path: "/" + ih + "/" + f.name}
+		fmt.Fprintf(w, "<a href=\"%s\">%s</a> %d\n", html.EscapeString(u.String()), name, f.length)
+	}
+	fmt.Fprintln(w, "</pre>")
+}
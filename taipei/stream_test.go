@@ -0,0 +1,131 @@
+package taipei
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "taipei-stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	info := InfoDict{Name: "movie", PieceLength: 10, Files: []FileDict{
+		{Length: 6, Path: []string{"intro"}},
+		{Length: int64(len(data)) - 6, Path: []string{"clips", "main.mp4"}}}}
+	fs, _, err := newFileStore(&info, dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	// We have pieces 0 and 2.
+	ts, stop := newTestSession(info, fs, 0, 2)
+	defer stop()
+	for _, piece := range []int{0, 2} {
+		fs.WriteAt(data[piece*10:piece*10+10], int64(piece*10))
+	}
+	c := &Client{sessions: map[string]*TorrentSession{ts.m.InfoHash: ts}}
+	server := httptest.NewServer(http.HandlerFunc(c.serveStream))
+	defer server.Close()
+
+	get := func(path, byteRange string) (string, error) {
+		req, _ := http.NewRequest("GET", server.URL+path, nil)
+		if byteRange != "" {
+			req.Header.Set("Range", "bytes="+byteRange)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		return string(b), err
+	}
+	list, err := get("/"+strings.Repeat("78", 20)+"/", "")
+	if err != nil || !strings.Contains(list, "clips/main.mp4") {
+		t.Errorf("Got file list %q, %v", list, err)
+	}
+
+	// All the data is there.
+	file := "/" + strings.Repeat("78", 20) + "/clips/main.mp4"
+	if got, err := get(file, "0-3"); err != nil || got != "6789" {
+		t.Errorf("Got %q, %v", got, err)
+	}
+
+	// Piece 1 is missing. The read waits for it, and asks for it and for
+	// piece 3 first.
+	result := make(chan string)
+	go func() {
+		got, err := get(file, "2-15")
+		if err != nil {
+			got = err.Error()
+		}
+		result <- got
+	}()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		var waiting, wanted bool
+		ts.call(func() {
+			waiting = len(ts.pieceWaiters[1]) > 0
+			wanted = ts.streamPieces[1] == 1 && ts.streamPieces[3] == 1 && ts.streamPieces[2] == 0
+		})
+		if waiting && wanted {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("The read didn't wait for piece 1")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case got := <-result:
+		t.Fatalf("Got %q before piece 1 was there", got)
+	default:
+	}
+	fs.WriteAt(data[10:20], 10)
+	ts.call(func() {
+		ts.pieceSet.Set(1)
+		ts.streamPieceDone(1)
+	})
+	if got := <-result; got != string(data[8:22]) {
+		t.Errorf("Got %q, wanted %q", got, data[8:22])
+	}
+
+	// Streams that end or are canceled don't want their pieces anymore.
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequest("GET", server.URL+file, nil)
+	req.Header.Set("Range", "bytes=14-")
+	go func() {
+		if resp, err := http.DefaultClient.Do(req.WithContext(ctx)); err == nil {
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+	}()
+	waitFor := func(what string, f func() bool) {
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			var ok bool
+			ts.call(func() { ok = f() })
+			if ok {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatal(what)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitFor("The read didn't wait for piece 3", func() bool { return len(ts.pieceWaiters[3]) > 0 })
+	cancel()
+	waitFor("The canceled read still waits", func() bool {
+		return len(ts.pieceWaiters) == 0 && len(ts.streamPieces) == 0
+	})
+}
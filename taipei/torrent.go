@@ -2,6 +2,7 @@ package taipei
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"flag"
 	"fmt"
@@ -9,14 +10,17 @@ import (
 	"log"
 	"math/rand"
 	"net"
-	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/nictuku/Taipei-Torrent/dht"
 	"github.com/nictuku/Taipei-Torrent/nettools"
+	"github.com/nictuku/Taipei-Torrent/utp"
 )
 
 const (
@@ -37,7 +41,8 @@ const (
 	REQUEST
 	PIECE
 	CANCEL
-	PORT // Not implemented. For DHT support.
+	PORT           // BEP 5
+	EXTENSION = 20 // BEP 10
 )
 
 // Should be overriden by flag. Not thread safe.
@@ -46,6 +51,8 @@ var useUPnP bool
 var fileDir string
 var useDHT bool
 var trackerLessMode bool
+var seedRatio float64
+var seedTime time.Duration
 
 func init() {
 	flag.StringVar(&fileDir, "fileDir", ".", "path to directory where files are stored")
@@ -57,19 +64,34 @@ func init() {
 	flag.BoolVar(&useDHT, "useDHT", false, "Use DHT to get peers.")
 	flag.BoolVar(&trackerLessMode, "trackerLessMode", false, "Do not get peers from the tracker. Good for "+
 		"testing the DHT mode.")
+	flag.Float64Var(&seedRatio, "seedRatio", 0, "Stop seeding once we uploaded this many times the torrent size. "+
+		"0 means no limit.")
+	flag.DurationVar(&seedTime, "seedTime", 0, "Stop seeding after this long. 0 means no limit. "+
+		"If both -seedRatio and -seedTime are set, we stop at the first limit reached.")
 }
 
+// The states of a session, for Stop.
+const (
+	sessionNew int32 = iota
+	sessionRunning
+	sessionStopped
+)
+
+// How long to wait for the tracker to acknowledge that we are leaving.
+const stoppedAnnounceTimeout = 10 * time.Second
+
 func peerId() string {
 	sid := "-tt" + strconv.Itoa(os.Getpid()) + "_" + strconv.FormatInt(rand.Int63(), 10)
 	return sid[0:20]
 }
 
-func chooseListenPort() (listenPort int, err error) {
+// chooseListenPort returns the port to listen on and, with UPnP, the NAT it
+// is forwarded by.
+func chooseListenPort() (listenPort int, nat NAT, err error) {
 	listenPort = port
 	if useUPnP {
 		log.Println("Using UPnP to open port.")
 		// TODO: Look for ports currently in use. Handle collisions.
-		var nat NAT
 		nat, err = Discover()
 		if err != nil {
 			log.Println("Unable to discover NAT:", err)
@@ -84,47 +106,12 @@ func chooseListenPort() (listenPort int, err error) {
 			"Taipei-Torrent port "+strconv.Itoa(listenPort), 0)
 		if err != nil {
 			log.Println("Unable to forward listen port", err)
-			return
+			return listenPort, nil, err
 		}
 	}
 	return
 }
 
-func (t *TorrentSession) listenForPeerConnections(conChan chan net.Conn) {
-	listenString := ":" + strconv.Itoa(t.si.Port)
-	listener, err := net.Listen("tcp", listenString)
-	if err != nil {
-		log.Fatal("Listen failed:", err)
-	}
-
-	// If port was not set by UPnP, and was 0, get the actual port
-	if t.si.Port == 0 {
-		// so we can send it to trackers.
-		_, p, err := net.SplitHostPort(listener.Addr().String())
-		if err == nil {
-			t.si.Port, err = strconv.Atoi(p)
-		}
-
-		if err != nil {
-			log.Fatal("net.Listen() gave us an ivalid port: ", err)
-		}
-	}
-
-	log.Println("Listening for peers on port:", t.si.Port)
-	go func() {
-		for {
-			var conn net.Conn
-			conn, err = listener.Accept()
-			if err != nil {
-				log.Println("Listener failed:", err)
-			} else {
-				// log.Println("A peer contacted us", conn.RemoteAddr().String())
-				conChan <- conn
-			}
-		}
-	}()
-}
-
 var kBitTorrentHeader = []byte{'\x13', 'B', 'i', 't', 'T', 'o', 'r',
 	'r', 'e', 'n', 't', ' ', 'p', 'r', 'o', 't', 'o', 'c', 'o', 'l'}
 
@@ -181,33 +168,94 @@ func (a *ActivePiece) isComplete() bool {
 }
 
 type TorrentSession struct {
-	m               *MetaInfo
-	si              *SessionInfo
-	ti              *TrackerResponse
-	fileStore       FileStore
-	trackerInfoChan chan *TrackerResponse
-	peers           map[string]*peerState
-	peerMessageChan chan peerMessage
-	pieceSet        *Bitset // The pieces we have
-	totalPieces     int
-	totalSize       int64
-	lastPieceLength int
-	goodPieces      int
-	activePieces    map[int]*ActivePiece
-	lastHeartBeat   time.Time
-	dht             *dht.DHTEngine
-}
-
-func NewTorrentSession(torrent string) (ts *TorrentSession, err error) {
-
-	var listenPort int
-	if listenPort, err = chooseListenPort(); err != nil {
-		log.Println("Could not choose listen port.")
-		log.Println("Peer connectivity will be affected.")
-	}
+	m                 *MetaInfo
+	si                *SessionInfo
+	ti                *TrackerResponse
+	fileStore         FileStore
+	trackerInfoChan   chan *trackerAnswer
+	trackers          [][]*trackerState // Tiers of trackers, in the order we try them.
+	webSeeds          []*webSeed
+	announcing        bool
+	pendingEvents     []string  // Events to announce after the running announce.
+	retryAt           time.Time // No tracker answered; don't announce before.
+	peers             map[string]*peerState
+	peerMessageChan   chan peerMessage
+	pieceSet          *Bitset // The pieces we have
+	totalPieces       int
+	totalSize         int64
+	lastPieceLength   int
+	goodPieces        int
+	missingPieces     int // Pieces we want and don't have.
+	priorityRules     []priorityRule
+	filePriorities    []Priority // Of each file, in the order of the info dictionary.
+	piecePriorities   []Priority
+	wantedLengths     []int64 // Bytes of each piece in files that aren't skipped.
+	activePieces      map[int]*ActivePiece
+	pieceAvailability []int        // How many connected peers have each piece.
+	resumeDirty       bool         // pieceSet changed since the resume file was saved.
+	resumeSaving      chan bool    // Closed when the resume file being saved is written.
+	resumeErr         error        // Of that save; read once resumeSaving is closed.
+	verifying         map[int]bool // Downloaded pieces being hashed.
+	streamPieces      map[int]int  // How many streams read each piece next. They are picked first.
+	pieceWaiters      map[int][]chan bool
+	calls             chan func() // Run on the main loop; see call.
+	pieceVerifiedChan chan pieceVerification
+	lastHeartBeat     time.Time
+	name              string // Directory name for multi-file torrents.
+	metadataSize      int64
+	metadataPieces    [][]byte     // ut_metadata pieces received so far.
+	metadataSenders   []*peerState // Of each piece.
+	extensions        []registeredExtension
+	dht               *dht.DHTEngine
+	utp               *utp.Socket
+	dhtPeersChan      chan []string
+	conChan           chan net.Conn
+	seedingSince      time.Time
+	chokeRound        int
+	optimisticUnchoke *peerState
+	paused            bool
+	quit              chan bool // Closed by Stop.
+	stopOnce          sync.Once
+	state             int32     // sessionNew, sessionRunning or sessionStopped.
+	done              chan bool // Closed when DoTorrent returns.
+	uploadLimit       *nettools.RateLimiter
+	downloadLimit     *nettools.RateLimiter
+	// Shared by all the sessions of a Client. Nil if there is none.
+	globalUploadLimit   *nettools.RateLimiter
+	globalDownloadLimit *nettools.RateLimiter
+
+	checkMu  sync.Mutex // Protects check and checking.
+	check    CheckProgress
+	checking bool
+
+	scrapeMu    sync.Mutex // Protects the scrape fields.
+	scrapeURL   string
+	scrapeTried time.Time
+	scraped     time.Time
+	scrape      ScrapeInfo
+}
+
+// NewTorrentSession prepares a download of the torrent file or URL. Peers
+// should be told to connect to listenPort. The session does not listen on it
+// itself; see Client.
+func NewTorrentSession(torrent string, listenPort int) (ts *TorrentSession, err error) {
 	t := &TorrentSession{peers: make(map[string]*peerState),
-		peerMessageChan: make(chan peerMessage),
-		activePieces:    make(map[int]*ActivePiece)}
+		peerMessageChan:   make(chan peerMessage),
+		activePieces:      make(map[int]*ActivePiece),
+		verifying:         make(map[int]bool),
+		streamPieces:      make(map[int]int),
+		pieceWaiters:      make(map[int][]chan bool),
+		calls:             make(chan func()),
+		pieceVerifiedChan: make(chan pieceVerification),
+		dhtPeersChan:      make(chan []string, 10),
+		conChan:           make(chan net.Conn),
+		quit:              make(chan bool),
+		done:              make(chan bool),
+		uploadLimit:       nettools.NewRateLimiter(0),
+		downloadLimit:     nettools.NewRateLimiter(0)}
+	if t.priorityRules, err = parsePriorityRules(filePriorities); err != nil {
+		return
+	}
 	t.m, err = getMetaInfo(torrent)
 	if err != nil {
 		return
@@ -217,23 +265,53 @@ func NewTorrentSession(torrent string) (ts *TorrentSession, err error) {
 	if e := t.m.Encoding; e != "" && e != "UTF-8" {
 		return nil, errors.New(fmt.Sprintf("Unknown encoding %s", e))
 	}
-	ext := ".torrent"
+	t.si = &SessionInfo{PeerId: peerId(), Port: listenPort}
+	t.trackers = newTrackerTiers(t.m)
+	t.webSeeds = newWebSeeds(t.m.URLList)
+	if len(t.trackers) > 0 {
+		t.scrapeURL = t.trackers[0][0].url
+	}
+	t.registerExtension("ut_metadata", utMetadata{})
+	if t.m.Info.Private != 1 {
+		t.registerExtension("ut_pex", utPex{})
+	}
+	if strings.HasPrefix(torrent, "magnet:") {
+		// The name is only known once we have the metadata.
+		// Until then, we don't know how much is left either; anything but
+		// zero keeps trackers from taking us for a seeder.
+		t.si.Left = 1
+	} else {
+		t.name = strings.TrimSuffix(filepath.Base(torrent), ".torrent")
+		err = t.load()
+	}
+	return t, err
+}
+
+// load opens the files of the torrent and checks which pieces we already
+// have. It requires the info dictionary.
+func (t *TorrentSession) load() (err error) {
+	if t.name == "" {
+		t.name = filepath.Base(t.m.Info.Name)
+	}
 	dir := fileDir
 	if len(t.m.Info.Files) != 0 {
-		dir += "/" + filepath.Base(torrent)
-		if dir[len(dir)-len(ext):] == ext {
-			dir = dir[:len(dir)-len(ext)]
-		}
+		dir += "/" + t.name
 	}
 
-	t.fileStore, t.totalSize, err = NewFileStore(&t.m.Info, dir)
+	t.setPriorities()
+	fs, totalSize, err := newFileStore(&t.m.Info, dir, t.filePriorities)
 	if err != nil {
 		return
 	}
+	t.fileStore, t.totalSize = fs, totalSize
 	t.lastPieceLength = int(t.totalSize % t.m.Info.PieceLength)
+	if t.lastPieceLength == 0 {
+		t.lastPieceLength = int(t.m.Info.PieceLength)
+	}
 
 	start := time.Now()
-	good, bad, pieceSet, err := checkPieces(t.fileStore, t.totalSize, t.m)
+	good, bad, pieceSet, err := t.checkPiecesResuming()
+	t.checkDone()
 	end := time.Now()
 	log.Printf("Computed missing pieces (%.2f seconds)", end.Sub(start).Seconds())
 	if err != nil {
@@ -241,73 +319,88 @@ func NewTorrentSession(torrent string) (ts *TorrentSession, err error) {
 	}
 	t.pieceSet = pieceSet
 	t.totalPieces = good + bad
+	t.pieceAvailability = make([]int, t.totalPieces)
 	t.goodPieces = good
 	log.Println("Good pieces:", good, "Bad pieces:", bad)
 
-	left := int64(bad) * int64(t.m.Info.PieceLength)
-	if !t.pieceSet.IsSet(t.totalPieces - 1) {
-		left = left - t.m.Info.PieceLength + int64(t.lastPieceLength)
-	}
-	t.si = &SessionInfo{PeerId: peerId(), Port: listenPort, Left: left}
-	if useDHT {
-		// TODO: UPnP UDP port mapping.
-		if t.dht, err = dht.NewDHTNode(listenPort, TARGET_NUM_PEERS, true); err != nil {
-			log.Println("DHT node creation error", err)
-			return
+	// Only what we want is left to download.
+	var left int64
+	t.missingPieces = 0
+	for i := 0; i < t.totalPieces; i++ {
+		if t.needPiece(i) {
+			left += t.wantedLengths[i]
+			t.missingPieces++
 		}
-		go t.dht.DoDHT()
 	}
-	return t, err
-}
-
-func (t *TorrentSession) fetchTrackerInfo(event string) {
-	m, si := t.m, t.si
-	log.Println("Stats: Uploaded", si.Uploaded, "Downloaded", si.Downloaded, "Left", si.Left)
-	u, err := url.Parse(m.Announce)
-	if err != nil {
-		log.Println("Error: Invalid announce URL(", m.Announce, "):", err)
+	if t.missingPieces < bad {
+		log.Println("Skipping", bad-t.missingPieces, "pieces of files we don't want.")
 	}
-	uq := u.Query()
-	uq.Add("info_hash", m.InfoHash)
-	uq.Add("peer_id", si.PeerId)
-	uq.Add("port", strconv.Itoa(si.Port))
-	uq.Add("uploaded", strconv.FormatInt(si.Uploaded, 10))
-	uq.Add("downloaded", strconv.FormatInt(si.Downloaded, 10))
-	uq.Add("left", strconv.FormatInt(si.Left, 10))
-	uq.Add("compact", "1")
+	t.si.Left = left
+	t.si.HaveTorrent = true
+	t.resumeDirty = true
+	t.saveResume()
+	return
+}
 
-	if event != "" {
-		uq.Add("event", event)
-	}
+// CheckProgress tells how far the check of the pieces we already have is, if
+// one is running. A magnet link is checked once we have its metadata. It can
+// be called from any goroutine.
+func (t *TorrentSession) CheckProgress() (p CheckProgress, checking bool) {
+	t.checkMu.Lock()
+	defer t.checkMu.Unlock()
+	return t.check, t.checking
+}
 
-	// This might reorder the existing query string in the Announce url
-	// I worry this might break some broken trackers that don't parse URLs
-	// properly.
+func (t *TorrentSession) setCheckProgress(p CheckProgress) {
+	t.checkMu.Lock()
+	defer t.checkMu.Unlock()
+	t.check, t.checking = p, true
+}
 
-	u.RawQuery = uq.Encode()
+func (t *TorrentSession) checkDone() {
+	t.checkMu.Lock()
+	defer t.checkMu.Unlock()
+	t.check, t.checking = CheckProgress{}, false
+}
 
-	ch := t.trackerInfoChan
-	go func() {
-		ti, err := getTrackerInfo(u.String())
-		if ti == nil || err != nil {
-			log.Println("Error: Could not fetch tracker info:", err)
-		} else if ti.FailureReason != "" {
-			log.Println("Error: Tracker returned failure reason:", ti.FailureReason)
-		} else {
-			ch <- ti
-		}
-	}()
+// dialNewPeer connects to the peer, unless we already are connected to it. It
+// tells if a connection was attempted.
+func (t *TorrentSession) dialNewPeer(peer string) bool {
+	if _, ok := t.peers[peer]; ok {
+		return false
+	}
+	go t.connectToPeer(peer)
+	return true
 }
 
-func connectToPeer(peer string, ch chan net.Conn) {
+func (t *TorrentSession) connectToPeer(peer string) {
 	// log.Println("Connecting to", peer)
-	conn, err := net.Dial("tcp", peer)
+	conn, err := t.dialPeer(peer)
 	if err != nil {
 		// log.Println("Failed to connect to", peer, err)
 	} else {
 		// log.Println("Connected to", peer)
-		ch <- conn
+		select {
+		case t.conChan <- conn:
+		case <-t.done:
+			conn.Close()
+		}
+	}
+}
+
+// dialPeer connects to the peer over uTP if we can, and else over TCP.
+func (t *TorrentSession) dialPeer(peer string) (conn net.Conn, err error) {
+	if t.utp != nil {
+		conn, err = dialEncrypted(t.utp.Dial, peer, t.m.InfoHash, encryption)
+		if err == nil {
+			return
+		}
 	}
+	return dialEncrypted(dialTCP, peer, t.m.InfoHash, encryption)
+}
+
+func dialTCP(addr string) (net.Conn, error) {
+	return net.Dial("tcp", addr)
 }
 
 func (t *TorrentSession) AddPeer(conn net.Conn) {
@@ -320,9 +413,15 @@ func (t *TorrentSession) AddPeer(conn net.Conn) {
 	}
 	ps := NewPeerState(conn)
 	ps.address = peer
+	// Connections from other peers come through the Client.
+	_, ps.incoming = conn.(*replayConn)
+	ps.encrypted = isEncrypted(conn)
+	ps.uploadLimits = []*nettools.RateLimiter{t.uploadLimit, t.globalUploadLimit}
+	ps.downloadLimits = []*nettools.RateLimiter{t.downloadLimit, t.globalDownloadLimit}
 	var header [68]byte
 	copy(header[0:], kBitTorrentHeader[0:])
-	if t.m.Info.Private != 1 && useDHT {
+	header[25] |= 0x10 // Extension protocol (BEP 10)
+	if t.useDHT() {
 		header[27] = header[27] | 0x01
 	}
 	copy(header[28:48], string2Bytes(t.m.InfoHash))
@@ -331,19 +430,25 @@ func (t *TorrentSession) AddPeer(conn net.Conn) {
 	t.peers[peer] = ps
 	go ps.peerWriter(t.peerMessageChan, header[0:])
 	go ps.peerReader(t.peerMessageChan)
-	ps.SetChoke(false) // TODO: better choke policy
 }
 
 func (t *TorrentSession) ClosePeer(peer *peerState) {
 	log.Println("Closing peer", peer.address)
 	_ = t.removeRequests(peer)
+	t.removeAvailability(peer.have)
 	peer.Close()
 	delete(t.peers, peer.address)
 }
 
 func (t *TorrentSession) deadlockDetector() {
+	ticker := time.NewTicker(15 * time.Second)
+	defer ticker.Stop()
 	for {
-		time.Sleep(15 * time.Second)
+		select {
+		case <-ticker.C:
+		case <-t.done:
+			return
+		}
 		age := time.Now().Sub(t.lastHeartBeat)
 		if age > 15*time.Second {
 			log.Println("Starvation or deadlock of main thread detected. Look in the stack dump for what DoTorrent() is currently doing.")
@@ -353,85 +458,102 @@ func (t *TorrentSession) deadlockDetector() {
 	}
 }
 
+// DoTorrent runs the session until Stop is called, or until we are done
+// seeding.
 func (t *TorrentSession) DoTorrent() (err error) {
+	return t.DoTorrentContext(context.Background())
+}
+
+// DoTorrentContext is like DoTorrent, and also stops the session when ctx is
+// done. It then returns the error of ctx.
+func (t *TorrentSession) DoTorrentContext(ctx context.Context) (err error) {
+	if !atomic.CompareAndSwapInt32(&t.state, sessionNew, sessionRunning) {
+		return errSessionDone
+	}
+	defer close(t.done)
 	t.lastHeartBeat = time.Now()
 	go t.deadlockDetector()
+	if t.isComplete() {
+		t.seedingSince = time.Now()
+	}
 	log.Println("Fetching torrent.")
-	rechokeChan := time.Tick(1 * time.Second)
-	// Start out polling tracker every 20 seconds untill we get a response.
-	// Maybe be exponential backoff here?
-	retrackerChan := time.Tick(20 * time.Second)
-	keepAliveChan := time.Tick(60 * time.Second)
-	t.trackerInfoChan = make(chan *TrackerResponse)
-
-	conChan := make(chan net.Conn)
-	t.listenForPeerConnections(conChan)
-
-	DHTPeersRequestResults := make(chan map[string][]string)
-	if t.m.Info.Private != 1 && useDHT {
-		DHTPeersRequestResults = t.dht.PeersRequestResults
+	// The tickers are stopped when we return, as a stopped session can be
+	// added again.
+	rechoke := time.NewTicker(1 * time.Second)
+	defer rechoke.Stop()
+	choke := time.NewTicker(chokeInterval)
+	defer choke.Stop()
+	// Each tracker answer, or failure, sets when to announce next.
+	retracker := time.NewTimer(firstRetryDelay)
+	defer retracker.Stop()
+	keepAlive := time.NewTicker(60 * time.Second)
+	defer keepAlive.Stop()
+	resume := time.NewTicker(resumeSaveInterval)
+	defer resume.Stop()
+	pex := time.NewTicker(pexInterval)
+	defer pex.Stop()
+	t.trackerInfoChan = make(chan *trackerAnswer)
+	conChan := t.conChan
+
+	if t.useDHT() {
 		t.dht.PeersRequest(t.m.InfoHash, true)
 	}
 
 	t.fetchTrackerInfo("started")
+	t.connectWebSeeds()
 
 	for {
 		select {
-		case _ = <-retrackerChan:
-			if !trackerLessMode {
+		case _ = <-retracker.C:
+			if !trackerLessMode && !t.paused {
 				t.fetchTrackerInfo("")
 			}
-		case dhtInfoHashPeers := <-DHTPeersRequestResults:
+		case dhtPeers := <-t.dhtPeersChan:
+			if t.paused {
+				break
+			}
 			newPeerCount := 0
-			// key = infoHash. The torrent client currently only
-			// supports one download at a time, so let's assume
-			// it's the case.
-			for _, peers := range dhtInfoHashPeers {
-				for _, peer := range peers {
-					peer = nettools.BinaryToDottedPort(peer)
-					if _, ok := t.peers[peer]; !ok {
-						newPeerCount++
-						go connectToPeer(peer, conChan)
-					}
+			for _, peer := range dhtPeers {
+				if t.dialNewPeer(nettools.BinaryToDottedPort(peer)) {
+					newPeerCount++
 				}
 			}
 			// log.Println("Contacting", newPeerCount, "new peers (thanks DHT!)")
-		case ti := <-t.trackerInfoChan:
+		case answer := <-t.trackerInfoChan:
+			ti := t.trackerAnswered(answer)
+			if answer.stopped {
+				break
+			}
+			delay := nextAnnounce(answer)
+			retracker.Reset(delay)
+			if ti == nil {
+				log.Println("No tracker answered. Trying again in", delay)
+				t.retryAt = time.Now().Add(delay)
+				break
+			}
+			t.retryAt = time.Time{}
 			t.ti = ti
 			log.Println("Torrent has", t.ti.Complete, "seeders and", t.ti.Incomplete, "leachers.")
-			if !trackerLessMode {
-				peers := t.ti.Peers
-				log.Println("Tracker gave us", len(peers)/6, "peers")
+			if !trackerLessMode && !t.paused {
+				peers := parseCompactPeers(t.ti.Peers, 6, len(t.ti.Peers))
+				peers = append(peers, parseCompactPeers(t.ti.Peers6, 18, len(t.ti.Peers6))...)
+				log.Println("Tracker gave us", len(peers), "peers")
 				newPeerCount := 0
-				for i := 0; i < len(peers); i += 6 {
-					peer := nettools.BinaryToDottedPort(peers[i : i+6])
-					if _, ok := t.peers[peer]; !ok {
+				for _, peer := range peers {
+					if t.dialNewPeer(peer) {
 						newPeerCount++
-						go connectToPeer(peer, conChan)
 					}
 				}
 				log.Println("Contacting", newPeerCount, "new peers")
-				interval := t.ti.Interval
-				if interval < 120 {
-					interval = 120
-				} else if interval > 24*3600 {
-					interval = 24 * 3600
-				}
-				log.Println("..checking again in", interval, "seconds.")
-				retrackerChan = time.Tick(interval * time.Second)
-				log.Println("Contacting", newPeerCount, "new peers")
-			}
-			interval := t.ti.Interval
-			if interval < 120 {
-				interval = 120
-			} else if interval > 24*3600 {
-				interval = 24 * 3600
 			}
-			log.Println("..checking again in", interval.String())
-			retrackerChan = time.Tick(interval * time.Second)
+			log.Println("..checking again in", delay)
 
 		case pm := <-t.peerMessageChan:
 			peer, message := pm.peer, pm.message
+			if t.peers[peer.address] != peer {
+				// Leftovers from a peer we already closed.
+				break
+			}
 			peer.lastReadTime = time.Now()
 			err2 := t.DoMessage(peer, message)
 			if err2 != nil {
@@ -441,19 +563,52 @@ func (t *TorrentSession) DoTorrent() (err error) {
 				t.ClosePeer(peer)
 			}
 		case conn := <-conChan:
+			if t.paused {
+				conn.Close()
+				break
+			}
 			t.AddPeer(conn)
-		case _ = <-rechokeChan:
-			// TODO: recalculate who to choke / unchoke
+		case _ = <-choke.C:
+			t.rechoke()
+		case _ = <-resume.C:
+			t.saveResume()
+		case _ = <-pex.C:
+			t.sendPex()
+		case v := <-t.pieceVerifiedChan:
+			t.pieceVerified(v)
+		case f := <-t.calls:
+			f()
+		case <-t.quit:
+			log.Println("Stopping torrent.")
+			t.shutdown()
+			return
+		case <-ctx.Done():
+			log.Println("Stopping torrent:", ctx.Err())
+			t.shutdown()
+			return ctx.Err()
+		case _ = <-rechoke.C:
 			t.lastHeartBeat = time.Now()
 			ratio := 0.0
 			if t.si.Downloaded > 0 {
 				ratio = float64(t.si.Uploaded) / float64(t.si.Downloaded)
 			}
-			log.Println("Peers:", len(t.peers), "Pieces(good/total):", 
-				t.goodPieces,"/",t.totalPieces ,"Up:", t.si.Downloaded,
-				"Down:", t.si.Uploaded, "Ratio:", ratio)
-			if len(t.peers) < TARGET_NUM_PEERS && t.goodPieces < t.totalPieces {
-				if t.m.Info.Private != 1 && useDHT {
+			log.Println("Peers:", len(t.peers), "Pieces(good/total):",
+				t.goodPieces, "/", t.totalPieces, "Up:", t.si.Uploaded,
+				"Down:", t.si.Downloaded, "Ratio:", ratio)
+			if t.paused {
+				break
+			}
+			if t.isComplete() {
+				if t.doneSeeding() {
+					log.Println("Done seeding.")
+					t.shutdown()
+					return
+				}
+				t.closeSeeds()
+			}
+			t.connectWebSeeds()
+			if len(t.peers) < TARGET_NUM_PEERS && !t.isComplete() {
+				if t.useDHT() {
 					go t.dht.PeersRequest(t.m.InfoHash, true)
 				}
 				if !trackerLessMode {
@@ -462,7 +617,7 @@ func (t *TorrentSession) DoTorrent() (err error) {
 					}
 				}
 			}
-		case _ = <-keepAliveChan:
+		case _ = <-keepAlive.C:
 			now := time.Now()
 			for _, peer := range t.peers {
 				if peer.lastReadTime.Second() != 0 && now.Sub(peer.lastReadTime) > 3*time.Minute {
@@ -479,12 +634,176 @@ func (t *TorrentSession) DoTorrent() (err error) {
 					continue
 				}
 				peer.keepAlive(now)
+				// Requests for metadata may have been ignored.
+				t.requestMetadata(peer)
 			}
 		}
 	}
 	return
 }
 
+// SetRateLimits limits how fast this torrent uploads and downloads piece
+// data, in bytes per second. Zero means no limit. It is safe to call at any
+// time, from any goroutine.
+func (t *TorrentSession) SetRateLimits(upload, download int64) {
+	t.uploadLimit.SetRate(upload)
+	t.downloadLimit.SetRate(download)
+}
+
+// RateLimits returns the limits set with SetRateLimits.
+func (t *TorrentSession) RateLimits() (upload, download int64) {
+	return t.uploadLimit.Rate(), t.downloadLimit.Rate()
+}
+
+// isComplete tells if we have all the pieces we want.
+func (t *TorrentSession) isComplete() bool {
+	return t.si.HaveTorrent && t.missingPieces == 0
+}
+
+// hasAllPieces tells if we have the whole torrent, skipped files included.
+func (t *TorrentSession) hasAllPieces() bool {
+	return t.si.HaveTorrent && t.goodPieces == t.totalPieces
+}
+
+// startSeeding is called when the last piece we want is downloaded. From then
+// on we only upload, until doneSeeding says we're done. The trackers are only
+// told we completed if we have the whole torrent.
+func (t *TorrentSession) startSeeding() {
+	t.seedingSince = time.Now()
+	if t.hasAllPieces() {
+		log.Println("Download complete. Seeding.")
+		t.fetchTrackerInfo("completed")
+	} else {
+		log.Println("Downloaded the files we want. Seeding what we have.")
+	}
+	t.saveResume()
+	for _, p := range t.peers {
+		p.SetInterested(false)
+	}
+}
+
+// doneSeeding tells if we reached the share ratio, of what we wanted, or the
+// seeding time limits.
+func (t *TorrentSession) doneSeeding() bool {
+	if seedRatio > 0 && float64(t.si.Uploaded) >= seedRatio*float64(t.wantedSize()) {
+		return true
+	}
+	if seedTime > 0 && time.Now().Sub(t.seedingSince) >= seedTime {
+		return true
+	}
+	return false
+}
+
+func isSeed(p *peerState) bool {
+	return p.have != nil && p.have.FindNextClear(0) == -1
+}
+
+// closeSeeds drops connections to other seeds, which neither of us needs.
+func (t *TorrentSession) closeSeeds() {
+	for _, p := range t.peers {
+		if isSeed(p) {
+			t.ClosePeer(p)
+		}
+	}
+}
+
+// shutdown leaves the swarm: the tracker is told we stopped, peers are
+// disconnected and the files closed.
+func (t *TorrentSession) shutdown() {
+	for _, p := range t.peers {
+		t.ClosePeer(p)
+	}
+	go t.drainPeerMessages()
+	if !t.paused {
+		// Else the trackers were told when we paused.
+		t.announceStopped()
+	}
+	if fs, ok := t.fileStore.(*fileStore); ok {
+		if err := fs.Sync(); err != nil {
+			log.Println("Could not sync files:", err)
+		}
+	}
+	if t.fileStore != nil {
+		// The last save is waited for, as the process may exit next.
+		t.resumeSaved(true)
+		t.saveResume()
+		t.resumeSaved(true)
+		t.fileStore.Close()
+	}
+}
+
+// Pause disconnects the peers and tells the trackers we stopped, but keeps
+// the session, with its files open, until Resume.
+func (t *TorrentSession) Pause() error {
+	if !t.call(t.pause) {
+		return errSessionDone
+	}
+	return nil
+}
+
+// Resume connects to peers again after Pause.
+func (t *TorrentSession) Resume() error {
+	if !t.call(t.resume) {
+		return errSessionDone
+	}
+	return nil
+}
+
+// Stop leaves the swarm like when we are done seeding: the trackers are told
+// we stopped, the peers are disconnected and the files closed. It waits for
+// DoTorrent to return. If DoTorrent wasn't called yet, Stop only closes the
+// files, and DoTorrent returns at once if it is called later.
+func (t *TorrentSession) Stop() {
+	t.stopOnce.Do(func() {
+		close(t.quit)
+		if atomic.CompareAndSwapInt32(&t.state, sessionNew, sessionStopped) {
+			if t.fileStore != nil {
+				t.fileStore.Close()
+			}
+			close(t.done)
+		}
+	})
+	<-t.done
+}
+
+func (t *TorrentSession) pause() {
+	if t.paused {
+		return
+	}
+	log.Println("Pausing torrent.")
+	t.paused = true
+	for _, p := range t.peers {
+		t.ClosePeer(p)
+	}
+	t.saveResume()
+	t.fetchTrackerInfo("stopped")
+}
+
+func (t *TorrentSession) resume() {
+	if !t.paused {
+		return
+	}
+	log.Println("Resuming torrent.")
+	t.paused = false
+	if t.useDHT() {
+		go t.dht.PeersRequest(t.m.InfoHash, true)
+	}
+	t.fetchTrackerInfo("started")
+	t.connectWebSeeds()
+}
+
+// drainPeerMessages lets the goroutines of closed peers deliver their last
+// messages and exit.
+func (t *TorrentSession) drainPeerMessages() {
+	for {
+		select {
+		case <-t.peerMessageChan:
+		case <-time.After(time.Minute):
+			return
+		}
+	}
+}
+
 func (t *TorrentSession) RequestBlock(p *peerState) (err error) {
 	for k, _ := range t.activePieces {
 		if p.have.IsSet(k) {
@@ -521,27 +840,6 @@ func (t *TorrentSession) RequestBlock(p *peerState) (err error) {
 	return
 }
 
-func (t *TorrentSession) ChoosePiece(p *peerState) (piece int) {
-	n := t.totalPieces
-	start := rand.Intn(n)
-	piece = t.checkRange(p, start, n)
-	if piece == -1 {
-		piece = t.checkRange(p, 0, start)
-	}
-	return
-}
-
-func (t *TorrentSession) checkRange(p *peerState, start, end int) (piece int) {
-	for i := start; i < end; i++ {
-		if (!t.pieceSet.IsSet(i)) && p.have.IsSet(i) {
-			if _, ok := t.activePieces[i]; !ok {
-				return i
-			}
-		}
-	}
-	return -1
-}
-
 func (t *TorrentSession) RequestBlock2(p *peerState, piece int, endGame bool) (err error) {
 	v := t.activePieces[piece]
 	block := v.chooseBlockToDownload(endGame)
@@ -605,33 +903,7 @@ func (t *TorrentSession) RecordBlock(p *peerState, piece, begin, length uint32)
 		t.si.Downloaded += int64(length)
 		if v.isComplete() {
 			delete(t.activePieces, int(piece))
-			ok, err = checkPiece(t.fileStore, t.totalSize, t.m, int(piece))
-			if !ok || err != nil {
-				log.Println("Ignoring bad piece", piece, err)
-				return
-			}
-			t.si.Left -= int64(v.pieceLength)
-			t.pieceSet.Set(int(piece))
-			t.goodPieces++
-			log.Println("Have", t.goodPieces, "of", t.totalPieces, "pieces.")
-			if t.goodPieces == t.totalPieces {
-				t.fetchTrackerInfo("completed")
-				// TODO: Drop connections to all seeders.
-			}
-			for _, p := range t.peers {
-				if p.have != nil {
-					if p.have.IsSet(int(piece)) {
-						// We don't do anything special. We rely on the caller
-						// to decide if this peer is still interesting.
-					} else {
-						// log.Println("...telling ", p)
-						haveMsg := make([]byte, 5)
-						haveMsg[0] = 4
-						uint32ToBytes(haveMsg[1:5], uint32(piece))
-						p.sendMessage(haveMsg)
-					}
-				}
-			}
+			t.verifyPiece(int(piece))
 		}
 	} else {
 		log.Println("Received a block we already have.", piece, block, p.address)
@@ -639,6 +911,103 @@ func (t *TorrentSession) RecordBlock(p *peerState, piece, begin, length uint32)
 	return
 }
 
+// verifyPiece checks the hash of a downloaded piece. Hashing is done in its
+// own goroutine, so it doesn't stall the main loop; pieceVerified gets the
+// result.
+func (t *TorrentSession) verifyPiece(piece int) {
+	t.verifying[piece] = true
+	fs, totalSize, m := t.fileStore, t.totalSize, t.m
+	go func() {
+		ok, err := checkPiece(fs, totalSize, m, piece)
+		select {
+		case t.pieceVerifiedChan <- pieceVerification{piece, ok, err}:
+		case <-t.done:
+		}
+	}()
+}
+
+type pieceVerification struct {
+	piece int
+	ok    bool
+	err   error
+}
+
+func (t *TorrentSession) pieceVerified(v pieceVerification) {
+	piece := v.piece
+	delete(t.verifying, piece)
+	if !v.ok || v.err != nil {
+		log.Println("Ignoring bad piece", piece, v.err)
+		return
+	}
+	// Its file may have been skipped since it was requested.
+	needed := t.needPiece(piece)
+	if needed {
+		t.si.Left -= t.wantedLengths[piece]
+		t.missingPieces--
+	}
+	t.pieceSet.Set(piece)
+	t.resumeDirty = true
+	t.goodPieces++
+	t.streamPieceDone(piece)
+	log.Println("Have", t.goodPieces, "of", t.totalPieces, "pieces.")
+	if needed && t.missingPieces == 0 {
+		t.startSeeding()
+	}
+	for _, p := range t.peers {
+		if p.have != nil {
+			if p.have.IsSet(piece) {
+				// We don't do anything special. We rely on the caller
+				// to decide if this peer is still interesting.
+			} else {
+				// log.Println("...telling ", p)
+				haveMsg := make([]byte, 5)
+				haveMsg[0] = 4
+				uint32ToBytes(haveMsg[1:5], uint32(piece))
+				p.sendMessage(haveMsg)
+			}
+		}
+	}
+}
+
+// useDHT tells if the DHT can be used for this torrent.
+func (t *TorrentSession) useDHT() bool {
+	return t.m.Info.Private != 1 && t.dht != nil
+}
+
+// sendBitfield tells the peer which pieces we have.
+func (t *TorrentSession) sendBitfield(p *peerState) {
+	p.sendMessage(append([]byte{BITFIELD}, t.pieceSet.b...))
+}
+
+// sendPort tells the peer on which port our DHT node listens.
+func (t *TorrentSession) sendPort(p *peerState) {
+	port := t.dht.Port()
+	if port <= 0 || port > 65535 {
+		return
+	}
+	p.sendMessage([]byte{PORT, byte(port >> 8), byte(port)})
+}
+
+// doPort adds the peer's DHT node, whose port is in the message, to our
+// routing table.
+func (t *TorrentSession) doPort(p *peerState, message []byte) (err error) {
+	if len(message) != 3 {
+		return errors.New(fmt.Sprintf("Unexpected length for port message: %d", len(message)))
+	}
+	port := int(message[1])<<8 | int(message[2])
+	if !t.useDHT() || port == 0 {
+		return
+	}
+	host, _, err := net.SplitHostPort(p.address)
+	if err != nil {
+		return
+	}
+	// It's OK if we know this node already. The DHT engine will ignore it
+	// accordingly.
+	go t.dht.RemoteNodeAcquaintance(net.JoinHostPort(host, strconv.Itoa(port)))
+	return
+}
+
 func (t *TorrentSession) doChoke(p *peerState) (err error) {
 	p.peer_choking = true
 	err = t.removeRequests(p)
@@ -683,25 +1052,30 @@ func (t *TorrentSession) DoMessage(p *peerState, message []byte) (err error) {
 	}
 	if len(p.id) == 0 {
 		// This is the header message from the peer.
-		if t.m.Info.Private != 1 && useDHT {
-			// If 128, then it supports DHT.
-			if int(message[7])&0x01 == 0x01 {
-				// It's OK if we know this node already. The DHT engine will
-				// ignore it accordingly.
-				go t.dht.RemoteNodeAcquaintance(p.address)
-			}
-		}
-
 		peersInfoHash := string(message[8:28])
 		if peersInfoHash != t.m.InfoHash {
 			return errors.New("this peer doesn't have the right info hash")
 		}
 		p.id = string(message[28:48])
+		// The bitfield must be the first message after the handshake.
+		if t.si.HaveTorrent && t.goodPieces > 0 {
+			t.sendBitfield(p)
+		}
+		if int(message[5])&0x10 == 0x10 {
+			t.sendExtendedHandshake(p)
+		}
+		// If the last bit is set, the peer runs a DHT node too.
+		if int(message[7])&0x01 == 0x01 && t.useDHT() {
+			t.sendPort(p)
+		}
 	} else {
 		if len(message) == 0 { // keep alive
 			return
 		}
 		messageId := message[0]
+		if !t.si.HaveTorrent {
+			return t.doMessageWithoutMetadata(p, message)
+		}
 		// Message 5 is optional, but must be sent as the first message.
 		if p.have == nil && messageId != 5 {
 			// Fill out the have bitfield
@@ -732,7 +1106,7 @@ func (t *TorrentSession) DoMessage(p *peerState, message []byte) (err error) {
 				return errors.New("Unexpected length")
 			}
 			p.peer_interested = true
-			// TODO: Consider unchoking
+			t.unchokeIfSlotFree(p)
 		case NOT_INTERESTED:
 			// log.Println("not interested", p)
 			if len(message) != 1 {
@@ -745,8 +1119,11 @@ func (t *TorrentSession) DoMessage(p *peerState, message []byte) (err error) {
 			}
 			n := bytesToUint32(message[1:])
 			if n < uint32(p.have.n) {
+				if !p.have.IsSet(int(n)) {
+					t.pieceAvailability[n]++
+				}
 				p.have.Set(int(n))
-				if !p.am_interested && !t.pieceSet.IsSet(int(n)) {
+				if !p.am_interested && t.needPiece(int(n)) {
 					p.SetInterested(true)
 				}
 			} else {
@@ -761,6 +1138,7 @@ func (t *TorrentSession) DoMessage(p *peerState, message []byte) (err error) {
 			if p.have == nil {
 				return errors.New("Invalid bitfield data.")
 			}
+			t.addAvailability(p.have)
 			t.checkInteresting(p)
 		case REQUEST:
 			// log.Println("request", p.address)
@@ -817,6 +1195,8 @@ func (t *TorrentSession) DoMessage(p *peerState, message []byte) (err error) {
 			if err != nil {
 				return err
 			}
+			p.downloaded += int64(length)
+			p.lastPieceTime = time.Now()
 			t.RecordBlock(p, index, begin, uint32(length))
 			err = t.RequestBlock(p)
 		case CANCEL:
@@ -844,13 +1224,9 @@ func (t *TorrentSession) DoMessage(p *peerState, message []byte) (err error) {
 			}
 			p.CancelRequest(index, begin, length)
 		case PORT:
-			// TODO: Implement this message.
-			// We see peers sending us 16K byte messages here, so
-			// it seems that we don't understand what this is.
-			if len(message) != 3 {
-				return errors.New(fmt.Sprintf("Unexpected length for port message:", len(message)))
-			}
-			go t.dht.RemoteNodeAcquaintance(p.address)
+			return t.doPort(p, message)
+		case EXTENSION:
+			return t.doExtension(p, message[1:])
 		default:
 			return errors.New("Uknown message id")
 		}
@@ -871,6 +1247,7 @@ func (t *TorrentSession) sendRequest(peer *peerState, index, begin, length uint3
 			return
 		}
 		peer.sendMessage(buf)
+		peer.uploaded += int64(length)
 		t.si.Uploaded += int64(length)
 	}
 	return
@@ -882,7 +1259,7 @@ func (t *TorrentSession) checkInteresting(p *peerState) {
 
 func (t *TorrentSession) isInteresting(p *peerState) bool {
 	for i := 0; i < t.totalPieces; i++ {
-		if !t.pieceSet.IsSet(i) && p.have.IsSet(i) {
+		if t.needPiece(i) && p.have.IsSet(i) {
 			return true
 		}
 	}
@@ -0,0 +1,264 @@
+package taipei
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// createTestTorrent writes data to a file named content in dir, and a
+// torrent of it. It returns the path of the torrent.
+func createTestTorrent(t *testing.T, dir string, data []byte, opts *CreateOptions) string {
+	content := filepath.Join(dir, "content")
+	if err := ioutil.WriteFile(content, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	torrent := filepath.Join(dir, "content.torrent")
+	f, err := os.Create(torrent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = CreateTorrent(f, content, opts)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return torrent
+}
+
+// newTestSession makes a session of a torrent with the info dictionary, that
+// has the pieces in have. Its main loop only runs calls, until stop is
+// called.
+func newTestSession(info InfoDict, fs *fileStore, have ...int) (ts *TorrentSession, stop func()) {
+	ts = &TorrentSession{m: &MetaInfo{Info: info, InfoHash: strings.Repeat("x", 20)},
+		si:           &SessionInfo{HaveTorrent: true},
+		fileStore:    fs,
+		peers:        make(map[string]*peerState),
+		streamPieces: make(map[int]int),
+		pieceWaiters: make(map[int][]chan bool),
+		calls:        make(chan func()),
+		done:         make(chan bool)}
+	for _, l := range fileLengths(&info) {
+		ts.totalSize += l
+	}
+	ts.totalPieces = int((ts.totalSize + info.PieceLength - 1) / info.PieceLength)
+	ts.pieceSet = NewBitset(ts.totalPieces)
+	for _, piece := range have {
+		ts.pieceSet.Set(piece)
+	}
+	ts.setPriorities()
+	for i := 0; i < ts.totalPieces; i++ {
+		if ts.needPiece(i) {
+			ts.si.Left += ts.wantedLengths[i]
+			ts.missingPieces++
+		} else {
+			ts.goodPieces++
+		}
+	}
+	go func() {
+		for {
+			select {
+			case f := <-ts.calls:
+				f()
+			case <-ts.done:
+				return
+			}
+		}
+	}()
+	return ts, func() { close(ts.done) }
+}
+
+// useFileDir makes sessions keep their files in dir, without resume files.
+// It returns the function that restores the flags.
+func useFileDir(dir string) func() {
+	oldFileDir, oldResumeDir := fileDir, resumeDir
+	fileDir, resumeDir = dir, ""
+	return func() { fileDir, resumeDir = oldFileDir, oldResumeDir }
+}
+
+func TestSeedServesNewPeers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "taipei-seed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := bytes.Repeat([]byte("0123456789"), 5000)
+	torrent := createTestTorrent(t, dir, data, &CreateOptions{PieceLength: 16384})
+	defer useFileDir(dir)()
+	ts, err := NewTorrentSession(torrent, 6881)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ts.DoTorrent()
+	defer ts.Stop()
+
+	// A peer connects once we are complete.
+	conn, ours := net.Pipe()
+	defer conn.Close()
+	ts.call(func() { ts.AddPeer(ours) })
+	var header [68]byte
+	copy(header[:], kBitTorrentHeader)
+	copy(header[28:48], ts.m.InfoHash)
+	copy(header[48:68], "-xx0000-abcdefghijkl")
+	go conn.Write(header[:])
+	var theirs [68]byte
+	if _, err = io.ReadFull(conn, theirs[:]); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	readMessage := func() []byte {
+		for {
+			n, err := readNBOUint32(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg := make([]byte, n)
+			if _, err = io.ReadFull(conn, msg); err != nil {
+				t.Fatal(err)
+			}
+			if n > 0 {
+				return msg
+			}
+		}
+	}
+	// Writes block until the session reads, so they run in goroutines. Their
+	// errors show up as failed reads.
+	writeMessage := func(msg []byte) {
+		if writeNBOUint32(conn, uint32(len(msg))) == nil {
+			conn.Write(msg)
+		}
+	}
+
+	// 4 pieces, all set.
+	if msg := readMessage(); !bytes.Equal(msg, []byte{BITFIELD, 0xf0}) {
+		t.Fatalf("Got %x instead of the bitfield", msg)
+	}
+	go writeMessage([]byte{INTERESTED})
+	for msg := readMessage(); msg[0] != UNCHOKE; msg = readMessage() {
+	}
+	request := make([]byte, 13)
+	request[0] = REQUEST
+	uint32ToBytes(request[1:5], 1)
+	uint32ToBytes(request[5:9], 0)
+	uint32ToBytes(request[9:13], STANDARD_BLOCK_LENGTH)
+	go writeMessage(request)
+	msg := readMessage()
+	for ; msg[0] != PIECE; msg = readMessage() {
+	}
+	if bytesToUint32(msg[1:5]) != 1 || bytesToUint32(msg[5:9]) != 0 ||
+		!bytes.Equal(msg[9:], data[16384:2*16384]) {
+		t.Errorf("Got the wrong block: %q", msg)
+	}
+}
+
+func TestSessionLifecycle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "taipei-lifecycle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	events := make(chan string, 10)
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		events <- r.URL.Query().Get("event")
+		fmt.Fprint(w, "d8:intervali900e5:peers0:e")
+	}))
+	defer tracker.Close()
+
+	torrent := createTestTorrent(t, dir, []byte("some data to share"), &CreateOptions{
+		AnnounceList: [][]string{{tracker.URL}}})
+	defer useFileDir(dir)()
+
+	expect := func(want string) {
+		select {
+		case got := <-events:
+			if got != want {
+				t.Fatalf("Got event %q, wanted %q", got, want)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("No %q event", want)
+		}
+	}
+	// waitAnnounced waits for the session to record the answer of the
+	// tracker, so it knows to send the stopped event.
+	waitAnnounced := func(ts *TorrentSession) {
+		for {
+			var announced bool
+			ts.call(func() { announced = !ts.announcing })
+			if announced {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	start := func(ctx context.Context) (*TorrentSession, chan error) {
+		ts, err := NewTorrentSession(torrent, 6881)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result := make(chan error, 1)
+		go func() { result <- ts.DoTorrentContext(ctx) }()
+		expect("started")
+		waitAnnounced(ts)
+		return ts, result
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ts, result := start(ctx)
+	if err = ts.Pause(); err != nil {
+		t.Fatal(err)
+	}
+	expect("stopped")
+	if s, err := ts.Status(); err != nil || s.State != "paused" {
+		t.Errorf("Got %+v, %v after pausing", s, err)
+	}
+	if err = ts.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	expect("started")
+	waitAnnounced(ts)
+	if s, err := ts.Status(); err != nil || s.State != "seeding" {
+		t.Errorf("Got %+v, %v after resuming", s, err)
+	}
+	cancel()
+	if err = <-result; err != context.Canceled {
+		t.Errorf("DoTorrentContext returned %v", err)
+	}
+	expect("stopped")
+	if _, err = ts.fileStore.ReadAt(make([]byte, 1), 0); err == nil {
+		t.Errorf("The files are still open")
+	}
+	if err = ts.Pause(); err != errSessionDone {
+		t.Errorf("Pause returned %v once the session was over", err)
+	}
+
+	ts, result = start(context.Background())
+	ts.Stop()
+	if err = <-result; err != nil {
+		t.Errorf("DoTorrentContext returned %v", err)
+	}
+	expect("stopped")
+	ts.Stop() // Does nothing.
+
+	// Stopped before it runs.
+	ts, err = NewTorrentSession(torrent, 6881)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.Stop()
+	if err = ts.DoTorrent(); err != errSessionDone {
+		t.Errorf("DoTorrent returned %v after Stop", err)
+	}
+	if _, err = ts.fileStore.ReadAt(make([]byte, 1), 0); err == nil {
+		t.Errorf("The files are still open")
+	}
+}
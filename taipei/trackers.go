@@ -0,0 +1,349 @@
+package taipei
+
+// Talking to trackers. A torrent can have several trackers, in tiers. We
+// announce to one tracker at a time, trying them in order until one answers.
+// The tracker that answered moves to the front of its tier, so we keep using
+// it.
+//
+// References:
+// - http://bittorrent.org/beps/bep_0003.html
+// - http://bittorrent.org/beps/bep_0012.html
+
+import (
+	"errors"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// How many times lost UDP packets are sent again in an announce. The timeouts
+// of BEP 15 would otherwise keep us waiting for hours on a dead tracker, with
+// no other announce able to start meanwhile.
+const udpFailoverRetries = 2
+
+const (
+	// How long an HTTP announce can take.
+	trackerTimeout = time.Minute
+	// Limits of the announce interval trackers ask for.
+	minAnnounceInterval = 2 * time.Minute
+	maxAnnounceInterval = 24 * time.Hour
+	// How long to wait before announcing again when no tracker answered.
+	// It doubles with each failure.
+	firstRetryDelay = 20 * time.Second
+	maxRetryDelay   = 30 * time.Minute
+)
+
+var trackerClient = &http.Client{Timeout: trackerTimeout}
+
+// trackerState is what we know about one tracker. It belongs to the main
+// loop of the session.
+type trackerState struct {
+	url          string
+	lastAnnounce time.Time     // Last successful announce.
+	interval     time.Duration // As asked by the tracker.
+	failures     int           // Failed announces since the last success.
+	trackerId    string        // To send back in later announces.
+}
+
+// trackerAnswer is the result of trying the trackers in order.
+type trackerAnswer struct {
+	tracker  *trackerState // The tracker that answered, nil if none did.
+	response *TrackerResponse
+	failed   []*trackerState
+	stopped  bool // The answer to a stopped event; there is nothing to record.
+}
+
+// newTrackerTiers makes the tracker list of a torrent: its announce-list if
+// it has one, its announce URL otherwise. The trackers of each tier are
+// shuffled.
+func newTrackerTiers(m *MetaInfo) (tiers [][]*trackerState) {
+	list := m.AnnounceList
+	if len(list) == 0 && m.Announce != "" {
+		list = [][]string{{m.Announce}}
+	}
+	for _, urls := range list {
+		var tier []*trackerState
+		for _, u := range urls {
+			if u != "" {
+				tier = append(tier, &trackerState{url: u})
+			}
+		}
+		for i := range tier {
+			j := rand.Intn(i + 1)
+			tier[i], tier[j] = tier[j], tier[i]
+		}
+		if len(tier) > 0 {
+			tiers = append(tiers, tier)
+		}
+	}
+	return
+}
+
+// promoteTracker moves tr to the front of its tier.
+func (t *TorrentSession) promoteTracker(tr *trackerState) {
+	for _, tier := range t.trackers {
+		for i, x := range tier {
+			if x == tr {
+				copy(tier[1:i+1], tier[:i])
+				tier[0] = tr
+				return
+			}
+		}
+	}
+}
+
+func (t *TorrentSession) fetchTrackerInfo(event string) {
+	if len(t.trackers) == 0 {
+		return
+	}
+	if t.announcing {
+		// One announce at a time, so the trackers get the events in order
+		// and only one answer moves a tracker in its tier. Regular announces
+		// are skipped, events wait for the running announce.
+		if event != "" {
+			t.pendingEvents = append(t.pendingEvents, event)
+		}
+		return
+	}
+	if event == "" && time.Now().Before(t.retryAt) {
+		return
+	}
+	t.announcing = true
+	ch := t.trackerInfoChan
+	if event == "stopped" {
+		answered, n := t.sendStopped()
+		go func() {
+			timeout := time.After(stoppedAnnounceTimeout)
+		wait:
+			for ; n > 0; n-- {
+				select {
+				case <-answered:
+				case <-timeout:
+					break wait
+				}
+			}
+			select {
+			case ch <- &trackerAnswer{stopped: true}:
+			case <-t.done:
+			}
+		}()
+		return
+	}
+	// The goroutine only gets copies of what it needs.
+	var trackers []*trackerState
+	var params []*announceParams
+	for _, tier := range t.trackers {
+		for _, tr := range tier {
+			a := t.announceParams(event, tr)
+			a.udpRetries = udpFailoverRetries
+			trackers = append(trackers, tr)
+			params = append(params, a)
+		}
+	}
+	log.Println("Stats: Uploaded", t.si.Uploaded, "Downloaded", t.si.Downloaded, "Left", t.si.Left)
+	go func() {
+		answer := &trackerAnswer{}
+		for i, tr := range trackers {
+			ti, err := queryTracker(tr.url, params[i])
+			if err == nil && ti.FailureReason != "" {
+				err = errors.New("failure reason: " + ti.FailureReason)
+			}
+			if err != nil {
+				log.Println("Error: Could not fetch tracker info from", tr.url, err)
+				answer.failed = append(answer.failed, tr)
+				continue
+			}
+			if ti.WarningMessage != "" {
+				log.Println("Tracker", tr.url, "warning:", ti.WarningMessage)
+			}
+			answer.tracker, answer.response = tr, ti
+			break
+		}
+		select {
+		case ch <- answer:
+		case <-t.done:
+		}
+	}()
+}
+
+// trackerAnswered records the result of fetchTrackerInfo. It returns the
+// tracker response, or nil if no tracker answered. The next event waiting
+// for the announce is sent.
+func (t *TorrentSession) trackerAnswered(answer *trackerAnswer) *TrackerResponse {
+	t.announcing = false
+	defer t.announcePending()
+	if answer.stopped {
+		return nil
+	}
+	for _, tr := range answer.failed {
+		tr.failures++
+	}
+	tr := answer.tracker
+	if tr == nil {
+		return nil
+	}
+	ti := answer.response
+	tr.lastAnnounce = time.Now()
+	tr.interval = ti.Interval * time.Second
+	tr.failures = 0
+	if ti.TrackerId != "" {
+		tr.trackerId = ti.TrackerId
+	}
+	t.promoteTracker(tr)
+	t.setScrapeURL(tr.url)
+	return ti
+}
+
+// announcePending sends the first event that waited for the last announce.
+func (t *TorrentSession) announcePending() {
+	if len(t.pendingEvents) > 0 {
+		event := t.pendingEvents[0]
+		t.pendingEvents = t.pendingEvents[1:]
+		t.fetchTrackerInfo(event)
+	}
+}
+
+// nextAnnounce returns how long to wait before announcing again after
+// answer: the interval the tracker that answered asked for or, if none did,
+// a delay that grows with the failures of the trackers.
+func nextAnnounce(answer *trackerAnswer) time.Duration {
+	if tr := answer.tracker; tr != nil {
+		d := tr.interval
+		if d < minAnnounceInterval {
+			d = minAnnounceInterval
+		} else if d > maxAnnounceInterval {
+			d = maxAnnounceInterval
+		}
+		return d
+	}
+	failures := 0
+	for i, tr := range answer.failed {
+		if i == 0 || tr.failures < failures {
+			failures = tr.failures
+		}
+	}
+	d := firstRetryDelay
+	for i := 1; i < failures && d < maxRetryDelay; i++ {
+		d *= 2
+	}
+	if d > maxRetryDelay {
+		d = maxRetryDelay
+	}
+	return d
+}
+
+// announceStopped tells the trackers we are leaving. It waits a little for
+// them to answer, so the requests aren't lost when the process exits.
+func (t *TorrentSession) announceStopped() {
+	timeout := time.After(stoppedAnnounceTimeout)
+	// The running announce may make a tracker know about us, so it goes
+	// first. The events waiting for it don't matter anymore.
+	t.pendingEvents = nil
+	if t.announcing {
+		select {
+		case answer := <-t.trackerInfoChan:
+			t.trackerAnswered(answer)
+		case <-timeout:
+			log.Println("Trackers didn't answer the stopped event in time.")
+			return
+		}
+	}
+	answered, n := t.sendStopped()
+	for ; n > 0; n-- {
+		select {
+		case <-answered:
+		case <-timeout:
+			log.Println("Trackers didn't answer the stopped event in time.")
+			return
+		}
+	}
+}
+
+// sendStopped sends the stopped event to the n trackers that know about us,
+// without waiting. Each answer, or failure, is signaled on answered.
+func (t *TorrentSession) sendStopped() (answered chan bool, n int) {
+	for _, tier := range t.trackers {
+		n += len(tier)
+	}
+	// Room for every answer, so late ones don't block.
+	answered = make(chan bool, n)
+	n = 0
+	for _, tier := range t.trackers {
+		for _, tr := range tier {
+			if tr.lastAnnounce.IsZero() {
+				// It doesn't know about us.
+				continue
+			}
+			n++
+			go func(u string, a *announceParams) {
+				if _, err := queryTracker(u, a); err != nil {
+					log.Println("Error: Could not announce stop to tracker", u, err)
+				}
+				answered <- true
+			}(tr.url, t.announceParams("stopped", tr))
+		}
+	}
+	return
+}
+
+// announceParams is what we tell a tracker about a session. It is a copy, so
+// trackers can be contacted without touching the session.
+type announceParams struct {
+	infoHash   string
+	si         SessionInfo
+	event      string
+	trackerId  string
+	udpRetries uint // How many times lost UDP packets are sent again.
+}
+
+func (t *TorrentSession) announceParams(event string, tr *trackerState) *announceParams {
+	return &announceParams{t.m.InfoHash, *t.si, event, tr.trackerId, 0}
+}
+
+// queryTracker announces to the tracker, over HTTP or UDP depending on the
+// scheme of its URL.
+func queryTracker(announce string, a *announceParams) (tr *TrackerResponse, err error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return nil, errors.New("Invalid announce URL " + announce + ": " + err.Error())
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return getTrackerInfo(httpAnnounceURL(u, a))
+	case "udp":
+		return udpAnnounce(u.Host, a)
+	}
+	return nil, errors.New("Unsupported tracker URL scheme: " + announce)
+}
+
+// httpAnnounceURL returns the URL of the announce request to the HTTP tracker
+// at u.
+func httpAnnounceURL(u *url.URL, a *announceParams) string {
+	si := a.si
+	uq := u.Query()
+	uq.Add("info_hash", a.infoHash)
+	uq.Add("peer_id", si.PeerId)
+	uq.Add("port", strconv.Itoa(si.Port))
+	uq.Add("uploaded", strconv.FormatInt(si.Uploaded, 10))
+	uq.Add("downloaded", strconv.FormatInt(si.Downloaded, 10))
+	uq.Add("left", strconv.FormatInt(si.Left, 10))
+	uq.Add("compact", "1")
+
+	if a.event != "" {
+		uq.Add("event", a.event)
+	}
+	if a.trackerId != "" {
+		uq.Add("trackerid", a.trackerId)
+	}
+
+	// This might reorder the existing query string in the Announce url
+	// I worry this might break some broken trackers that don't parse URLs
+	// properly.
+
+	announce := *u
+	announce.RawQuery = uq.Encode()
+	return announce.String()
+}
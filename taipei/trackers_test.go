@@ -0,0 +1,160 @@
+package taipei
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+)
+
+func trackerURLs(tiers [][]*trackerState) (urls [][]string) {
+	for _, tier := range tiers {
+		var u []string
+		for _, tr := range tier {
+			u = append(u, tr.url)
+		}
+		urls = append(urls, u)
+	}
+	return
+}
+
+func TestNewTrackerTiers(t *testing.T) {
+	m := &MetaInfo{Announce: "http://a/announce",
+		AnnounceList: [][]string{{"http://a/announce", "http://b/announce", ""}, {}, {"udp://c:80"}}}
+	urls := trackerURLs(newTrackerTiers(m))
+	if len(urls) != 2 || len(urls[0]) != 2 || len(urls[1]) != 1 || urls[1][0] != "udp://c:80" {
+		t.Fatalf("Unexpected tiers %v", urls)
+	}
+	sort.Strings(urls[0])
+	if urls[0][0] != "http://a/announce" || urls[0][1] != "http://b/announce" {
+		t.Errorf("Unexpected first tier %v", urls[0])
+	}
+
+	// Without announce-list.
+	m.AnnounceList = nil
+	urls = trackerURLs(newTrackerTiers(m))
+	if len(urls) != 1 || len(urls[0]) != 1 || urls[0][0] != m.Announce {
+		t.Errorf("Unexpected tiers %v", urls)
+	}
+}
+
+func TestTrackerFailover(t *testing.T) {
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "d14:failure reason4:nopee")
+	}))
+	defer broken.Close()
+	var gotTrackerId string
+	working := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotTrackerId = r.URL.Query().Get("trackerid")
+		fmt.Fprint(w, "d8:intervali900e10:tracker id3:xyz5:peers6:\x7f\x00\x00\x01\x1a\xe1e")
+	}))
+	defer working.Close()
+
+	t1 := &trackerState{url: broken.URL}
+	t2 := &trackerState{url: "udp://127.0.0.1:0"} // Can't be reached.
+	t3 := &trackerState{url: working.URL}
+	ts := &TorrentSession{m: &MetaInfo{InfoHash: "abcdefghijabcdefghij"},
+		si:              &SessionInfo{PeerId: "-tt1234-abcdefghijkl", Port: 6881},
+		trackers:        [][]*trackerState{{t1, t2}, {t3}},
+		trackerInfoChan: make(chan *trackerAnswer),
+		done:            make(chan bool)}
+	defer close(ts.done)
+
+	for i := 0; i < 2; i++ {
+		ts.fetchTrackerInfo("")
+		ti := ts.trackerAnswered(<-ts.trackerInfoChan)
+		if ti == nil || ti.Peers != "\x7f\x00\x00\x01\x1a\xe1" {
+			t.Fatalf("Unexpected tracker response %+v", ti)
+		}
+	}
+	if t1.failures != 2 || t2.failures != 2 || t3.failures != 0 {
+		t.Errorf("Unexpected failure counts %d %d %d", t1.failures, t2.failures, t3.failures)
+	}
+	if t3.trackerId != "xyz" || gotTrackerId != "xyz" {
+		t.Errorf("Tracker id not kept: stored %q, sent %q", t3.trackerId, gotTrackerId)
+	}
+	if t3.lastAnnounce.IsZero() || t3.interval.Seconds() != 900 {
+		t.Errorf("Unexpected tracker state %+v", t3)
+	}
+
+	// The working tracker moves to the front of its tier.
+	ts.trackers = [][]*trackerState{{t1, t2, t3}}
+	ts.promoteTracker(t3)
+	if urls := trackerURLs(ts.trackers); urls[0][0] != t3.url || urls[0][1] != t1.url || urls[0][2] != t2.url {
+		t.Errorf("Unexpected order after promotion: %v", urls)
+	}
+}
+
+func TestNextAnnounce(t *testing.T) {
+	answered := &trackerAnswer{tracker: &trackerState{interval: 30 * time.Minute}}
+	if d := nextAnnounce(answered); d != 30*time.Minute {
+		t.Errorf("Got %v after an answer", d)
+	}
+	answered.tracker.interval = time.Second
+	if d := nextAnnounce(answered); d != minAnnounceInterval {
+		t.Errorf("Got %v for a short interval", d)
+	}
+	for _, c := range []struct {
+		failures []int
+		want     time.Duration
+	}{
+		{[]int{1}, firstRetryDelay},
+		{[]int{3, 2}, 2 * firstRetryDelay},
+		{[]int{4}, 8 * firstRetryDelay},
+		{[]int{50}, maxRetryDelay},
+	} {
+		failed := &trackerAnswer{}
+		for _, f := range c.failures {
+			failed.failed = append(failed.failed, &trackerState{failures: f})
+		}
+		if d := nextAnnounce(failed); d != c.want {
+			t.Errorf("Got %v after %v failures, wanted %v", d, c.failures, c.want)
+		}
+	}
+}
+
+func TestAnnounceEventsInOrder(t *testing.T) {
+	events := make(chan string, 10)
+	release := make(chan bool)
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		events <- r.URL.Query().Get("event")
+		<-release
+		fmt.Fprint(w, "d8:intervali900e5:peers0:e")
+	}))
+	defer tracker.Close()
+	defer close(release)
+
+	ts := &TorrentSession{m: &MetaInfo{InfoHash: "abcdefghijabcdefghij"},
+		si:              &SessionInfo{PeerId: "-tt1234-abcdefghijkl", Port: 6881},
+		trackers:        [][]*trackerState{{{url: tracker.URL}}},
+		trackerInfoChan: make(chan *trackerAnswer),
+		done:            make(chan bool)}
+	defer close(ts.done)
+
+	// The events sent during the started announce wait for it; the regular
+	// announce is skipped.
+	ts.fetchTrackerInfo("started")
+	ts.fetchTrackerInfo("")
+	ts.fetchTrackerInfo("completed")
+	ts.fetchTrackerInfo("stopped")
+	for _, want := range []string{"started", "completed", "stopped"} {
+		if got := <-events; got != want {
+			t.Fatalf("Got event %q, wanted %q", got, want)
+		}
+		select {
+		case got := <-events:
+			t.Fatalf("Got event %q during the %q announce", got, want)
+		case <-time.After(50 * time.Millisecond):
+		}
+		release <- true
+		answer := <-ts.trackerInfoChan
+		if ti := ts.trackerAnswered(answer); (ti == nil) != (want == "stopped") {
+			t.Errorf("Got tracker response %+v for %q", ti, want)
+		}
+	}
+	if ts.announcing || len(ts.pendingEvents) != 0 {
+		t.Errorf("Still announcing %v", ts.pendingEvents)
+	}
+}
@@ -0,0 +1,268 @@
+package taipei
+
+// UDP tracker protocol.
+//
+// References:
+// - http://bittorrent.org/beps/bep_0015.html
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	udpProtocolId = 0x41727101980
+
+	udpActionConnect  = 0
+	udpActionAnnounce = 1
+	udpActionScrape   = 2
+	udpActionError    = 3
+
+	// We may keep using a connection id for a minute after getting it.
+	udpConnectionIdLifetime = time.Minute
+	// A request is sent again after 15 * 2 ^ n seconds without an answer,
+	// up to n = 8.
+	udpMaxRetries = 8
+	// Number of info hashes that fit in a scrape request.
+	udpMaxScrapeHashes = 74
+)
+
+// Changed by tests.
+var udpBaseTimeout = 15 * time.Second
+
+var errUDPTimeout = errors.New("UDP tracker timed out")
+
+// The trackers' connection ids, so we don't have to connect before every
+// announce.
+var udpConnectionIds struct {
+	sync.Mutex
+	m map[string]udpConnectionId // key: tracker host:port
+}
+
+type udpConnectionId struct {
+	id  uint64
+	got time.Time
+}
+
+// Event numbers, by the name used with HTTP trackers.
+var udpEvents = map[string]uint32{
+	"":          0,
+	"completed": 1,
+	"started":   2,
+	"stopped":   3,
+}
+
+type udpTracker struct {
+	host string // host:port
+	conn net.Conn
+}
+
+func dialUDPTracker(host string) (u *udpTracker, err error) {
+	conn, err := net.Dial("udp", host)
+	if err != nil {
+		return
+	}
+	return &udpTracker{host, conn}, nil
+}
+
+func (u *udpTracker) Close() error {
+	return u.conn.Close()
+}
+
+// udpAnnounce announces to the UDP tracker at host. The answer is converted
+// to what an HTTP tracker would have said.
+func udpAnnounce(host string, a *announceParams) (tr *TrackerResponse, err error) {
+	u, err := dialUDPTracker(host)
+	if err != nil {
+		return
+	}
+	defer u.Close()
+
+	var b bytes.Buffer
+	b.WriteString(a.infoHash)
+	b.WriteString(a.si.PeerId)
+	binary.Write(&b, binary.BigEndian, a.si.Downloaded)
+	binary.Write(&b, binary.BigEndian, a.si.Left)
+	binary.Write(&b, binary.BigEndian, a.si.Uploaded)
+	binary.Write(&b, binary.BigEndian, udpEvents[a.event])
+	binary.Write(&b, binary.BigEndian, uint32(0)) // IP: the sender's.
+	// The key lets the tracker recognize us if our IP changes.
+	binary.Write(&b, binary.BigEndian, crc32.ChecksumIEEE([]byte(a.si.PeerId)))
+	binary.Write(&b, binary.BigEndian, int32(-1)) // num_want: default.
+	binary.Write(&b, binary.BigEndian, uint16(a.si.Port))
+
+	resp, err := u.request(udpActionAnnounce, b.Bytes(), a.udpRetries)
+	if err != nil {
+		return
+	}
+	if len(resp) < 12 {
+		return nil, errors.New("UDP tracker announce answer too short")
+	}
+	tr = &TrackerResponse{
+		// In seconds, like the HTTP answer.
+		Interval:   time.Duration(binary.BigEndian.Uint32(resp[0:4])),
+		Incomplete: int(binary.BigEndian.Uint32(resp[4:8])),
+		Complete:   int(binary.BigEndian.Uint32(resp[8:12])),
+	}
+	// Trackers we talk to over IPv6 answer with IPv6 peers.
+	if addr, ok := u.conn.RemoteAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		tr.Peers6 = string(resp[12:])
+	} else {
+		tr.Peers = string(resp[12:])
+	}
+	return
+}
+
+// udpScrape asks the UDP tracker at host about the torrents with the given
+// info hashes. Hashes the tracker said nothing about are missing from the
+// result.
+func udpScrape(host string, infoHashes []string) (result map[string]ScrapeInfo, err error) {
+	u, err := dialUDPTracker(host)
+	if err != nil {
+		return
+	}
+	defer u.Close()
+
+	result = make(map[string]ScrapeInfo, len(infoHashes))
+	for len(infoHashes) > 0 {
+		batch := infoHashes
+		if len(batch) > udpMaxScrapeHashes {
+			batch = batch[:udpMaxScrapeHashes]
+		}
+		infoHashes = infoHashes[len(batch):]
+
+		var resp []byte
+		resp, err = u.request(udpActionScrape, []byte(joinStrings(batch)), udpMaxRetries)
+		if err != nil {
+			return nil, err
+		}
+		for i, ih := range batch {
+			if len(resp) < 12*(i+1) {
+				break
+			}
+			r := resp[12*i:]
+			result[ih] = ScrapeInfo{
+				Complete:   int(binary.BigEndian.Uint32(r[0:4])),
+				Downloaded: int(binary.BigEndian.Uint32(r[4:8])),
+				Incomplete: int(binary.BigEndian.Uint32(r[8:12])),
+			}
+		}
+	}
+	return
+}
+
+func joinStrings(a []string) string {
+	var b bytes.Buffer
+	for _, s := range a {
+		b.WriteString(s)
+	}
+	return b.String()
+}
+
+// request sends an action with its arguments to the tracker, connecting
+// first if needed, and returns the payload of the answer. Lost packets are
+// sent again with growing timeouts, up to retries times.
+func (u *udpTracker) request(action uint32, args []byte, retries uint) (resp []byte, err error) {
+	for n := uint(0); n <= retries; n++ {
+		timeout := udpBaseTimeout << n
+		var connectionId uint64
+		connectionId, err = u.connectionId(timeout)
+		if err == errUDPTimeout {
+			continue
+		} else if err != nil {
+			return
+		}
+		var b bytes.Buffer
+		binary.Write(&b, binary.BigEndian, connectionId)
+		binary.Write(&b, binary.BigEndian, action)
+		tid := rand.Uint32()
+		binary.Write(&b, binary.BigEndian, tid)
+		b.Write(args)
+		resp, err = u.roundTrip(b.Bytes(), action, tid, timeout)
+		if err != errUDPTimeout {
+			return
+		}
+	}
+	return
+}
+
+// connectionId returns a valid connection id for the tracker, doing the
+// connect exchange if we don't have one.
+func (u *udpTracker) connectionId(timeout time.Duration) (id uint64, err error) {
+	c := &udpConnectionIds
+	c.Lock()
+	cached, ok := c.m[u.host]
+	c.Unlock()
+	if ok && time.Since(cached.got) < udpConnectionIdLifetime {
+		return cached.id, nil
+	}
+
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, uint64(udpProtocolId))
+	binary.Write(&b, binary.BigEndian, uint32(udpActionConnect))
+	tid := rand.Uint32()
+	binary.Write(&b, binary.BigEndian, tid)
+	resp, err := u.roundTrip(b.Bytes(), udpActionConnect, tid, timeout)
+	if err != nil {
+		return
+	}
+	if len(resp) < 8 {
+		return 0, errors.New("UDP tracker connect answer too short")
+	}
+	id = binary.BigEndian.Uint64(resp)
+
+	c.Lock()
+	if c.m == nil {
+		c.m = make(map[string]udpConnectionId)
+	}
+	c.m[u.host] = udpConnectionId{id, time.Now()}
+	c.Unlock()
+	return
+}
+
+// roundTrip sends a packet and waits for the answer with the same
+// transaction id. It returns what follows the action and transaction id.
+func (u *udpTracker) roundTrip(packet []byte, action, tid uint32, timeout time.Duration) (resp []byte, err error) {
+	if _, err = u.conn.Write(packet); err != nil {
+		return
+	}
+	u.conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 65536)
+	for {
+		var n int
+		n, err = u.conn.Read(buf)
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Timeout() {
+				err = errUDPTimeout
+			}
+			return
+		}
+		if n < 8 || binary.BigEndian.Uint32(buf[4:8]) != tid {
+			// Garbage, or a late answer to a previous attempt.
+			continue
+		}
+		gotAction := binary.BigEndian.Uint32(buf[0:4])
+		if gotAction == udpActionError {
+			// Maybe our connection id is no good anymore.
+			u.forgetConnectionId()
+			return nil, errors.New("UDP tracker error: " + string(buf[8:n]))
+		}
+		if gotAction != action {
+			return nil, errors.New("UDP tracker answered with the wrong action")
+		}
+		return append([]byte(nil), buf[8:n]...), nil
+	}
+}
+
+func (u *udpTracker) forgetConnectionId() {
+	c := &udpConnectionIds
+	c.Lock()
+	delete(c.m, u.host)
+	c.Unlock()
+}
@@ -0,0 +1,107 @@
+package taipei
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeUDPTracker answers connect, announce and scrape requests. It ignores
+// the first dropFirst packets it receives.
+func fakeUDPTracker(t *testing.T, conn net.PacketConn, dropFirst int) {
+	buf := make([]byte, 2048)
+	const connectionId = 0x1234567890
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if dropFirst > 0 {
+			dropFirst--
+			continue
+		}
+		if n < 16 {
+			t.Errorf("Request too short: %d bytes", n)
+			continue
+		}
+		id := binary.BigEndian.Uint64(buf[0:8])
+		action := binary.BigEndian.Uint32(buf[8:12])
+		var resp bytes.Buffer
+		binary.Write(&resp, binary.BigEndian, action)
+		resp.Write(buf[12:16]) // Transaction id.
+		switch action {
+		case udpActionConnect:
+			if id != udpProtocolId {
+				t.Errorf("Bad protocol id %x", id)
+			}
+			binary.Write(&resp, binary.BigEndian, uint64(connectionId))
+		case udpActionAnnounce:
+			if id != connectionId || n != 98 {
+				t.Errorf("Bad announce: connection id %x, %d bytes", id, n)
+			}
+			if event := binary.BigEndian.Uint32(buf[80:84]); event != 2 {
+				t.Errorf("Got event %d, wanted 2 (started)", event)
+			}
+			if port := binary.BigEndian.Uint16(buf[96:98]); port != 6881 {
+				t.Errorf("Got port %d, wanted 6881", port)
+			}
+			for _, v := range []uint32{1800, 5, 7} { // Interval, leechers, seeders.
+				binary.Write(&resp, binary.BigEndian, v)
+			}
+			resp.WriteString("\x7f\x00\x00\x01\x1a\xe1")
+		case udpActionScrape:
+			for i := 16; i < n; i += 20 {
+				binary.Write(&resp, binary.BigEndian, []uint32{uint32(buf[i]), 2, 3})
+			}
+		}
+		conn.WriteTo(resp.Bytes(), addr)
+	}
+}
+
+func TestUDPTracker(t *testing.T) {
+	defer func(d time.Duration) { udpBaseTimeout = d }(udpBaseTimeout)
+	udpBaseTimeout = 50 * time.Millisecond
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go fakeUDPTracker(t, conn, 1)
+	host := conn.LocalAddr().String()
+
+	a := &announceParams{
+		infoHash: "abcdefghijabcdefghij",
+		si:       SessionInfo{PeerId: "-tt1234-abcdefghijkl", Port: 6881, Left: 100},
+		event:    "started",
+		// The first packet is lost.
+		udpRetries: 1,
+	}
+	tr, err := udpAnnounce(host, a)
+	if err != nil {
+		t.Fatal("Announce failed:", err)
+	}
+	if tr.Interval != 1800 || tr.Incomplete != 5 || tr.Complete != 7 || tr.Peers != "\x7f\x00\x00\x01\x1a\xe1" {
+		t.Errorf("Unexpected announce answer %+v", tr)
+	}
+
+	// More hashes than fit in one packet.
+	hashes := make([]string, udpMaxScrapeHashes+3)
+	for i := range hashes {
+		hashes[i] = string(bytes.Repeat([]byte{byte(i)}, 20))
+	}
+	result, err := udpScrape(host, hashes)
+	if err != nil {
+		t.Fatal("Scrape failed:", err)
+	}
+	if len(result) != len(hashes) {
+		t.Fatalf("Got %d scrape results, wanted %d", len(result), len(hashes))
+	}
+	for i, ih := range hashes {
+		if got := result[ih]; got != (ScrapeInfo{Complete: i, Downloaded: 2, Incomplete: 3}) {
+			t.Errorf("Scrape result %d: got %+v", i, got)
+		}
+	}
+}
@@ -2,14 +2,17 @@ package taipei
 
 import (
 	"crypto/sha1"
+	"encoding/base32"
+	"encoding/hex"
 	"fmt"
-	"io"
 	"net/url"
 	"strings"
 )
 
 type Magnet struct {
-	InfoHashes []string
+	InfoHashes []string // Hex encoded.
+	Name       string
+	Trackers   []string
 }
 
 func parseMagnet(s string) (Magnet, error) {
@@ -41,18 +44,29 @@ func parseMagnet(s string) (Magnet, error) {
 			return Magnet{}, fmt.Errorf("Magnet URI xt parameter missing the 'urn:btih:' prefix. Not a bittorrent hash link?")
 		}
 		ih := s[1]
-		// TODO: support base32 encoded hashes, if they still exist.
+		if len(ih) == 32 { // base32 format.
+			b, err := base32.StdEncoding.DecodeString(strings.ToUpper(ih))
+			if err != nil {
+				return Magnet{}, fmt.Errorf("Magnet URI contains invalid base32 infohash %v: %v", ih, err)
+			}
+			ih = hex.EncodeToString(b)
+		}
 		if len(ih) != sha1.Size*2 { // hex format.
 			return Magnet{}, fmt.Errorf("Magnet URI contains infohash with unexpected length. Wanted %d, got %d: %v", sha1.Size, len(ih), ih)
 		}
-		infoHashes = append(infoHashes, s[1])
+		infoHashes = append(infoHashes, ih)
 	}
-	return Magnet{infoHashes}, nil
+	q := u.Query()
+	return Magnet{infoHashes, q.Get("dn"), q["tr"]}, nil
 }
 
-// torrentFromMagnet fetches the content of a torrent meta file from the magnet
-// uri. It only uses the first infohash found in the URI.
-func torrentFromMagnet(uri string) (torrentBody io.ReadCloser, err error) {
+// metaInfoFromMagnet builds the MetaInfo we can know from a magnet uri. It
+// only uses the first infohash found in the URI. The info dictionary itself
+// is fetched from peers by the torrent session.
+//
+// References:
+// - http://bittorrent.org/beps/bep_0009.html
+func metaInfoFromMagnet(uri string) (metaInfo *MetaInfo, err error) {
 	m, err := parseMagnet(uri)
 	if err != nil {
 		return nil, err
@@ -60,12 +74,19 @@ func torrentFromMagnet(uri string) (torrentBody io.ReadCloser, err error) {
 	if len(m.InfoHashes) == 0 {
 		return nil, fmt.Errorf("No bittorrent infohashes found in the magnet link %v.", uri)
 	}
-	ih := m.InfoHashes[0]
-	return nil, fmt.Errorf("Not supported. Would have downloaded torrent file with hash %v", ih)
-
-	// Start a torrent session to download the magnet file.
-	//
-	// References:
-	// - http://bittorrent.org/beps/bep_0009.html
-	// TODO: Refactor the torrent code to support multiple sessions per client.
+	ih, err := hex.DecodeString(m.InfoHashes[0])
+	if err != nil {
+		return nil, err
+	}
+	metaInfo = &MetaInfo{InfoHash: string(ih)}
+	metaInfo.Info.Name = m.Name
+	// Each tracker gets its own tier, so they are tried in the order of
+	// the link.
+	for _, tr := range m.Trackers {
+		if metaInfo.Announce == "" {
+			metaInfo.Announce = tr
+		}
+		metaInfo.AnnounceList = append(metaInfo.AnnounceList, []string{tr})
+	}
+	return
 }
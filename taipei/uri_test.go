@@ -8,11 +8,17 @@ import (
 type magnetTest struct {
 	uri        string
 	infoHashes []string
+	name       string
+	trackers   []string
 }
 
 func TestParseMagnet(t *testing.T) {
 	uris := []magnetTest{
-		{uri: "magnet:?xt=urn:btih:bbb6db69965af769f664b6636e7914f8735141b3&dn=Ubuntu-12.04-desktop-i386.iso&tr=udp%3A%2F%2Ftracker.openbittorrent.com%3A80&tr=udp%3A%2F%2Ftracker.publicbt.com%3A80&tr=udp%3A%2F%2Ftracker.istole.it%3A6969&tr=udp%3A%2F%2Ftracker.ccc.de%3A80", infoHashes: []string{"bbb6db69965af769f664b6636e7914f8735141b3"}},
+		{uri: "magnet:?xt=urn:btih:bbb6db69965af769f664b6636e7914f8735141b3&dn=Ubuntu-12.04-desktop-i386.iso&tr=udp%3A%2F%2Ftracker.openbittorrent.com%3A80&tr=udp%3A%2F%2Ftracker.publicbt.com%3A80&tr=udp%3A%2F%2Ftracker.istole.it%3A6969&tr=udp%3A%2F%2Ftracker.ccc.de%3A80", infoHashes: []string{"bbb6db69965af769f664b6636e7914f8735141b3"},
+			name:     "Ubuntu-12.04-desktop-i386.iso",
+			trackers: []string{"udp://tracker.openbittorrent.com:80", "udp://tracker.publicbt.com:80", "udp://tracker.istole.it:6969", "udp://tracker.ccc.de:80"}},
+		// Base32 encoded infohash.
+		{uri: "magnet:?xt=urn:btih:XO3NW2MWLL3WT5TEWZRW46IU7BZVCQNT", infoHashes: []string{"bbb6db69965af769f664b6636e7914f8735141b3"}},
 	}
 
 	for _, u := range uris {
@@ -23,5 +29,11 @@ func TestParseMagnet(t *testing.T) {
 		if !reflect.DeepEqual(u.infoHashes, m.InfoHashes) {
 			t.Errorf("ParseMagnet failed, wanted %v, got %v", u.infoHashes, m.InfoHashes)
 		}
+		if m.Name != u.name {
+			t.Errorf("ParseMagnet failed, wanted name %q, got %q", u.name, m.Name)
+		}
+		if !reflect.DeepEqual(u.trackers, m.Trackers) {
+			t.Errorf("ParseMagnet failed, wanted trackers %v, got %v", u.trackers, m.Trackers)
+		}
 	}
 }
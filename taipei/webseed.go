@@ -0,0 +1,340 @@
+package taipei
+
+// Web seeds.
+//
+// A torrent can list HTTP servers that have its files, in url-list. Each web
+// seed is handled like a peer that has every piece: a webSeedConn speaks the
+// peer protocol with the session, and turns the blocks it requests into HTTP
+// Range requests for the files they are in. The pieces are verified, and
+// counted in the stats, like those from any peer.
+//
+// References:
+// - http://bittorrent.org/beps/bep_0019.html
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// How long to wait before connecting to a web seed again.
+	webSeedRetryInterval = time.Minute
+	webSeedTimeout       = time.Minute
+)
+
+var webSeedClient = &http.Client{Timeout: webSeedTimeout}
+
+type webSeed struct {
+	url     string
+	lastTry time.Time
+}
+
+func newWebSeeds(urls []string) (seeds []*webSeed) {
+	for _, u := range urls {
+		if strings.HasPrefix(u, "http:") || strings.HasPrefix(u, "https:") {
+			seeds = append(seeds, &webSeed{url: u})
+		}
+	}
+	return
+}
+
+// connectWebSeeds adds the web seeds we aren't connected to as peers, while
+// we miss pieces.
+func (t *TorrentSession) connectWebSeeds() {
+	fs, ok := t.fileStore.(*fileStore)
+	if !ok || !t.si.HaveTorrent || t.isComplete() {
+		return
+	}
+	now := time.Now()
+	for _, ws := range t.webSeeds {
+		if _, ok := t.peers[ws.url]; ok || now.Sub(ws.lastTry) < webSeedRetryInterval {
+			continue
+		}
+		ws.lastTry = now
+		t.AddPeer(newWebSeedConn(ws.url, t.m, fs))
+	}
+}
+
+// webSeedURLs returns the URL of each file of the torrent on the web seed at
+// base.
+func webSeedURLs(base string, info *InfoDict) (urls []string) {
+	if len(info.Files) == 0 {
+		if strings.HasSuffix(base, "/") {
+			base += url.PathEscape(info.Name)
+		}
+		return []string{base}
+	}
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+	base += url.PathEscape(info.Name) + "/"
+	for _, f := range info.Files {
+		path := make([]string, len(f.Path))
+		for i, p := range f.Path {
+			path[i] = url.PathEscape(p)
+		}
+		urls = append(urls, base+strings.Join(path, "/"))
+	}
+	return
+}
+
+type webSeedRequest struct {
+	piece, begin, length uint32
+}
+
+// webSeedConn is a connection to a web seed, as a peer. What the session
+// writes is parsed for block requests, and what it reads are the messages
+// of a seed: a handshake, a full bitfield, an unchoke and the blocks.
+type webSeedConn struct {
+	url         string
+	files       []string   // URL of each file.
+	layout      *fileStore // Where the files are in the torrent.
+	pieceLength int64
+	totalSize   int64
+
+	mu         sync.Mutex
+	changed    *sync.Cond
+	out        bytes.Buffer // Messages for the session.
+	in         []byte       // Unparsed messages from the session.
+	headerLeft int          // Bytes of the session's handshake not read yet.
+	requests   []webSeedRequest
+	err        error // Set once the connection is broken.
+
+	// The piece last fetched, which the next requests are likely in. Only
+	// used by run.
+	cachePiece int64
+	cache      []byte
+}
+
+func newWebSeedConn(u string, m *MetaInfo, layout *fileStore) *webSeedConn {
+	c := &webSeedConn{url: u, files: webSeedURLs(u, &m.Info), layout: layout,
+		pieceLength: m.Info.PieceLength, totalSize: layout.offsets[len(layout.offsets)-1],
+		headerLeft: 68, cachePiece: -1}
+	c.totalSize += layout.files[len(layout.files)-1].length
+	c.changed = sync.NewCond(&c.mu)
+
+	// The handshake, with the hash of the URL as the peer id.
+	c.out.Write(kBitTorrentHeader)
+	c.out.Write(make([]byte, 8))
+	c.out.WriteString(m.InfoHash)
+	id := sha1.Sum([]byte(u))
+	c.out.Write(id[:])
+	numPieces := int((c.totalSize + c.pieceLength - 1) / c.pieceLength)
+	have := NewBitset(numPieces)
+	for i := 0; i < numPieces; i++ {
+		have.Set(i)
+	}
+	c.writeMessage(append([]byte{BITFIELD}, have.b...))
+	c.writeMessage([]byte{UNCHOKE})
+	go c.run()
+	return c
+}
+
+func (c *webSeedConn) writeMessage(msg []byte) {
+	var n [4]byte
+	uint32ToBytes(n[:], uint32(len(msg)))
+	c.out.Write(n[:])
+	c.out.Write(msg)
+}
+
+// run fetches the blocks the session requests, in order.
+func (c *webSeedConn) run() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		for len(c.requests) == 0 && c.err == nil {
+			c.changed.Wait()
+		}
+		if c.err != nil {
+			return
+		}
+		r := c.requests[0]
+		c.requests = c.requests[1:]
+		c.mu.Unlock()
+		block, err := c.block(r)
+		c.mu.Lock()
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		msg := make([]byte, 9, 9+len(block))
+		msg[0] = PIECE
+		uint32ToBytes(msg[1:5], r.piece)
+		uint32ToBytes(msg[5:9], r.begin)
+		c.writeMessage(append(msg, block...))
+		c.changed.Broadcast()
+	}
+}
+
+func (c *webSeedConn) fail(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+	c.changed.Broadcast()
+}
+
+// block returns the data of a request, fetching its whole piece if it
+// isn't the one we have.
+func (c *webSeedConn) block(r webSeedRequest) ([]byte, error) {
+	if int64(r.piece) != c.cachePiece {
+		start := int64(r.piece) * c.pieceLength
+		size := c.pieceLength
+		if start+size > c.totalSize {
+			size = c.totalSize - start
+		}
+		if size <= 0 {
+			return nil, errors.New("request for a piece out of range")
+		}
+		data := make([]byte, size)
+		if err := c.fetch(data, start); err != nil {
+			return nil, err
+		}
+		c.cachePiece, c.cache = int64(r.piece), data
+	}
+	if int64(r.begin)+int64(r.length) > int64(len(c.cache)) {
+		return nil, errors.New("request for a block out of range")
+	}
+	return c.cache[r.begin : r.begin+r.length], nil
+}
+
+// fetch reads the data of the torrent at off into p, from each file it is
+// in.
+func (c *webSeedConn) fetch(p []byte, off int64) error {
+	index := c.layout.find(off)
+	for len(p) > 0 && index < len(c.layout.offsets) {
+		itemOffset := off - c.layout.offsets[index]
+		if length := c.layout.files[index].length; itemOffset < length {
+			chunk := int64(len(p))
+			if space := length - itemOffset; space < chunk {
+				chunk = space
+			}
+			if err := c.get(c.files[index], p[:chunk], itemOffset); err != nil {
+				return err
+			}
+			p = p[chunk:]
+			off += chunk
+		}
+		index++
+	}
+	return nil
+}
+
+// get reads the file at u from off into p, with a Range request.
+func (c *webSeedConn) get(u string, p []byte, off int64) error {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+int64(len(p))-1))
+	resp, err := webSeedClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// The server ignored the range.
+		if _, err = io.CopyN(ioutil.Discard, resp.Body, off); err != nil {
+			return err
+		}
+	default:
+		return errors.New("web seed " + u + " answered " + resp.Status)
+	}
+	_, err = io.ReadFull(resp.Body, p)
+	return err
+}
+
+func (c *webSeedConn) Read(b []byte) (n int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.out.Len() == 0 && c.err == nil {
+		c.changed.Wait()
+	}
+	if c.out.Len() > 0 {
+		return c.out.Read(b)
+	}
+	return 0, c.err
+}
+
+// Write takes the handshake and messages of the session. Only the requests
+// and cancels matter.
+func (c *webSeedConn) Write(b []byte) (n int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return 0, c.err
+	}
+	n = len(b)
+	if c.headerLeft > 0 {
+		skip := c.headerLeft
+		if skip > len(b) {
+			skip = len(b)
+		}
+		c.headerLeft -= skip
+		b = b[skip:]
+	}
+	c.in = append(c.in, b...)
+	for len(c.in) >= 4 {
+		size := int(bytesToUint32(c.in))
+		if len(c.in) < 4+size {
+			break
+		}
+		msg := c.in[4 : 4+size]
+		c.in = c.in[4+size:]
+		if size != 13 || (msg[0] != REQUEST && msg[0] != CANCEL) {
+			continue
+		}
+		r := webSeedRequest{bytesToUint32(msg[1:5]), bytesToUint32(msg[5:9]), bytesToUint32(msg[9:13])}
+		if msg[0] == REQUEST {
+			c.requests = append(c.requests, r)
+			c.changed.Broadcast()
+			continue
+		}
+		for i, q := range c.requests {
+			if q == r {
+				c.requests = append(c.requests[:i], c.requests[i+1:]...)
+				break
+			}
+		}
+	}
+	if len(c.in) == 0 {
+		c.in = nil
+	}
+	return
+}
+
+func (c *webSeedConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.fail(errors.New("web seed connection closed"))
+	return nil
+}
+
+type webSeedAddr string
+
+func (a webSeedAddr) Network() string { return "http" }
+func (a webSeedAddr) String() string  { return string(a) }
+
+// RemoteAddr is the URL of the web seed, which is its address as a peer.
+func (c *webSeedConn) RemoteAddr() net.Addr {
+	return webSeedAddr(c.url)
+}
+
+func (c *webSeedConn) LocalAddr() net.Addr {
+	return webSeedAddr("")
+}
+
+func (c *webSeedConn) SetDeadline(t time.Time) error      { return nil }
+func (c *webSeedConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *webSeedConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,106 @@
+package taipei
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestWebSeedURLs(t *testing.T) {
+	single := &InfoDict{Name: "a file"}
+	if got := webSeedURLs("http://h/dir/", single); !reflect.DeepEqual(got, []string{"http://h/dir/a%20file"}) {
+		t.Errorf("Got %v", got)
+	}
+	if got := webSeedURLs("http://h/f.iso", single); !reflect.DeepEqual(got, []string{"http://h/f.iso"}) {
+		t.Errorf("Got %v", got)
+	}
+	multi := &InfoDict{Name: "content", Files: []FileDict{{Path: []string{"a"}}, {Path: []string{"b", "c?"}}}}
+	want := []string{"http://h/dir/content/a", "http://h/dir/content/b/c%3F"}
+	if got := webSeedURLs("http://h/dir", multi); !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %v, wanted %v", got, want)
+	}
+}
+
+func TestWebSeedConn(t *testing.T) {
+	dir, err := ioutil.TempDir("", "taipei-webseed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := []byte("0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRS")
+	if err = os.MkdirAll(filepath.Join(dir, "content", "b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "content", "a"), data[:30], 0600)
+	ioutil.WriteFile(filepath.Join(dir, "content", "b", "c"), data[30:], 0600)
+	server := httptest.NewServer(http.FileServer(http.Dir(dir)))
+	defer server.Close()
+
+	// Pieces of 20 bytes, the second one in both files.
+	m := &MetaInfo{InfoHash: strings.Repeat("x", 20), Info: InfoDict{Name: "content", PieceLength: 20,
+		Files: []FileDict{{Length: 30, Path: []string{"a"}}, {Length: 25, Path: []string{"b", "c"}}}}}
+	layout := &fileStore{offsets: []int64{0, 30}, files: []fileEntry{{length: 30}, {length: 25}}}
+	c := newWebSeedConn(server.URL, m, layout)
+	defer c.Close()
+
+	var header [68]byte
+	if _, err = io.ReadFull(c, header[:]); err != nil || string(header[28:48]) != m.InfoHash {
+		t.Fatalf("Got handshake %q, %v", header, err)
+	}
+	readMessage := func() []byte {
+		n, err := readNBOUint32(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := make([]byte, n)
+		if _, err = io.ReadFull(c, msg); err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+	if msg := readMessage(); !bytes.Equal(msg, []byte{BITFIELD, 0xe0}) {
+		t.Errorf("Got bitfield %x", msg)
+	}
+	if msg := readMessage(); !bytes.Equal(msg, []byte{UNCHOKE}) {
+		t.Errorf("Got %x instead of an unchoke", msg)
+	}
+
+	c.Write(header[:])
+	request := func(piece, begin, length uint32) {
+		msg := make([]byte, 17)
+		uint32ToBytes(msg, 13)
+		msg[4] = REQUEST
+		uint32ToBytes(msg[5:], piece)
+		uint32ToBytes(msg[9:], begin)
+		uint32ToBytes(msg[13:], length)
+		// In two writes, like peerWriter does.
+		c.Write(msg[:4])
+		c.Write(msg[4:])
+	}
+	request(1, 5, 10)
+	request(2, 0, 15)
+	for _, want := range []struct {
+		piece, begin uint32
+		data         []byte
+	}{{1, 5, data[25:35]}, {2, 0, data[40:55]}} {
+		msg := readMessage()
+		if msg[0] != PIECE || bytesToUint32(msg[1:5]) != want.piece || bytesToUint32(msg[5:9]) != want.begin ||
+			!bytes.Equal(msg[9:], want.data) {
+			t.Errorf("Got %q, wanted piece %d at %d: %q", msg, want.piece, want.begin, want.data)
+		}
+	}
+
+	// Files the server doesn't have break the connection.
+	os.Remove(filepath.Join(dir, "content", "a"))
+	request(0, 0, 10)
+	if n, err := c.Read(header[:]); err == nil {
+		t.Errorf("Got %q instead of an error", header[:n])
+	}
+}
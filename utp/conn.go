@@ -0,0 +1,544 @@
+package utp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// Bytes of data per packet, to stay under common path MTUs.
+	maxPayload = 1380
+	// Bytes received but not read yet that we buffer.
+	recvWindow = 1 << 20
+	// How far ahead of the next expected packet we keep packets that arrive
+	// out of order.
+	maxOutOfOrder = 1024
+
+	// Congestion control (LEDBAT).
+	target          = 100 * time.Millisecond // Queuing delay we aim for.
+	maxCwndIncrease = 3000                   // Bytes per round trip.
+	minCwnd         = maxPayload
+	maxCwnd         = 1 << 20
+	initialCwnd     = 2 * maxPayload
+	// The base delay is the lowest delay seen in the last two intervals.
+	baseDelayInterval = time.Minute
+	dupAckThreshold   = 3
+
+	// Retransmission timeouts.
+	initialRTO = time.Second
+	minRTO     = 500 * time.Millisecond
+	maxRTO     = 30 * time.Second
+	// Times a packet is sent before giving up on the connection.
+	synTransmissions = 2
+	maxTransmissions = 6
+)
+
+// Connection states.
+const (
+	stateSynSent = iota
+	stateConnected
+	stateClosed
+)
+
+var (
+	errClosed   = errors.New("utp: use of closed connection")
+	errReset    = errors.New("utp: connection reset by peer")
+	errTimedOut = errors.New("utp: connection timed out")
+)
+
+// timeoutError is returned when a deadline passes.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "utp: i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// Conn is a uTP connection. It implements net.Conn.
+type Conn struct {
+	s      *Socket
+	raddr  net.Addr
+	recvID uint16 // Connection id of the packets we receive.
+	sendID uint16 // Connection id of the packets we send.
+
+	mu      sync.Mutex
+	changed chan bool // Closed and replaced on every change of state.
+	state   int
+	err     error // Why the connection broke.
+	closing bool  // Close was called.
+
+	// Sending.
+	seq          uint16 // Of the next packet.
+	unacked      []*outPacket
+	inFlight     int // Bytes of data not acked yet.
+	peerWnd      int
+	cwnd         float64
+	slowStart    bool
+	lastAck      uint16
+	dupAcks      int
+	recovering   bool   // Lost packets are being sent again.
+	recoverySeq  uint16 // Last packet sent when the loss was noticed.
+	rtt, rttVar  time.Duration
+	rto          time.Duration
+	replyMicro   uint32 // Delay of the last packet received, to send back.
+	curMinDelay  uint32
+	lastMinDelay uint32
+	delaySince   time.Time // Start of the current base delay interval.
+	finSent      bool
+
+	// Receiving.
+	ack        uint16 // Last packet received in order.
+	readBuf    bytes.Buffer
+	outOfOrder map[uint16]packet
+	eof        bool // The peer's FIN, and all before it, arrived.
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+type outPacket struct {
+	packet
+	sentAt        time.Time
+	transmissions int
+}
+
+func newConn(s *Socket, raddr net.Addr, recvID, sendID uint16) *Conn {
+	return &Conn{s: s, raddr: raddr, recvID: recvID, sendID: sendID,
+		changed:      make(chan bool),
+		peerWnd:      maxPayload,
+		cwnd:         initialCwnd,
+		slowStart:    true,
+		rto:          initialRTO,
+		curMinDelay:  math.MaxUint32,
+		lastMinDelay: math.MaxUint32,
+		delaySince:   time.Now(),
+		outOfOrder:   make(map[uint16]packet)}
+}
+
+func (c *Conn) key() connKey {
+	return connKey{c.raddr.String(), c.recvID}
+}
+
+// notify wakes up the goroutines waiting for a change. c.mu must be held.
+func (c *Conn) notify() {
+	close(c.changed)
+	c.changed = make(chan bool)
+}
+
+// wait releases c.mu until the next change or until the deadline, if it
+// isn't zero.
+func (c *Conn) wait(deadline time.Time) {
+	changed := c.changed
+	c.mu.Unlock()
+	defer c.mu.Lock()
+	if deadline.IsZero() {
+		<-changed
+		return
+	}
+	timer := time.NewTimer(deadline.Sub(time.Now()))
+	defer timer.Stop()
+	select {
+	case <-changed:
+	case <-timer.C:
+	}
+}
+
+func passed(deadline time.Time) bool {
+	return !deadline.IsZero() && !time.Now().Before(deadline)
+}
+
+func (c *Conn) Read(b []byte) (n int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		switch {
+		case c.readBuf.Len() > 0:
+			full := c.window() < maxPayload
+			n, _ = c.readBuf.Read(b)
+			if full && c.state == stateConnected {
+				// Tell the peer it can send again.
+				c.sendState()
+			}
+			return
+		case c.eof:
+			return 0, io.EOF
+		case c.closing:
+			return 0, errClosed
+		case c.err != nil:
+			return 0, c.err
+		case passed(c.readDeadline):
+			return 0, timeoutError{}
+		}
+		c.wait(c.readDeadline)
+	}
+}
+
+func (c *Conn) Write(b []byte) (n int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(b) > 0 {
+		switch {
+		case c.closing:
+			return n, errClosed
+		case c.err != nil:
+			return n, c.err
+		}
+		size := len(b)
+		if size > maxPayload {
+			size = maxPayload
+		}
+		// With nothing in flight, a packet always goes out, which also
+		// probes a closed receive window.
+		if c.inFlight > 0 && c.inFlight+size > c.sendWindow() {
+			if passed(c.writeDeadline) {
+				return n, timeoutError{}
+			}
+			c.wait(c.writeDeadline)
+			continue
+		}
+		c.sendNew(stData, b[:size])
+		n += size
+		b = b[size:]
+	}
+	return
+}
+
+// Close sends a FIN after the data written so far. It doesn't wait for the
+// peer to acknowledge it.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closing {
+		return errClosed
+	}
+	c.closing = true
+	c.readBuf.Reset()
+	if c.state == stateConnected {
+		c.sendNew(stFin, nil)
+		c.finSent = true
+	} else {
+		c.finish(errClosed)
+	}
+	c.notify()
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.s.Addr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline, c.writeDeadline = t, t
+	c.notify()
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.notify()
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	c.notify()
+	return nil
+}
+
+// window is how many more bytes we can receive.
+func (c *Conn) window() int {
+	if w := recvWindow - c.readBuf.Len(); w > 0 {
+		return w
+	}
+	return 0
+}
+
+// sendWindow is how many bytes can be in flight.
+func (c *Conn) sendWindow() int {
+	if w := int(c.cwnd); w < c.peerWnd {
+		return w
+	}
+	return c.peerWnd
+}
+
+// sendNew sends a packet that takes a sequence number, and keeps it until
+// the peer acknowledges it.
+func (c *Conn) sendNew(typ byte, payload []byte) {
+	p := &outPacket{packet: packet{header: header{typ: typ, seq: c.seq}}}
+	if len(payload) > 0 {
+		p.payload = append([]byte(nil), payload...)
+	}
+	c.seq++
+	c.unacked = append(c.unacked, p)
+	c.inFlight += len(payload)
+	c.transmit(p)
+}
+
+func (c *Conn) transmit(p *outPacket) {
+	p.sentAt = time.Now()
+	p.transmissions++
+	c.send(&p.packet)
+}
+
+// sendState acknowledges what we received.
+func (c *Conn) sendState() {
+	c.send(&packet{header: header{typ: stState, seq: c.seq}})
+}
+
+// send fills in the fields of the header that reflect the current state, and
+// sends the packet.
+func (c *Conn) send(p *packet) {
+	p.connID = c.sendID
+	if p.typ == stSyn {
+		p.connID = c.recvID
+	}
+	p.timestamp = microseconds()
+	p.timestampDiff = c.replyMicro
+	p.wnd = uint32(c.window())
+	p.ack = c.ack
+	c.s.writeTo(p.marshal(), c.raddr)
+}
+
+// handle processes a packet the socket received for this connection.
+func (c *Conn) handle(p packet) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == stateClosed {
+		return
+	}
+	if p.typ == stReset {
+		c.finish(errReset)
+		return
+	}
+	c.peerWnd = int(p.wnd)
+	c.replyMicro = microseconds() - p.timestamp
+	switch {
+	case p.typ == stSyn:
+		// Our answer to the SYN was lost.
+		c.sendState()
+		return
+	case c.state == stateSynSent:
+		if p.typ != stState {
+			return
+		}
+		c.state = stateConnected
+		c.ack = p.seq - 1
+	}
+	c.processAck(p)
+	if p.typ == stData || p.typ == stFin {
+		c.receive(p)
+	}
+	if c.finSent && len(c.unacked) == 0 {
+		// Everything we sent, FIN included, arrived.
+		c.finish(nil)
+	}
+	c.notify()
+}
+
+// accept sets up an incoming connection from its SYN.
+func (c *Conn) accept(syn packet, seq uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state = stateConnected
+	c.ack = syn.seq
+	c.seq = seq
+	c.lastAck = seq - 1
+	c.peerWnd = int(syn.wnd)
+	c.replyMicro = microseconds() - syn.timestamp
+	c.sendState()
+}
+
+func (c *Conn) processAck(p packet) {
+	if len(c.unacked) == 0 || seqLess(p.ack, c.unacked[0].seq) {
+		// Nothing new is acked.
+		if p.typ == stState && len(c.unacked) > 0 && p.ack == c.lastAck {
+			c.dupAcks++
+			// With few packets in flight, there can't be many duplicate
+			// acks (early retransmit, RFC 5827).
+			threshold := dupAckThreshold
+			if n := len(c.unacked) - 1; n < threshold && n > 0 {
+				threshold = n
+			}
+			if c.dupAcks == threshold {
+				c.lost()
+				c.transmit(c.unacked[0])
+			}
+		}
+		return
+	}
+	acked := 0
+	// Packets that arrived out of order waited for one sent again before
+	// being acked. Their round trip time means nothing then.
+	sample := true
+	var last *outPacket
+	for len(c.unacked) > 0 && !seqLess(p.ack, c.unacked[0].seq) {
+		last = c.unacked[0]
+		c.unacked = c.unacked[1:]
+		acked += len(last.payload)
+		sample = sample && last.transmissions == 1
+	}
+	if sample {
+		c.updateRTT(time.Now().Sub(last.sentAt))
+	}
+	c.inFlight -= acked
+	c.lastAck = p.ack
+	c.dupAcks = 0
+	if c.recovering {
+		if len(c.unacked) > 0 && seqLess(p.ack, c.recoverySeq) {
+			// More was lost at the same time.
+			c.transmit(c.unacked[0])
+		} else {
+			c.recovering = false
+		}
+	}
+	if acked > 0 {
+		c.congestionControl(acked, p.timestampDiff)
+	}
+}
+
+// lost reacts to the loss of a packet. The caller sends it again.
+func (c *Conn) lost() {
+	c.cwnd = math.Max(c.cwnd/2, minCwnd)
+	c.slowStart = false
+	c.recovering = true
+	c.recoverySeq = c.seq - 1
+}
+
+// congestionControl grows or shrinks the congestion window, depending on
+// how far the queuing delay is from the target.
+func (c *Conn) congestionControl(acked int, delay uint32) {
+	var ourDelay time.Duration
+	if delay != 0 {
+		now := time.Now()
+		if now.Sub(c.delaySince) > baseDelayInterval {
+			c.lastMinDelay, c.curMinDelay = c.curMinDelay, delay
+			c.delaySince = now
+		} else if delay < c.curMinDelay {
+			c.curMinDelay = delay
+		}
+		base := c.curMinDelay
+		if c.lastMinDelay < base {
+			base = c.lastMinDelay
+		}
+		ourDelay = time.Duration(delay-base) * time.Microsecond
+	}
+	offTarget := float64(target-ourDelay) / float64(target)
+	if c.slowStart && offTarget < 0 {
+		c.slowStart = false
+	}
+	if c.slowStart {
+		c.cwnd += float64(acked)
+	} else {
+		windowFactor := float64(acked) / math.Max(c.cwnd, float64(acked))
+		c.cwnd += maxCwndIncrease * offTarget * windowFactor
+	}
+	c.cwnd = math.Min(math.Max(c.cwnd, minCwnd), maxCwnd)
+}
+
+func (c *Conn) updateRTT(sample time.Duration) {
+	if c.rtt == 0 {
+		c.rtt, c.rttVar = sample, sample/2
+	} else {
+		delta := c.rtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttVar += (delta - c.rttVar) / 4
+		c.rtt += (sample - c.rtt) / 8
+	}
+	c.rto = c.rtt + 4*c.rttVar
+	if c.rto < minRTO {
+		c.rto = minRTO
+	}
+}
+
+// receive takes in a DATA or FIN packet.
+func (c *Conn) receive(p packet) {
+	if !c.eof {
+		next := c.ack + 1
+		if p.seq == next {
+			c.deliver(p)
+			for !c.eof {
+				q, ok := c.outOfOrder[c.ack+1]
+				if !ok {
+					break
+				}
+				delete(c.outOfOrder, q.seq)
+				c.deliver(q)
+			}
+		} else if seqLess(next, p.seq) && p.seq-next < maxOutOfOrder {
+			c.outOfOrder[p.seq] = p
+		}
+	}
+	// Packets out of order are acked too: the duplicate acks tell the
+	// sender what is missing.
+	c.sendState()
+}
+
+func (c *Conn) deliver(p packet) {
+	c.ack = p.seq
+	if p.typ == stFin {
+		c.eof = true
+		c.outOfOrder = make(map[uint16]packet)
+		return
+	}
+	if !c.closing {
+		c.readBuf.Write(p.payload)
+	}
+}
+
+// finish ends the connection and forgets it. c.mu must be held.
+func (c *Conn) finish(err error) {
+	if c.state == stateClosed {
+		return
+	}
+	c.state = stateClosed
+	if c.err == nil {
+		c.err = err
+	}
+	c.unacked = nil
+	c.inFlight = 0
+	c.s.remove(c)
+	c.notify()
+}
+
+// tick sends the oldest packet again if it wasn't acked in time.
+func (c *Conn) tick(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == stateClosed || len(c.unacked) == 0 {
+		return
+	}
+	p := c.unacked[0]
+	if now.Sub(p.sentAt) < c.rto {
+		return
+	}
+	max := maxTransmissions
+	if c.state == stateSynSent {
+		max = synTransmissions
+	}
+	if p.transmissions >= max {
+		c.finish(errTimedOut)
+		return
+	}
+	if c.rto *= 2; c.rto > maxRTO {
+		c.rto = maxRTO
+	}
+	c.lost()
+	c.cwnd = minCwnd
+	c.transmit(p)
+}
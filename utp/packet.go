@@ -0,0 +1,96 @@
+// Package utp implements the Micro Transport Protocol: reliable, ordered
+// streams over UDP, with LEDBAT congestion control so that they yield to
+// other traffic on the link.
+//
+// References:
+// - http://bittorrent.org/beps/bep_0029.html
+// - http://tools.ietf.org/html/rfc6817
+package utp
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// Packet types.
+const (
+	stData  = 0
+	stFin   = 1
+	stState = 2
+	stReset = 3
+	stSyn   = 4
+)
+
+const (
+	version    = 1
+	headerSize = 20
+)
+
+var errBadPacket = errors.New("utp: malformed packet")
+
+type header struct {
+	typ           byte
+	connID        uint16
+	timestamp     uint32 // When the packet was sent, in microseconds.
+	timestampDiff uint32 // Delay measured on the last packet received.
+	wnd           uint32 // Bytes the sender can still receive.
+	seq           uint16
+	ack           uint16
+}
+
+type packet struct {
+	header
+	payload []byte
+}
+
+func (p *packet) marshal() []byte {
+	b := make([]byte, headerSize+len(p.payload))
+	b[0] = p.typ<<4 | version
+	// b[1] is zero: no extensions.
+	binary.BigEndian.PutUint16(b[2:4], p.connID)
+	binary.BigEndian.PutUint32(b[4:8], p.timestamp)
+	binary.BigEndian.PutUint32(b[8:12], p.timestampDiff)
+	binary.BigEndian.PutUint32(b[12:16], p.wnd)
+	binary.BigEndian.PutUint16(b[16:18], p.seq)
+	binary.BigEndian.PutUint16(b[18:20], p.ack)
+	copy(b[headerSize:], p.payload)
+	return b
+}
+
+// unmarshal decodes a packet. The payload is copied out of b.
+func unmarshal(b []byte) (p packet, err error) {
+	if len(b) < headerSize || b[0]&0x0f != version || b[0]>>4 > stSyn {
+		return p, errBadPacket
+	}
+	p.typ = b[0] >> 4
+	p.connID = binary.BigEndian.Uint16(b[2:4])
+	p.timestamp = binary.BigEndian.Uint32(b[4:8])
+	p.timestampDiff = binary.BigEndian.Uint32(b[8:12])
+	p.wnd = binary.BigEndian.Uint32(b[12:16])
+	p.seq = binary.BigEndian.Uint16(b[16:18])
+	p.ack = binary.BigEndian.Uint16(b[18:20])
+	// Skip the extensions, such as selective acks, which we don't use.
+	rest := b[headerSize:]
+	for ext := b[1]; ext != 0; {
+		if len(rest) < 2 || len(rest) < 2+int(rest[1]) {
+			return p, errBadPacket
+		}
+		ext = rest[0]
+		rest = rest[2+int(rest[1]):]
+	}
+	if len(rest) > 0 {
+		p.payload = append([]byte(nil), rest...)
+	}
+	return
+}
+
+// microseconds is the current time, as in the timestamp field.
+func microseconds() uint32 {
+	return uint32(time.Now().UnixNano() / 1000)
+}
+
+// seqLess compares sequence numbers, which wrap around.
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
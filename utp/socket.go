@@ -0,0 +1,206 @@
+package utp
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// Connections not accepted yet that we keep. Beyond that, SYNs are
+	// ignored and the peers try again later.
+	backlogSize = 32
+	// How often retransmission timeouts are checked.
+	tickInterval = 100 * time.Millisecond
+	// Biggest packet we read.
+	maxPacketSize = 65536
+)
+
+type connKey struct {
+	addr string
+	id   uint16 // Connection id of the packets we receive.
+}
+
+// Socket carries uTP connections over a UDP socket. It dials connections,
+// and accepts them as a net.Listener.
+type Socket struct {
+	pc        net.PacketConn
+	backlog   chan *Conn
+	closed    chan bool
+	closeOnce sync.Once
+
+	mu    sync.Mutex
+	conns map[connKey]*Conn
+}
+
+// Listen opens a UDP socket at the address, like ":6881", for uTP.
+func Listen(addr string) (*Socket, error) {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewSocket(pc), nil
+}
+
+// NewSocket runs uTP over pc, which the socket reads from until it's
+// closed. pc can be shared with other protocols, as long as they pass on the
+// uTP packets.
+func NewSocket(pc net.PacketConn) *Socket {
+	s := &Socket{pc: pc,
+		backlog: make(chan *Conn, backlogSize),
+		closed:  make(chan bool),
+		conns:   make(map[connKey]*Conn)}
+	go s.readLoop()
+	go s.tickLoop()
+	return s
+}
+
+// Dial opens a uTP connection to the address.
+func (s *Socket) Dial(addr string) (net.Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	select {
+	case <-s.closed:
+		s.mu.Unlock()
+		return nil, errClosed
+	default:
+	}
+	var id uint16
+	for {
+		id = uint16(rand.Intn(1 << 16))
+		if _, ok := s.conns[connKey{raddr.String(), id}]; !ok {
+			break
+		}
+	}
+	c := newConn(s, raddr, id, id+1)
+	s.conns[c.key()] = c
+	s.mu.Unlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq = 1
+	c.sendNew(stSyn, nil)
+	for c.state == stateSynSent {
+		c.wait(time.Time{})
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+	return c, nil
+}
+
+// Accept waits for the next incoming connection.
+func (s *Socket) Accept() (net.Conn, error) {
+	select {
+	case c := <-s.backlog:
+		return c, nil
+	case <-s.closed:
+		return nil, errClosed
+	}
+}
+
+// Close closes the socket and breaks its connections.
+func (s *Socket) Close() error {
+	err := errClosed
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		err = s.pc.Close()
+		for _, c := range s.connList() {
+			c.mu.Lock()
+			c.finish(errClosed)
+			c.mu.Unlock()
+		}
+	})
+	return err
+}
+
+// Addr is the local address of the socket.
+func (s *Socket) Addr() net.Addr {
+	return s.pc.LocalAddr()
+}
+
+func (s *Socket) readLoop() {
+	b := make([]byte, maxPacketSize)
+	for {
+		n, addr, err := s.pc.ReadFrom(b)
+		if err != nil {
+			s.Close()
+			return
+		}
+		if p, err := unmarshal(b[:n]); err == nil {
+			s.dispatch(p, addr)
+		}
+	}
+}
+
+// dispatch hands a packet over to its connection.
+func (s *Socket) dispatch(p packet, addr net.Addr) {
+	key := connKey{addr.String(), p.connID}
+	if p.typ == stSyn {
+		// The id of a SYN is the one we send with.
+		key.id++
+	}
+	s.mu.Lock()
+	c := s.conns[key]
+	if c == nil && p.typ == stSyn {
+		// Only this goroutine adds to the backlog, so there will be room.
+		if len(s.backlog) < backlogSize {
+			c = newConn(s, addr, key.id, p.connID)
+			s.conns[key] = c
+			s.mu.Unlock()
+			c.accept(p, uint16(rand.Intn(1<<16)))
+			s.backlog <- c
+		} else {
+			s.mu.Unlock()
+		}
+		return
+	}
+	s.mu.Unlock()
+	if c != nil {
+		c.handle(p)
+	} else if p.typ != stReset {
+		reset := packet{header: header{typ: stReset, connID: p.connID, timestamp: microseconds(), ack: p.seq}}
+		s.writeTo(reset.marshal(), addr)
+	}
+}
+
+func (s *Socket) tickLoop() {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			for _, c := range s.connList() {
+				c.tick(now)
+			}
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+func (s *Socket) connList() (conns []*Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		conns = append(conns, c)
+	}
+	return
+}
+
+func (s *Socket) remove(c *Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns[c.key()] == c {
+		delete(s.conns, c.key())
+	}
+}
+
+func (s *Socket) writeTo(b []byte, addr net.Addr) {
+	// Lost packets are sent again, like those lost on the way.
+	s.pc.WriteTo(b, addr)
+}
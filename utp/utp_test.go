@@ -0,0 +1,122 @@
+package utp
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lossyConn drops some of the packets written to it.
+type lossyConn struct {
+	net.PacketConn
+	mu   sync.Mutex
+	rand *rand.Rand
+	loss float64
+}
+
+func (c *lossyConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	drop := c.rand.Float64() < c.loss
+	c.mu.Unlock()
+	if drop {
+		return len(b), nil
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func lossySocket(t *testing.T, seed int64, loss float64) *Socket {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewSocket(&lossyConn{PacketConn: pc, rand: rand.New(rand.NewSource(seed)), loss: loss})
+}
+
+func TestPacket(t *testing.T) {
+	p := packet{header{stData, 1, 2, 3, 4, 5, 6}, []byte("data")}
+	b := p.marshal()
+	got, err := unmarshal(b)
+	if err != nil || got.header != p.header || string(got.payload) != "data" {
+		t.Errorf("Got %+v (%v), wanted %+v", got, err, p)
+	}
+	// An extension, which is skipped.
+	b = append(b[:headerSize], append([]byte{0, 2, 'x', 'x'}, b[headerSize:]...)...)
+	b[1] = 1
+	if got, err = unmarshal(b); err != nil || string(got.payload) != "data" {
+		t.Errorf("Got payload %q (%v) after an extension", got.payload, err)
+	}
+	if _, err = unmarshal(b[:headerSize+3]); err == nil {
+		t.Errorf("Expected an error for a truncated extension")
+	}
+}
+
+func TestSeqLess(t *testing.T) {
+	if !seqLess(1, 2) || seqLess(2, 1) || !seqLess(65535, 0) || seqLess(0, 65535) {
+		t.Errorf("Wrong order of sequence numbers")
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	a := lossySocket(t, 1, 0.05)
+	defer a.Close()
+	b := lossySocket(t, 2, 0.05)
+	defer b.Close()
+
+	data := make([]byte, 300*1024)
+	rand.New(rand.NewSource(3)).Read(data)
+	done := make(chan error, 1)
+	go func() {
+		conn, err := b.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(time.Minute))
+		// Echo everything back, until the other side closes.
+		_, err = io.Copy(conn, conn)
+		done <- err
+	}()
+
+	conn, err := a.Dial(b.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(time.Minute))
+	go func() {
+		conn.Write(data)
+	}()
+	got := make([]byte, len(data))
+	if _, err = io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("Data was corrupted on the way")
+	}
+	conn.Close()
+	if err = <-done; err != nil {
+		t.Errorf("Echo failed: %v", err)
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	a := lossySocket(t, 1, 0)
+	defer a.Close()
+	b := lossySocket(t, 2, 0)
+	defer b.Close()
+	go b.Accept()
+	conn, err := a.Dial(b.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = conn.Read(make([]byte, 1))
+	if e, ok := err.(net.Error); !ok || !e.Timeout() {
+		t.Errorf("Got %v, wanted a timeout", err)
+	}
+}